@@ -4,17 +4,50 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 //	Config - структура хранения конфигурации нашего сервера
 type Config struct {
-	ServerAddress  string      //	адрес запуска сервера
-	DatabaseDSN    string      //	адрес подключения к БД (PostgreSQL)
-	AccrualAddress string      //	адрес доступа к системе расчёта начислений
-	InfoLog        *log.Logger //	logger для информационных сообщений
-	ErrorLog       *log.Logger //	logger для сообщений об ошибках
+	ServerAddress   string        //	адрес запуска сервера
+	DatabaseDSN     string        //	адрес подключения к БД (PostgreSQL) или sqlite://путь к файловой БД sqlite, memory:// - хранение в памяти
+	DBMaxConns      int           //	максимальное количество соединений в пуле PostgreSQL
+	DBMinConns      int           //	количество соединений, которые пул PostgreSQL держит открытыми постоянно
+	DBConnTimeout   time.Duration //	время на установку соединения с PostgreSQL
+	DBHealthCheck   time.Duration //	период проверки простаивающих соединений пула PostgreSQL
+	DBBusyTimeout   time.Duration //	время ожидания блокировки записи файловой БД sqlite
+	AccrualAddress  string        //	адрес доступа к системе расчёта начислений
+	IdempotencyTTL  time.Duration //	срок хранения ответов по ключам идемпотентности
+	PasswordHasher  string        //	алгоритм хеширования паролей пользователей: argon2id или bcrypt
+	SessionTTL      time.Duration //	срок жизни сессии пользователя
+	JWTKeys         string        //	ключи подписи JWT в формате "kid:алгоритм:ключ в base64,..."
+	JWTSigningKey   string        //	kid ключа, которым подписываются новые JWT
+	JWTAccessTTL    time.Duration //	срок действия JWT
+	AdminToken      string        //	токен доступа к административным маршрутам; пустой - административные маршруты отключены
+	ShutdownTimeout time.Duration //	время на завершение обработки запросов и синхронизации при остановке сервера
+	RunMode         string        //	режим работы экземпляра: all - API и синхронизация, api - только API, sync - только синхронизация
+	SyncWorkers     int           //	количество обработчиков, параллельно опрашивающих сервер начислений
+	SyncQueueSize   int           //	максимальное количество заказов, опрашиваемых за один цикл синхронизации
+	SyncBackoffMin  time.Duration //	период цикла синхронизации и пауза перед повторным опросом заказа
+	SyncBackoffMax  time.Duration //	максимальная пауза между опросами одного заказа
+	SyncRateLimit   int           //	начальный лимит запросов в минуту к серверу начислений
+	SyncMaxFailures int           //	количество неудачных опросов заказа подряд, после которого задание переходит в статус DEAD
+	SyncLeaseTTL    time.Duration //	срок аренды задания синхронизации обработчиком
+	HoldTTL         time.Duration //	срок действия резерва баллов
+	HoldInterval    time.Duration //	период возврата в доступный остаток резервов с истёкшим сроком
+	InfoLog         *log.Logger   //	logger для информационных сообщений
+	ErrorLog        *log.Logger   //	logger для сообщений об ошибках
 }
 
+//	режимы работы экземпляра сервера: несколько экземпляров с общей базой данных могут делить API и синхронизацию заказов
+//	между собой; задания синхронизации арендуются в базе, поэтому каждый заказ опрашивает ровно один экземпляр
+const (
+	runModeAll  = "all"  //	API и синхронизация заказов
+	runModeAPI  = "api"  //	только API
+	runModeSync = "sync" //	только синхронизация заказов с сервером начислений
+)
+
 //	newConfig - функция-конфигуратор приложения через считывание флагов и переменных окружения
 func newConfig() (cfg Config) {
 	//	Приоритеты настроек:
@@ -24,8 +57,31 @@ func newConfig() (cfg Config) {
 
 	//	Считываем флаги запуска из командной строки и задаём значения по умолчанию, если флаг при запуске не указан
 	ServerAddress := flag.String("a", "127.0.0.1:8080", "RUN_ADDRESS - адрес запуска сервера")
-	DatabaseDSN := flag.String("d", "", "DATABASE_URI - адрес подключения к БД (PostgreSQL)")
+	DatabaseDSN := flag.String("d", "", "DATABASE_URI - адрес подключения к БД (PostgreSQL) или sqlite://путь к файловой БД sqlite, memory:// - хранение в памяти")
+	DBMaxConns := flag.Int("dmax", 10, "DATABASE_MAX_CONNS - максимальное количество соединений в пуле PostgreSQL")
+	DBMinConns := flag.Int("dmin", 0, "DATABASE_MIN_CONNS - количество соединений, которые пул PostgreSQL держит открытыми постоянно")
+	DBConnTimeout := flag.Duration("dct", 5*time.Second, "DATABASE_CONNECT_TIMEOUT - время на установку соединения с PostgreSQL")
+	DBHealthCheck := flag.Duration("dhc", time.Minute, "DATABASE_HEALTH_CHECK_PERIOD - период проверки простаивающих соединений пула PostgreSQL")
+	DBBusyTimeout := flag.Duration("dbt", 5*time.Second, "SQLITE_BUSY_TIMEOUT - время ожидания блокировки записи файловой БД sqlite")
 	AccrualAddress := flag.String("r", "", "ACCRUAL_SYSTEM_ADDRESS - адрес доступа к системе расчёта начислений")
+	IdempotencyTTL := flag.Duration("i", 24*time.Hour, "IDEMPOTENCY_TTL - срок хранения ответов по ключам идемпотентности")
+	PasswordHasher := flag.String("p", "argon2id", "PASSWORD_HASHER - алгоритм хеширования паролей пользователей: argon2id или bcrypt")
+	SessionTTL := flag.Duration("s", 24*time.Hour, "SESSION_TTL - срок жизни сессии пользователя")
+	JWTKeys := flag.String("k", "", "JWT_KEYS - ключи подписи JWT в формате kid:HS256|EdDSA:ключ в base64, через запятую")
+	JWTSigningKey := flag.String("ks", "", "JWT_SIGNING_KEY - kid ключа, которым подписываются новые JWT")
+	JWTAccessTTL := flag.Duration("kt", 15*time.Minute, "JWT_ACCESS_TTL - срок действия JWT")
+	AdminToken := flag.String("at", "", "ADMIN_TOKEN - токен доступа к административным маршрутам /api/admin, пустой - маршруты отключены")
+	ShutdownTimeout := flag.Duration("st", 10*time.Second, "SHUTDOWN_TIMEOUT - время на завершение обработки запросов и синхронизации при остановке сервера")
+	RunMode := flag.String("m", runModeAll, "RUN_MODE - режим работы экземпляра: all - API и синхронизация заказов, api - только API, sync - только синхронизация заказов")
+	SyncWorkers := flag.Int("w", 4, "SYNC_WORKERS - количество обработчиков, параллельно опрашивающих сервер начислений")
+	SyncQueueSize := flag.Int("q", 100, "SYNC_QUEUE_SIZE - максимальное количество заказов, опрашиваемых за один цикл синхронизации")
+	SyncBackoffMin := flag.Duration("bmin", time.Second, "SYNC_BACKOFF_MIN - период цикла синхронизации и пауза перед повторным опросом заказа")
+	SyncBackoffMax := flag.Duration("bmax", 10*time.Minute, "SYNC_BACKOFF_MAX - максимальная пауза между опросами одного заказа")
+	SyncRateLimit := flag.Int("rl", 0, "SYNC_RATE_LIMIT - начальный лимит запросов в минуту к серверу начислений, 0 - без лимита до первого ответа 429")
+	SyncMaxFailures := flag.Int("mf", 10, "SYNC_MAX_FAILURES - количество ошибок опроса заказа подряд, после которого задание переходит в статус DEAD; недоступность сервера начислений не учитывается")
+	SyncLeaseTTL := flag.Duration("lt", time.Minute, "SYNC_LEASE_TTL - срок аренды задания синхронизации обработчиком")
+	HoldTTL := flag.Duration("ht", 15*time.Minute, "HOLD_TTL - срок действия резерва баллов в счёт оплаты заказа")
+	HoldInterval := flag.Duration("hri", time.Minute, "HOLD_RELEASE_INTERVAL - период возврата в доступный остаток резервов с истёкшим сроком")
 	//	парсим флаги
 	flag.Parse()
 
@@ -34,27 +90,198 @@ func newConfig() (cfg Config) {
 	if u, flg := os.LookupEnv("RUN_ADDRESS"); flg {
 		*ServerAddress = u
 	}
+	if u, flg := os.LookupEnv("RUN_MODE"); flg {
+		*RunMode = u
+	}
 	if u, flg := os.LookupEnv("DATABASE_URI"); flg {
 		*DatabaseDSN = u
 	}
+	if u, flg := os.LookupEnv("DATABASE_MAX_CONNS"); flg {
+		if n, err := strconv.Atoi(u); err == nil && n > 0 {
+			*DBMaxConns = n
+		} else {
+			log.Println("DATABASE_MAX_CONNS is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("DATABASE_MIN_CONNS"); flg {
+		if n, err := strconv.Atoi(u); err == nil && n >= 0 {
+			*DBMinConns = n
+		} else {
+			log.Println("DATABASE_MIN_CONNS is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("DATABASE_CONNECT_TIMEOUT"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*DBConnTimeout = d
+		} else {
+			log.Println("DATABASE_CONNECT_TIMEOUT is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("DATABASE_HEALTH_CHECK_PERIOD"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*DBHealthCheck = d
+		} else {
+			log.Println("DATABASE_HEALTH_CHECK_PERIOD is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SQLITE_BUSY_TIMEOUT"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*DBBusyTimeout = d
+		} else {
+			log.Println("SQLITE_BUSY_TIMEOUT is ignored:", u)
+		}
+	}
 	if u, flg := os.LookupEnv("ACCRUAL_SYSTEM_ADDRESS"); flg {
 		*AccrualAddress = u
 	}
+	if u, flg := os.LookupEnv("PASSWORD_HASHER"); flg {
+		*PasswordHasher = u
+	}
+	if u, flg := os.LookupEnv("SESSION_TTL"); flg {
+		if ttl, err := time.ParseDuration(u); err == nil {
+			*SessionTTL = ttl
+		} else {
+			log.Println("SESSION_TTL is ignored:", err.Error())
+		}
+	}
+	if u, flg := os.LookupEnv("JWT_KEYS"); flg {
+		*JWTKeys = u
+	}
+	if u, flg := os.LookupEnv("JWT_SIGNING_KEY"); flg {
+		*JWTSigningKey = u
+	}
+	if u, flg := os.LookupEnv("ADMIN_TOKEN"); flg {
+		*AdminToken = u
+	}
+	if u, flg := os.LookupEnv("JWT_ACCESS_TTL"); flg {
+		if ttl, err := time.ParseDuration(u); err == nil {
+			*JWTAccessTTL = ttl
+		} else {
+			log.Println("JWT_ACCESS_TTL is ignored:", err.Error())
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_WORKERS"); flg {
+		if n, err := strconv.Atoi(u); err == nil && n > 0 {
+			*SyncWorkers = n
+		} else {
+			log.Println("SYNC_WORKERS is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_QUEUE_SIZE"); flg {
+		if n, err := strconv.Atoi(u); err == nil && n > 0 {
+			*SyncQueueSize = n
+		} else {
+			log.Println("SYNC_QUEUE_SIZE is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_BACKOFF_MIN"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*SyncBackoffMin = d
+		} else {
+			log.Println("SYNC_BACKOFF_MIN is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_BACKOFF_MAX"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*SyncBackoffMax = d
+		} else {
+			log.Println("SYNC_BACKOFF_MAX is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_RATE_LIMIT"); flg {
+		if n, err := strconv.Atoi(u); err == nil && n >= 0 {
+			*SyncRateLimit = n
+		} else {
+			log.Println("SYNC_RATE_LIMIT is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_MAX_FAILURES"); flg {
+		if n, err := strconv.Atoi(u); err == nil && n > 0 {
+			*SyncMaxFailures = n
+		} else {
+			log.Println("SYNC_MAX_FAILURES is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SYNC_LEASE_TTL"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*SyncLeaseTTL = d
+		} else {
+			log.Println("SYNC_LEASE_TTL is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("HOLD_TTL"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*HoldTTL = d
+		} else {
+			log.Println("HOLD_TTL is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("HOLD_RELEASE_INTERVAL"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*HoldInterval = d
+		} else {
+			log.Println("HOLD_RELEASE_INTERVAL is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("SHUTDOWN_TIMEOUT"); flg {
+		if d, err := time.ParseDuration(u); err == nil && d > 0 {
+			*ShutdownTimeout = d
+		} else {
+			log.Println("SHUTDOWN_TIMEOUT is ignored:", u)
+		}
+	}
+	if u, flg := os.LookupEnv("IDEMPOTENCY_TTL"); flg {
+		if ttl, err := time.ParseDuration(u); err == nil {
+			*IdempotencyTTL = ttl
+		} else {
+			log.Println("IDEMPOTENCY_TTL is ignored:", err.Error())
+		}
+	}
+
+	//	в неизвестном режиме экземпляр не запускаем - иначе он молча начнёт синхронизацию или откроет API там, где их не ждут
+	switch *RunMode {
+	case runModeAll, runModeAPI, runModeSync:
+	default:
+		log.Fatalln("RUN_MODE must be one of all, api, sync:", *RunMode)
+	}
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)                  // logger для информационных сообщений
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile) // logger для сообщений об ошибках
 
 	//	собираем конфигурацию сервера
 	cfg = Config{
-		ServerAddress:  *ServerAddress,
-		DatabaseDSN:    *DatabaseDSN,
-		AccrualAddress: *AccrualAddress,
-		InfoLog:        infoLog,
-		ErrorLog:       errorLog,
+		ServerAddress:   *ServerAddress,
+		DatabaseDSN:     *DatabaseDSN,
+		DBMaxConns:      *DBMaxConns,
+		DBMinConns:      *DBMinConns,
+		DBConnTimeout:   *DBConnTimeout,
+		DBHealthCheck:   *DBHealthCheck,
+		DBBusyTimeout:   *DBBusyTimeout,
+		AccrualAddress:  *AccrualAddress,
+		IdempotencyTTL:  *IdempotencyTTL,
+		PasswordHasher:  *PasswordHasher,
+		SessionTTL:      *SessionTTL,
+		JWTKeys:         *JWTKeys,
+		JWTSigningKey:   *JWTSigningKey,
+		JWTAccessTTL:    *JWTAccessTTL,
+		AdminToken:      *AdminToken,
+		ShutdownTimeout: *ShutdownTimeout,
+		RunMode:         *RunMode,
+		SyncWorkers:     *SyncWorkers,
+		SyncQueueSize:   *SyncQueueSize,
+		SyncBackoffMin:  *SyncBackoffMin,
+		SyncBackoffMax:  *SyncBackoffMax,
+		SyncRateLimit:   *SyncRateLimit,
+		SyncMaxFailures: *SyncMaxFailures,
+		SyncLeaseTTL:    *SyncLeaseTTL,
+		HoldTTL:         *HoldTTL,
+		HoldInterval:    *HoldInterval,
+		InfoLog:         infoLog,
+		ErrorLog:        errorLog,
 	}
 
 	//	выводим в лог конфигурацию сервера
-	log.Println("SERVER Gophermart STARTED with configuration:\n   RUN_ADDRESS: ", cfg.ServerAddress, "\n   DATABASE_DSN: ", cfg.DatabaseDSN, "\n   ACCRUAL_SYSTEM_ADDRESS: ", cfg.AccrualAddress)
+	log.Println("SERVER Gophermart STARTED with configuration:\n   RUN_ADDRESS: ", cfg.ServerAddress, "\n   DATABASE_DSN: ", cfg.DatabaseDSN, "\n   DATABASE_MAX_CONNS: ", cfg.DBMaxConns, "\n   DATABASE_MIN_CONNS: ", cfg.DBMinConns, "\n   DATABASE_CONNECT_TIMEOUT: ", cfg.DBConnTimeout, "\n   DATABASE_HEALTH_CHECK_PERIOD: ", cfg.DBHealthCheck, "\n   SQLITE_BUSY_TIMEOUT: ", cfg.DBBusyTimeout, "\n   ACCRUAL_SYSTEM_ADDRESS: ", cfg.AccrualAddress, "\n   IDEMPOTENCY_TTL: ", cfg.IdempotencyTTL, "\n   PASSWORD_HASHER: ", cfg.PasswordHasher, "\n   SESSION_TTL: ", cfg.SessionTTL, "\n   JWT_SIGNING_KEY: ", cfg.JWTSigningKey, "\n   JWT_ACCESS_TTL: ", cfg.JWTAccessTTL, "\n   SHUTDOWN_TIMEOUT: ", cfg.ShutdownTimeout, "\n   RUN_MODE: ", cfg.RunMode, "\n   SYNC_WORKERS: ", cfg.SyncWorkers, "\n   SYNC_QUEUE_SIZE: ", cfg.SyncQueueSize, "\n   SYNC_BACKOFF_MIN: ", cfg.SyncBackoffMin, "\n   SYNC_BACKOFF_MAX: ", cfg.SyncBackoffMax, "\n   SYNC_RATE_LIMIT: ", cfg.SyncRateLimit, "\n   SYNC_MAX_FAILURES: ", cfg.SyncMaxFailures, "\n   SYNC_LEASE_TTL: ", cfg.SyncLeaseTTL, "\n   HOLD_TTL: ", cfg.HoldTTL, "\n   HOLD_RELEASE_INTERVAL: ", cfg.HoldInterval)
 
 	return cfg
 }
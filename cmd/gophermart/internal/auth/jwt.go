@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//	алгоритмы подписи JWT
+const (
+	AlgHS256 = "HS256" //	HMAC SHA-256 с общим секретом
+	AlgEdDSA = "EdDSA" //	Ed25519
+)
+
+//	ErrInvalidToken - ошибка возникающая при проверке JWT с неверной подписью, неизвестным ключом или в неверном формате
+var ErrInvalidToken = errors.New("invalid token")
+
+//	ErrTokenExpired - ошибка возникающая при проверке JWT с истёкшим сроком действия
+var ErrTokenExpired = errors.New("token is expired")
+
+//	Key - ключ подписи JWT
+//	идентификатор ключа (kid) передаётся в заголовке JWT, что позволяет менять ключ подписи (ротация),
+//	продолжая принимать токены, подписанные предыдущими ключами
+type Key struct {
+	ID         string             //	идентификатор ключа - kid
+	Algorithm  string             //	алгоритм подписи: AlgHS256 или AlgEdDSA
+	Secret     []byte             //	общий секрет для HS256
+	PrivateKey ed25519.PrivateKey //	закрытый ключ для EdDSA
+}
+
+//	Claims - содержимое JWT
+type Claims struct {
+	Subject   string `json:"sub"` //	идентификатор пользователя
+	SessionID string `json:"sid"` //	идентификатор сессии, в рамках которой выпущен токен
+	IssuedAt  int64  `json:"iat"` //	время выпуска токена, unix time
+	ExpiresAt int64  `json:"exp"` //	время окончания действия токена, unix time
+}
+
+//	Issuer - выпуск и проверка JWT
+type Issuer struct {
+	Keys       map[string]Key //	все действующие ключи, по kid
+	SigningKey string         //	kid ключа, которым подписываются новые токены
+	AccessTTL  time.Duration  //	срок действия токена
+}
+
+//	NewIssuer - функция конструктор, собирающая Issuer из описания ключей
+//	формат описания ключей: "kid:алгоритм:ключ в base64,kid:алгоритм:ключ в base64", где ключ -
+//	общий секрет для HS256 или seed (32 байта) закрытого ключа Ed25519 для EdDSA
+//	если signingKey не задан - новые токены подписываются первым ключом из списка
+func NewIssuer(keys, signingKey string, accessTTL time.Duration) (*Issuer, error) {
+	issuer := &Issuer{Keys: make(map[string]Key), SigningKey: signingKey, AccessTTL: accessTTL}
+
+	for _, spec := range strings.Split(keys, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("wrong JWT key format: %q", spec)
+		}
+		raw, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("wrong JWT key %q: %w", parts[0], err)
+		}
+
+		key := Key{ID: parts[0], Algorithm: parts[1]}
+		switch key.Algorithm {
+		case AlgHS256:
+			if len(raw) < 32 { //	секрет HS256 должен быть не короче выхода SHA-256
+				return nil, fmt.Errorf("JWT key %q is too short", key.ID)
+			}
+			key.Secret = raw
+		case AlgEdDSA:
+			if len(raw) != ed25519.SeedSize {
+				return nil, fmt.Errorf("JWT key %q must be %d bytes Ed25519 seed", key.ID, ed25519.SeedSize)
+			}
+			key.PrivateKey = ed25519.NewKeyFromSeed(raw)
+		default:
+			return nil, fmt.Errorf("JWT key %q has unsupported algorithm %q", key.ID, key.Algorithm)
+		}
+		if _, ok := issuer.Keys[key.ID]; ok {
+			return nil, fmt.Errorf("JWT key %q is duplicated", key.ID)
+		}
+		issuer.Keys[key.ID] = key
+
+		if issuer.SigningKey == "" {
+			issuer.SigningKey = key.ID
+		}
+	}
+
+	if len(issuer.Keys) == 0 { //	ключи не заданы - авторизация по JWT отключена
+		return nil, nil
+	}
+	if _, ok := issuer.Keys[issuer.SigningKey]; !ok {
+		return nil, fmt.Errorf("JWT signing key %q is not found", issuer.SigningKey)
+	}
+
+	return issuer, nil
+}
+
+//	Issue - метод выпускает JWT для пользователя userID в рамках сессии sessionID
+func (i *Issuer) Issue(userID, sessionID string) (token string, expiresAt time.Time, err error) {
+	key := i.Keys[i.SigningKey]
+	now := time.Now()
+	expiresAt = now.Add(i.AccessTTL)
+
+	header, err := json.Marshal(map[string]string{"alg": key.Algorithm, "typ": "JWT", "kid": key.ID})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(Claims{Subject: userID, SessionID: sessionID, IssuedAt: now.Unix(), ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := encode(header) + "." + encode(claims)
+	return signingInput + "." + encode(sign(key, signingInput)), expiresAt, nil
+}
+
+//	Verify - метод проверяет подпись и срок действия JWT и возвращает его содержимое
+func (i *Issuer) Verify(token string) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decode(parts[0], &header); err != nil {
+		return claims, ErrInvalidToken
+	}
+
+	//	алгоритм берём из ключа, а не из заголовка токена - это исключает подмену алгоритма ("none", HS256 вместо EdDSA)
+	key, ok := i.Keys[header.KeyID]
+	if !ok || key.Algorithm != header.Algorithm {
+		return claims, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	signingInput := parts[0] + "." + parts[1]
+	switch key.Algorithm {
+	case AlgHS256:
+		ok = hmac.Equal(signature, sign(key, signingInput))
+	case AlgEdDSA:
+		ok = ed25519.Verify(key.PrivateKey.Public().(ed25519.PublicKey), []byte(signingInput), signature)
+	}
+	if !ok {
+		return claims, ErrInvalidToken
+	}
+
+	if err := decode(parts[1], &claims); err != nil || claims.Subject == "" {
+		return Claims{}, ErrInvalidToken
+	}
+	if !time.Now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return Claims{}, ErrTokenExpired
+	}
+
+	return claims, nil
+}
+
+//	sign - функция вычисляет подпись JWT ключом key
+func sign(key Key, signingInput string) []byte {
+	if key.Algorithm == AlgEdDSA {
+		return ed25519.Sign(key.PrivateKey, []byte(signingInput))
+	}
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+//	encode - функция кодирует часть JWT в base64url без дополнения
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//	decode - функция декодирует часть JWT из base64url и разбирает JSON
+func decode(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
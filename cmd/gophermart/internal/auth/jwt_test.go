@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//	testKey - функция изготавливает описание ключа для NewIssuer
+func testKey(kid, alg string, size int) string {
+	return kid + ":" + alg + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(kid, size)[:size]))
+}
+
+func TestIssuerRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		keys string
+	}{
+		{name: "HS256", keys: testKey("h1", AlgHS256, 32)},
+		{name: "EdDSA", keys: testKey("e1", AlgEdDSA, 32)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, err := NewIssuer(tt.keys, "", time.Minute)
+			require.NoError(t, err)
+
+			token, expiresAt, err := issuer.Issue("test1", "session1")
+			require.NoError(t, err)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, time.Second)
+
+			claims, err := issuer.Verify(token)
+			require.NoError(t, err)
+			assert.Equal(t, "test1", claims.Subject)
+			assert.Equal(t, "session1", claims.SessionID)
+		})
+	}
+}
+
+func TestIssuerKeyRotation(t *testing.T) {
+	old, err := NewIssuer(testKey("k1", AlgHS256, 32), "", time.Minute)
+	require.NoError(t, err)
+	oldToken, _, err := old.Issue("test1", "session1")
+	require.NoError(t, err)
+
+	//	новый ключ подписывает новые токены, токены старого ключа продолжают приниматься
+	rotated, err := NewIssuer(testKey("k1", AlgHS256, 32)+","+testKey("k2", AlgEdDSA, 32), "k2", time.Minute)
+	require.NoError(t, err)
+	newToken, _, err := rotated.Issue("test1", "session1")
+	require.NoError(t, err)
+
+	_, err = rotated.Verify(oldToken)
+	assert.NoError(t, err)
+	_, err = rotated.Verify(newToken)
+	assert.NoError(t, err)
+
+	//	после удаления старого ключа его токены отклоняются
+	retired, err := NewIssuer(testKey("k2", AlgEdDSA, 32), "", time.Minute)
+	require.NoError(t, err)
+	_, err = retired.Verify(oldToken)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = retired.Verify(newToken)
+	assert.NoError(t, err)
+}
+
+func TestIssuerRejects(t *testing.T) {
+	issuer, err := NewIssuer(testKey("k1", AlgHS256, 32), "", time.Minute)
+	require.NoError(t, err)
+	token, _, err := issuer.Issue("test1", "session1")
+	require.NoError(t, err)
+	parts := strings.Split(token, ".")
+
+	expired := &Issuer{Keys: issuer.Keys, SigningKey: "k1", AccessTTL: -time.Minute}
+	expiredToken, _, err := expired.Issue("test1", "session1")
+	require.NoError(t, err)
+
+	//	подменяем содержимое токена, сохраняя подпись
+	forged := parts[0] + "." + encode([]byte(`{"sub":"test2","sid":"session1","exp":9999999999}`)) + "." + parts[2]
+	//	подменяем алгоритм на "none" без подписи
+	none := encode([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "expired", token: expiredToken, err: ErrTokenExpired},
+		{name: "tampered claims", token: forged, err: ErrInvalidToken},
+		{name: "alg none", token: none, err: ErrInvalidToken},
+		{name: "garbage", token: "abc", err: ErrInvalidToken},
+		{name: "empty", token: "", err: ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := issuer.Verify(tt.token)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestNewIssuerConfig(t *testing.T) {
+	issuer, err := NewIssuer("", "", time.Minute)
+	require.NoError(t, err)
+	assert.Nil(t, issuer) //	без ключей авторизация по JWT отключена
+
+	for _, keys := range []string{
+		testKey("k1", AlgHS256, 16), //	короткий секрет
+		testKey("k1", AlgEdDSA, 16), //	seed неверной длины
+		testKey("k1", "RS256", 32),  //	неподдерживаемый алгоритм
+		"k1:HS256",                  //	неверный формат
+		testKey("k1", AlgHS256, 32) + "," + testKey("k1", AlgHS256, 32), //	повтор kid
+	} {
+		_, err := NewIssuer(keys, "", time.Minute)
+		assert.Error(t, err, keys)
+	}
+
+	_, err = NewIssuer(testKey("k1", AlgHS256, 32), "k2", time.Minute) //	неизвестный ключ подписи
+	assert.Error(t, err)
+}
@@ -2,17 +2,23 @@ package handlers
 
 import (
 	"log"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/auth"
 	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 )
 
 type Application struct {
-	ErrorLog   *log.Logger        //	журнал ошибок
-	InfoLog    *log.Logger        //	журнал информационных сообщений
-	Datasource storage.Datasource //	источник данных для хранения информации о заказах
+	ErrorLog       *log.Logger        //	журнал ошибок
+	InfoLog        *log.Logger        //	журнал информационных сообщений
+	Datasource     storage.Datasource //	источник данных для хранения информации о заказах
+	IdempotencyTTL time.Duration      //	срок хранения ответов по ключам идемпотентности
+	Tokens         *auth.Issuer       //	выпуск и проверка JWT; nil - авторизация по JWT отключена
+	AdminToken     string             //	токен доступа к административным маршрутам; пустой - административные маршруты отключены
+	HoldTTL        time.Duration      //	срок действия резерва баллов; 0 - storage.DefaultHoldTTL
 }
 
 func (app *Application) Routes() chi.Router {
@@ -31,15 +37,42 @@ func (app *Application) Routes() chi.Router {
 	//r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	//	маршруты сервера и их обработчики
-	r.Route("/", func(r chi.Router) {
+	//	маршруты, не требующие авторизации - регистрация и аутентификация пользователя
+	r.Group(func(r chi.Router) {
 		r.Post("/api/user/register", app.UserRegistrationHandler)
 		r.Post("/api/user/login", app.UserAuthenticationHandler)
-		r.Post("/api/user/orders", app.PostUserOrderHandler)
-		r.Post("/api/user/balance/withdraw", app.PostWithdrawRequestHandler)
+		r.Post("/api/user/token", app.UserTokenHandler)
+		r.Post("/api/user/token/refresh", app.RefreshTokenHandler)
+	})
+
+	//	маршруты, требующие авторизации - по cookie "sessionid" или по JWT
+	//	пользователь определяется один раз в middleware Authenticate и передаётся хендлерам через контекст запроса
+	r.Group(func(r chi.Router) {
+		r.Use(app.Authenticate)
+
+		r.Post("/api/user/logout", app.UserLogoutHandler)
+		r.Get("/api/user/sessions", app.GetUserSessionsHandler)
+		r.Delete("/api/user/sessions/{id}", app.DeleteUserSessionHandler)
+		//	запросы на изменение данных поддерживают повтор с заголовком Idempotency-Key
+		r.With(app.Idempotent).Post("/api/user/orders", app.PostUserOrderHandler)
+		r.With(app.Idempotent).Post("/api/user/balance/withdraw", app.PostWithdrawRequestHandler)
 		r.Get("/api/user/orders", app.GetUserOrdersHandler)
+		r.Get("/api/user/orders/{number}", app.GetUserOrderHandler)
 		r.Get("/api/user/balance", app.GetUserBalanceHandler)
 		r.Get("/api/user/balance/withdrawals", app.GetUserWithdrawalsHandler)
+		r.With(app.Idempotent).Post("/api/user/balance/withdrawals/{order}/refund", app.PostWithdrawalRefundHandler)
+		r.With(app.Idempotent).Post("/api/user/balance/holds", app.PostUserHoldHandler)
+		r.With(app.Idempotent).Post("/api/user/balance/holds/{id}/capture", app.PostUserHoldCaptureHandler)
+		r.With(app.Idempotent).Post("/api/user/balance/holds/{id}/release", app.PostUserHoldReleaseHandler)
+	})
+
+	//	административные маршруты - по токену администратора
+	r.Group(func(r chi.Router) {
+		r.Use(app.AuthenticateAdmin)
+
+		r.Post("/api/admin/withdrawals/{order}/refund", app.PostAdminWithdrawalRefundHandler)
+		//	метрики обмена с сервером начислений в формате expvar
+		r.Get("/debug/vars", app.GetAdminMetricsHandler)
 	})
 
 	return r
@@ -50,9 +83,26 @@ func (app *Application) Routes() chi.Router {
 
 POST /api/user/register — регистрация пользователя;
 POST /api/user/login — аутентификация пользователя;
+POST /api/user/token — аутентификация пользователя с выдачей JWT и refresh token;
+POST /api/user/token/refresh — продление сессии по refresh token с выдачей новой пары токенов;
+POST /api/user/logout — завершение текущей сессии пользователя;
+GET /api/user/sessions — получение списка действующих сессий пользователя;
+DELETE /api/user/sessions/{id} — завершение одной из сессий пользователя;
 POST /api/user/orders — загрузка пользователем номера заказа для расчёта;
 GET /api/user/orders — получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях;
-GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя;
+GET /api/user/orders/{number} — получение заказа пользователя с историей смены статусов его обработки;
+GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя: доступный остаток, резервы и сумма списаний;
 POST /api/user/balance/withdraw — запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа;
-GET /api/user/balance/withdrawals — получение информации о выводе средств с накопительного счёта пользователем.
+GET /api/user/balance/withdrawals — получение информации о выводе средств с накопительного счёта пользователем;
+POST /api/user/balance/withdrawals/{order}/refund — возврат на счёт баллов, списанных в счёт отменённого заказа, полностью или частично;
+POST /api/user/balance/holds — резервирование баллов в счёт оплаты нового заказа на ограниченный срок;
+POST /api/user/balance/holds/{id}/capture — списание резерва баллов в счёт оплаты заказа;
+POST /api/user/balance/holds/{id}/release — возврат резерва баллов в доступный остаток.
+
+POST /api/admin/withdrawals/{order}/refund — возврат баллов по списанию любого пользователя администратором.
+
+GET /debug/vars — метрики обмена с системой расчёта начислений для администратора: лимит запросов и количество ответов 429.
+
+Все запросы, кроме регистрации и аутентификации, принимаются с cookie "sessionid" или с заголовком "Authorization: Bearer <JWT>".
+Административные запросы принимаются с заголовком "Authorization: Bearer <токен администратора>".
 */
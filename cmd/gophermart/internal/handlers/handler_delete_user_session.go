@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	DeleteUserSessionHandler - обработчик завершения одной из сессий пользователя по её идентификатору
+func (app *Application) DeleteUserSessionHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	//	закрываем сессию с идентификатором из пути запроса
+	err := app.Datasource.DeleteSession(r.Context(), user.UserID, chi.URLParam(r, "id"))
+
+	if errors.Is(err, storage.ErrNoDataToAnswer) { //	если у пользователя нет сессии с таким идентификатором
+		http.Error(w, "session is not found", http.StatusNotFound) // отвечаем со статусом 404
+		return
+	}
+	if err != nil { //													при любых других ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
+		return
+	}
+
+	//	если сессия закрыта - отвечаем со статусом 200
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	GetAdminMetricsHandler - обработчик запроса метрик обмена с сервером начислений
+//	выдаются только метрики сервиса - в формате expvar, но без общего реестра с cmdline и memstats
+func (app *Application) GetAdminMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
+	w.Write([]byte(`{"accrual": ` + storage.SyncMetrics().String() + "}"))
+}
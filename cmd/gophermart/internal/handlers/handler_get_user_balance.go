@@ -3,21 +3,18 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 )
 
 //	GetUserBalanceHandler - обработчик запроса баланса счёта пользователя в системе
 func (app *Application) GetUserBalanceHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	sessionID, err := r.Cookie("sessionid") //	считываем идентификатор сессии из cookie запроса
-	//	если идентификатор сессии отсутствует в cookie - пользователь не авторизован
-	if err != nil || sessionID.Value == "" { // 		отвечаем со статусом 401
-		http.Error(w, "please, authorise previously", http.StatusUnauthorized)
-		return
-	}
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
 
 	//	производим запрос баланса баллов данного пользователя
-	accrualSum, withdrawSum, err := app.Datasource.GetBalance(sessionID.Value)
+	current, held, withdrawSum, err := app.Datasource.GetBalance(r.Context(), user.UserID)
 
 	if err != nil { //											при любых ошибках запроса баланса
 		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
@@ -25,14 +22,18 @@ func (app *Application) GetUserBalanceHandler(w http.ResponseWriter, r *http.Req
 	}
 
 	//	описываем структуру для отправки данных о балансе счёта пользователя в JSON виде
+	//	баллы кодируются в JSON как десятичные числа с точностью до сотых
+	//	current - доступный остаток, held - баллы, зарезервированные в счёт ещё не оплаченных заказов
 	type balance struct {
-		Current   float32 `json:"current"`
-		Withdrawn float32 `json:"withdrawn"`
+		Current   storage.Points `json:"current"`
+		Held      storage.Points `json:"held"`
+		Withdrawn storage.Points `json:"withdrawn"`
 	}
 
 	//	создаём экземпляр структуры balance
 	userBalance := balance{
-		Current:   accrualSum,
+		Current:   current,
+		Held:      held,
 		Withdrawn: withdrawSum,
 	}
 
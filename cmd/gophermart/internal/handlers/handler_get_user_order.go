@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	GetUserOrderHandler - обработчик запроса заказа пользователя с историей смены статусов его обработки
+func (app *Application) GetUserOrderHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	//	производим запрос заказа с номером из пути запроса
+	order, err := app.Datasource.GetOrder(r.Context(), user.UserID, chi.URLParam(r, "number"))
+
+	if errors.Is(err, storage.ErrNoDataToAnswer) { //	если у пользователя нет заказа с таким номером
+		http.Error(w, "order is not found", http.StatusNotFound) // отвечаем со статусом 404
+		return
+	}
+	if err != nil { //													при любых других ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
+		return
+	}
+
+	body, err := json.Marshal(order) //	кодируем информацию в JSON
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	// Изготавливаем и возвращаем ответ, вставляя заказ и его историю в тело ответа в JSON виде
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
+	w.Write(body)                //	пишем JSON в тело ответа
+}
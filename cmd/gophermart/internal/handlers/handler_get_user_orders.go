@@ -3,24 +3,38 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
-	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 	"net/http"
+	"strings"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 )
 
 //	GetUserOrdersHandler - обработчик заявок на выдачу списка заказов пользователя для начисление баллов
+//	список выдаётся постранично: параметры limit, after, from, to и sort разбирает parseListParams,
+//	параметр status (повторяющийся или через запятую) оставляет заказы только с этими статусами
+//	курсор следующей страницы передаётся в заголовке X-Next-Cursor
 func (app *Application) GetUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	sessionID, err := r.Cookie("sessionid") //	считываем идентификатор сессии из cookie запроса
-	//	если идентификатор сессии отсутствует в cookie - пользователь не авторизован
-	if err != nil || sessionID.Value == "" { // 		отвечаем со статусом 401
-		http.Error(w, "please, authorise previously", http.StatusUnauthorized)
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	params, err := parseListParams(r)
+	if err != nil { //	при некорректных параметрах запроса
+		http.Error(w, err.Error(), http.StatusBadRequest) //	отвечаем со статусом 400
 		return
 	}
+	statuses := queryValues(r, "status")
+	for i := range statuses {
+		statuses[i] = strings.ToUpper(statuses[i])
+	}
 
-	//	производим запрос списка заказов для начисления баллов, сформированного данным пользователем
-	orders, err := app.Datasource.GetOrders(sessionID.Value)
+	//	производим запрос страницы списка заказов для начисления баллов, сформированного данным пользователем
+	orders, next, err := app.Datasource.GetOrders(r.Context(), user.UserID, storage.OrdersFilter{ListParams: params, Statuses: statuses})
 
+	if errors.Is(err, storage.ErrInvalidListParams) { //	если курсор, статус или период некорректны
+		http.Error(w, err.Error(), http.StatusBadRequest) //	отвечаем со статусом 400
+		return
+	}
 	if errors.Is(err, storage.ErrNoDataToAnswer) { //		если список заказов пуст
 		http.Error(w, err.Error(), http.StatusNoContent) // отвечаем со статусом 204
 		return
@@ -41,6 +55,9 @@ func (app *Application) GetUserOrdersHandler(w http.ResponseWriter, r *http.Requ
 
 	// Изготавливаем и возвращаем ответ, вставляя список заказов в тело ответа в JSON виде
 	w.Header().Set("Content-Type", "application/json")
+	if next != "" { //	если у списка есть следующая страница
+		w.Header().Set(nextCursorHeader, next)
+	}
 	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
 	w.Write(body)                //	пишем JSON в тело ответа
 }
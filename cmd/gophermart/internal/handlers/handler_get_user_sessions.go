@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	GetUserSessionsHandler - обработчик запроса списка действующих сессий пользователя
+func (app *Application) GetUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	//	производим запрос списка сессий данного пользователя
+	sessions, err := app.Datasource.GetSessions(r.Context(), user.UserID, user.SessionID)
+
+	if errors.Is(err, storage.ErrNoDataToAnswer) { //		если список сессий пуст
+		http.Error(w, err.Error(), http.StatusNoContent) // отвечаем со статусом 204
+		return
+	}
+	if err != nil { //													при любых других ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
+		return
+	}
+
+	body, err := json.Marshal(sessions) //	кодируем информацию в JSON
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	// Изготавливаем и возвращаем ответ, вставляя список сессий в тело ответа в JSON виде
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
+	w.Write(body)                //	пишем JSON в тело ответа
+}
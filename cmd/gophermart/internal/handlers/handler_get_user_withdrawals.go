@@ -3,34 +3,74 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
-	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 	"net/http"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 )
 
+//	withdrawalsStatement - выписка по списаниям: страница списка и итоги за весь запрошенный период
+type withdrawalsStatement struct {
+	Withdrawals []storage.Withdraw         `json:"withdrawals"`    //	страница списка списаний
+	Summary     storage.WithdrawalsSummary `json:"summary"`        //	количество и сумма списаний за период
+	Next        string                     `json:"next,omitempty"` //	курсор следующей страницы
+}
+
 //	GetUserWithdrawalsHandler - обработчик заявок списание баллов в счёт новых заказов
+//	список выдаётся постранично: параметры limit, after, from, to и sort разбирает parseListParams,
+//	курсор следующей страницы передаётся в заголовке X-Next-Cursor
+//	с параметром summary=true ответ - выписка withdrawalsStatement с итогами за период from - to
 func (app *Application) GetUserWithdrawalsHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	sessionID, err := r.Cookie("sessionid") //	считываем идентификатор сессии из cookie запроса
-	//	если идентификатор сессии отсутствует в cookie - пользователь не авторизован
-	if err != nil || sessionID.Value == "" { // 		отвечаем со статусом 401
-		http.Error(w, "please, authorise previously", http.StatusUnauthorized)
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	params, err := parseListParams(r)
+	if err != nil { //	при некорректных параметрах запроса
+		http.Error(w, err.Error(), http.StatusBadRequest) //	отвечаем со статусом 400
+		return
+	}
+	withSummary := false
+	switch r.URL.Query().Get("summary") {
+	case "", "false":
+	case "true":
+		withSummary = true
+	default:
+		http.Error(w, errInvalidQuery.Error(), http.StatusBadRequest)
 		return
 	}
 
-	//	производим запрос списка заявок на списание баллов, сформированного данным пользователем
-	withdrawals, err := app.Datasource.GetWithdrawals(sessionID.Value)
+	//	производим запрос страницы списка заявок на списание баллов, сформированного данным пользователем
+	withdrawals, next, err := app.Datasource.GetWithdrawals(r.Context(), user.UserID, params)
 
-	if errors.Is(err, storage.ErrNoDataToAnswer) { //		если список заявок пуст
+	if errors.Is(err, storage.ErrInvalidListParams) { //	если курсор или период некорректны
+		http.Error(w, err.Error(), http.StatusBadRequest) //	отвечаем со статусом 400
+		return
+	}
+	if errors.Is(err, storage.ErrNoDataToAnswer) && !withSummary { //	если список заявок пуст
 		http.Error(w, err.Error(), http.StatusNoContent) // отвечаем со статусом 204
 		return
 	}
-	if err != nil { //													при любых других ошибках
+	if err != nil && !errors.Is(err, storage.ErrNoDataToAnswer) { //	при любых других ошибках
 		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
 		return
 	}
 
-	body, err := json.Marshal(withdrawals) //	кодируем информацию в JSON
+	var body []byte
+	if withSummary { //	выписка выдаётся и за период без списаний - с пустым списком и нулевыми итогами
+		statement := withdrawalsStatement{Withdrawals: withdrawals, Next: next}
+		if statement.Withdrawals == nil {
+			statement.Withdrawals = make([]storage.Withdraw, 0)
+		}
+		statement.Summary, err = app.Datasource.GetWithdrawalsSummary(r.Context(), user.UserID, params.From, params.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			app.ErrorLog.Println(err.Error())
+			return
+		}
+		body, err = json.Marshal(statement) //	кодируем информацию в JSON
+	} else {
+		body, err = json.Marshal(withdrawals) //	кодируем информацию в JSON
+	}
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -40,6 +80,9 @@ func (app *Application) GetUserWithdrawalsHandler(w http.ResponseWriter, r *http
 
 	// Изготавливаем и возвращаем ответ, вставляя список заявок в тело ответа в JSON виде
 	w.Header().Set("Content-Type", "application/json")
+	if next != "" { //	если у списка есть следующая страница
+		w.Header().Set(nextCursorHeader, next)
+	}
 	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
 	w.Write(body)                //	пишем JSON в тело ответа
 }
@@ -0,0 +1,11 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+//	PostAdminWithdrawalRefundHandler - обработчик заявки администратора на возврат баллов по списанию любого пользователя
+//	формат запроса и ответа тот же, что и у PostWithdrawalRefundHandler
+func (app *Application) PostAdminWithdrawalRefundHandler(w http.ResponseWriter, r *http.Request) {
+	app.refundWithdrawal(w, r, "") //	пустой пользователь - возврат от имени администратора
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/theplant/luhn" //	алгоритм Луна для проверки корректности номера
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	PostUserHoldHandler - обработчик заявки на резервирование баллов в счёт оплаты нового заказа
+//	зарезервированные баллы недоступны для других списаний до списания резерва, его возврата или истечения срока HoldTTL
+func (app *Application) PostUserHoldHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	body, err := io.ReadAll(r.Body) //	считываем информации о заявке из тела запроса
+
+	if err != nil { // при любых ошибках получения данных из запроса - отвечаем со статусом 400
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	//	описываем структуру для приема заявки в JSON виде - она совпадает с заявкой на списание
+	var holdIn struct {
+		Order string         `json:"order"`
+		Sum   storage.Points `json:"sum"`
+	}
+	if err := json.Unmarshal(body, &holdIn); err != nil { //	проверяем успешно ли парсится JSON
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.ErrorLog.Println("JSON body parsing error:", err.Error())
+		return
+	}
+
+	orderNum, err := strconv.Atoi(holdIn.Order) // конвертируем в целочисленный номер заказа
+	if err != nil || !luhn.Valid(orderNum) {    //	если номер заказа некорректный - отвечаем со статусом 422
+		http.Error(w, "wrong order number format", http.StatusUnprocessableEntity)
+		return
+	}
+	if holdIn.Sum <= 0 { //	если сумма резерва после округления до сотых не положительна - отвечаем со статусом 422
+		http.Error(w, "hold sum must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+
+	//	резервируем баллы на срок HoldTTL
+	hold, err := app.Datasource.HoldRequest(r.Context(), holdIn.Order, holdIn.Sum, user.UserID, app.HoldTTL)
+
+	if errors.Is(err, storage.ErrInsufficientFundsToAccount) { //	если доступных баллов на счёте недостаточно
+		http.Error(w, err.Error(), http.StatusPaymentRequired) // отвечаем со статусом 402
+		return
+	}
+	if errors.Is(err, storage.ErrWithdrawalExist) || errors.Is(err, storage.ErrHoldExist) || errors.Is(err, storage.ErrOrderExistToAnother) {
+		//	если по заказу уже есть списание или резерв, либо заказ зарегистрирован ДРУГИМ пользователем
+		http.Error(w, err.Error(), http.StatusConflict) //	отвечаем со статусом 409
+		return
+	}
+	if err != nil { //													при любых других ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
+		return
+	}
+
+	app.writeHold(w, hold, http.StatusCreated) //	отвечаем со статусом 201
+}
+
+//	writeHold - функция возвращает резерв баллов в теле ответа в JSON виде
+func (app *Application) writeHold(w http.ResponseWriter, hold storage.Hold, status int) {
+	body, err := json.Marshal(hold) //	кодируем информацию в JSON
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body) //	пишем JSON в тело ответа
+}
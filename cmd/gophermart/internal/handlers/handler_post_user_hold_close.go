@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	PostUserHoldCaptureHandler - обработчик списания резерва баллов в счёт оплаты заказа, для которого он оформлен
+func (app *Application) PostUserHoldCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	app.closeHold(w, r, app.Datasource.HoldCapture)
+}
+
+//	PostUserHoldReleaseHandler - обработчик возврата резерва баллов в доступный остаток, например при отказе от заказа
+func (app *Application) PostUserHoldReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	app.closeHold(w, r, app.Datasource.HoldRelease)
+}
+
+//	closeHold - функция закрывает резерв с идентификатором из пути запроса методом хранилища closeFunc
+func (app *Application) closeHold(w http.ResponseWriter, r *http.Request, closeFunc func(ctx context.Context, id, userID string) (storage.Hold, error)) {
+	defer r.Body.Close()
+
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	hold, err := closeFunc(r.Context(), chi.URLParam(r, "id"), user.UserID)
+
+	if errors.Is(err, storage.ErrNoDataToAnswer) { //	если такого резерва у пользователя нет
+		http.Error(w, "hold is not found", http.StatusNotFound) // отвечаем со статусом 404
+		return
+	}
+	if errors.Is(err, storage.ErrHoldClosed) || errors.Is(err, storage.ErrHoldExpired) || errors.Is(err, storage.ErrWithdrawalExist) {
+		//	если резерв уже списан, возвращён или истёк
+		http.Error(w, err.Error(), http.StatusConflict) //	отвечаем со статусом 409
+		return
+	}
+	if err != nil { //													при любых других ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
+		return
+	}
+
+	app.writeHold(w, hold, http.StatusOK) //	отвечаем со статусом 200
+}
@@ -15,12 +15,7 @@ import (
 func (app *Application) PostUserOrderHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	sessionID, err := r.Cookie("sessionid") //	считываем идентификатор сессии из cookie запроса
-	//	если идентификатор сессии отсутствует в cookie - пользователь не авторизован
-	if err != nil || sessionID.Value == "" { // 		отвечаем со статусом 401
-		http.Error(w, "please, authorise previously", http.StatusUnauthorized)
-		return
-	}
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
 
 	order, err := io.ReadAll(r.Body) //	считываем номер заказа из тела запроса
 
@@ -38,7 +33,7 @@ func (app *Application) PostUserOrderHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	//	производим вставку нового номера заказа в базу для начисления баллов
-	err = app.Datasource.OrderInsert(string(order), sessionID.Value)
+	err = app.Datasource.OrderInsert(r.Context(), string(order), user.UserID)
 
 	if errors.Is(err, storage.ErrOrderExistToAccount) { //	если такой заказ уже зарегистрирован ТЕКУЩИМ пользователем
 		http.Error(w, err.Error(), http.StatusOK) // отвечаем со статусом 200
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/theplant/luhn" //	алгоритм Луна для проверки корректности номера
+
 	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 )
 
@@ -14,12 +16,7 @@ import (
 func (app *Application) PostWithdrawRequestHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	sessionID, err := r.Cookie("sessionid") //	считываем идентификатор сессии из cookie запроса
-	//	если идентификатор сессии отсутствует в cookie - пользователь не авторизован
-	if err != nil || sessionID.Value == "" { // 		отвечаем со статусом 401
-		http.Error(w, "please, authorise previously", http.StatusUnauthorized)
-		return
-	}
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
 
 	body, err := io.ReadAll(r.Body) //	считываем информации о заявке из тела запроса
 
@@ -30,9 +27,10 @@ func (app *Application) PostWithdrawRequestHandler(w http.ResponseWriter, r *htt
 	}
 
 	//	описываем структуру для приема заявки в JSON виде
+	//	сумма разбирается в storage.Points с округлением до сотых по правилу "половина от нуля"
 	type withdrawOrder struct {
-		Order string  `json:"order"`
-		Sum   float32 `json:"sum"`
+		Order string         `json:"order"`
+		Sum   storage.Points `json:"sum"`
 	}
 	//	создаём экземпляр структуры withdrawOrder
 	withdrawIn := withdrawOrder{}
@@ -46,22 +44,37 @@ func (app *Application) PostWithdrawRequestHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
-	// проверяем, конвертируется ли считанный номер заказа в целочисленное значение
-	_, err = strconv.ParseInt(withdrawIn.Order, 10, 64)
+	orderNum, err := strconv.Atoi(withdrawIn.Order) // конвертируем в целочисленный номер заказа
+	//	проводим проверку номера заказа через алгоритм Луна, как и при регистрации заказа для начисления баллов
+	if err != nil || !luhn.Valid(orderNum) { //	если номер заказа некорректный - отвечаем со статусом 422
+		http.Error(w, "wrong order number format", http.StatusUnprocessableEntity)
+		return
+	}
 
-	if err != nil { //	если номер заказа не является набором цифр - отвечаем со статусом 422
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
-		app.ErrorLog.Println(err.Error())
+	if withdrawIn.Sum <= 0 { //	если сумма списания после округления до сотых не положительна - отвечаем со статусом 422
+		http.Error(w, "withdraw sum must be positive", http.StatusUnprocessableEntity)
 		return
 	}
 
 	//	производим вставку новой заявки на списание баллов в базу
-	err = app.Datasource.WithdrawRequest(withdrawIn.Order, withdrawIn.Sum, sessionID.Value)
-	
+	err = app.Datasource.WithdrawRequest(r.Context(), withdrawIn.Order, withdrawIn.Sum, user.UserID)
+
 	if errors.Is(err, storage.ErrInsufficientFundsToAccount) { //	если на счёте недостаточно средств
 		http.Error(w, err.Error(), http.StatusPaymentRequired) // отвечаем со статусом 402
 		return
 	}
+	if errors.Is(err, storage.ErrWithdrawalExist) { //	если в счёт этого заказа баллы уже списывались
+		http.Error(w, err.Error(), http.StatusConflict) //	отвечаем со статусом 409
+		return
+	}
+	if errors.Is(err, storage.ErrHoldExist) { //	если по этому заказу баллы уже зарезервированы
+		http.Error(w, err.Error(), http.StatusConflict) //	отвечаем со статусом 409
+		return
+	}
+	if errors.Is(err, storage.ErrOrderExistToAnother) { //	если заказ зарегистрирован для начисления баллов ДРУГИМ пользователем
+		http.Error(w, err.Error(), http.StatusConflict) //	отвечаем со статусом 409
+		return
+	}
 	if err != nil { //							при любых других ошибках при вставке заказа в базу
 		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
 		return
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	PostWithdrawalRefundHandler - обработчик заявки пользователя на возврат баллов, списанных в счёт заказа, например при его отмене
+//	в теле запроса может быть указана сумма частичного возврата {"sum": 10}, без неё возвращаются все ещё не возвращённые баллы
+func (app *Application) PostWithdrawalRefundHandler(w http.ResponseWriter, r *http.Request) {
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	app.refundWithdrawal(w, r, user.UserID)
+}
+
+//	refundWithdrawal - функция выполняет возврат баллов по списанию с номером заказа из пути запроса
+//	от имени пользователя userID или, если он пустой, от имени администратора
+func (app *Application) refundWithdrawal(w http.ResponseWriter, r *http.Request, userID string) {
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body) //	считываем сумму возврата из тела запроса
+
+	if err != nil { // при любых ошибках получения данных из запроса - отвечаем со статусом 400
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	//	описываем структуру для приема заявки в JSON виде
+	//	сумма разбирается в storage.Points с округлением до сотых по правилу "половина от нуля";
+	//	отсутствующая сумма (nil) отличается от нулевой: без суммы возвращаются все баллы, а нулевая сумма - ошибка
+	var refundIn struct {
+		Sum *storage.Points `json:"sum"`
+	}
+	if len(body) > 0 { //	пустое тело - возврат всей суммы
+		if err := json.Unmarshal(body, &refundIn); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			app.ErrorLog.Println("JSON body parsing error:", err.Error())
+			return
+		}
+	}
+	if refundIn.Sum != nil && *refundIn.Sum <= 0 { //	если сумма возврата после округления до сотых не положительна - отвечаем со статусом 422
+		http.Error(w, "refund sum must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+
+	//	производим возврат баллов по списанию с номером заказа из пути запроса
+	withdraw, err := app.Datasource.RefundWithdrawal(r.Context(), chi.URLParam(r, "order"), refundIn.Sum, userID)
+
+	if errors.Is(err, storage.ErrNoDataToAnswer) { //	если списания в счёт такого заказа нет
+		http.Error(w, "withdrawal is not found", http.StatusNotFound) // отвечаем со статусом 404
+		return
+	}
+	if errors.Is(err, storage.ErrWithdrawalRefunded) { //	если баллы по списанию уже полностью возвращены
+		http.Error(w, err.Error(), http.StatusConflict) //	отвечаем со статусом 409
+		return
+	}
+	if errors.Is(err, storage.ErrRefundExceedsWithdrawal) || errors.Is(err, storage.ErrInvalidPoints) { //	если сумма возврата больше невозвращённого остатка списания или не положительна
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity) //	отвечаем со статусом 422
+		return
+	}
+	if err != nil { //													при любых других ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError) //	отвечаем со статусом 500
+		return
+	}
+
+	body, err = json.Marshal(withdraw) //	кодируем информацию в JSON
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	// Изготавливаем и возвращаем ответ, вставляя списание с суммой возврата в тело ответа в JSON виде
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
+	w.Write(body)                //	пишем JSON в тело ответа
+}
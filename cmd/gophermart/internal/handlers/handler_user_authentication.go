@@ -6,7 +6,6 @@ import (
 	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 	"io"
 	"net/http"
-	"time"
 )
 
 //	UserAuthenticationHandler - обработчик авторизации пользователя в системе
@@ -36,7 +35,7 @@ func (app *Application) UserAuthenticationHandler(w http.ResponseWriter, r *http
 	}
 
 	//	проверяем логин/пароль пользователя
-	sessionID, err := app.Datasource.UserAuthorise(jsonUser.UserID, jsonUser.Password)
+	sessionID, expiresAt, err := app.Datasource.UserAuthorise(r.Context(), jsonUser.UserID, jsonUser.Password, sessionMeta(r))
 	if errors.Is(err, storage.ErrLoginPasswordIsWrong) { //	если логин/пароль не совпадают с зарегистрированными
 		http.Error(w, "login or password is wrong", http.StatusUnauthorized)
 		return
@@ -47,9 +46,9 @@ func (app *Application) UserAuthenticationHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	//	при успешной авторизации пользователя, изготавливаем cookie "sessionid", со сроком жизни - 1 день
+	//	при успешной авторизации пользователя, изготавливаем cookie "sessionid", со сроком жизни сессии
 	cookie := &http.Cookie{
-		Name: "sessionid", Value: sessionID, Expires: time.Now().AddDate(0, 0, 1),
+		Name: "sessionid", Value: sessionID, Expires: expiresAt,
 	}
 	//	вставляем cookie в response
 	http.SetCookie(w, cookie)
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	UserLogoutHandler - обработчик завершения текущей сессии пользователя
+func (app *Application) UserLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+
+	//	закрываем сессию в хранилище - после этого cookie и refresh token перестают действовать
+	err := app.Datasource.UserLogout(r.Context(), user.UserID, user.SessionID)
+
+	if errors.Is(err, storage.ErrSessionNotFound) { //	если сессия не найдена или уже закрыта - пользователь не авторизован
+		http.Error(w, "please, authorise previously", http.StatusUnauthorized)
+		return
+	}
+	if err != nil { //	при всех остальных ошибках
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	//	очищаем cookie с идентификатором сессии
+	http.SetCookie(w, &http.Cookie{Name: "sessionid", MaxAge: -1})
+
+	//	высылаем ответ со статусом 200
+	w.WriteHeader(http.StatusOK)
+}
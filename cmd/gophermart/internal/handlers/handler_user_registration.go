@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"net"
 	"net/http"
-	"time"
 
 	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 )
@@ -17,6 +17,16 @@ type User struct {
 	Password string `json:"password"` //  пароль пользователя (hash)
 }
 
+//	sessionMeta - функция собирает информацию о клиенте, открывающем сессию
+//	используется в обработчиках UserAuthenticationHandler и UserRegistrationHandler
+func sessionMeta(r *http.Request) storage.SessionMeta {
+	ip := r.RemoteAddr //	адрес клиента уже подменён middleware RealIP, если запрос пришёл через прокси
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return storage.SessionMeta{UserAgent: r.UserAgent(), IP: ip}
+}
+
 //	UserRegistrationHandler - обработчик регистрации нового пользователя
 //	в случае успеха выдаёт пользователю cookie для дальнейшей авторизованной работы в системе
 func (app *Application) UserRegistrationHandler(w http.ResponseWriter, r *http.Request) {
@@ -44,7 +54,7 @@ func (app *Application) UserRegistrationHandler(w http.ResponseWriter, r *http.R
 	}
 
 	//	создаём нового пользователя
-	sessionID, err := app.Datasource.UserRegister(jsonUser.UserID, jsonUser.Password)
+	sessionID, expiresAt, err := app.Datasource.UserRegister(r.Context(), jsonUser.UserID, jsonUser.Password, sessionMeta(r))
 
 	if errors.Is(err, storage.ErrUserAlreadyExist) { //	если такой пользователь уже существует
 		http.Error(w, "user with same login already exist", http.StatusConflict)
@@ -56,9 +66,9 @@ func (app *Application) UserRegistrationHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	//	при успешном создании нового пользователя, изготавливаем cookie "sessionid", со сроком жизни - 1 день
+	//	при успешном создании нового пользователя, изготавливаем cookie "sessionid", со сроком жизни сессии
 	cookie := &http.Cookie{
-		Name: "sessionid", Value: sessionID, Expires: time.Now().AddDate(0, 0, 1),
+		Name: "sessionid", Value: sessionID, Expires: expiresAt,
 	}
 
 	//	вставляем cookie в response
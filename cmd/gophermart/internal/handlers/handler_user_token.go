@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	tokenResponse - структура для выдачи пары токенов пользователю в виде JSON
+//	используется в обработчиках UserTokenHandler и RefreshTokenHandler
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`  //	JWT для заголовка "Authorization: Bearer"
+	TokenType    string `json:"token_type"`    //	тип токена - всегда "Bearer"
+	ExpiresIn    int64  `json:"expires_in"`    //	срок действия JWT в секундах
+	RefreshToken string `json:"refresh_token"` //	одноразовый токен для продления сессии
+}
+
+//	UserTokenHandler - обработчик авторизации пользователя для клиентов, работающих без cookie
+//	в случае успеха выдаёт пользователю JWT и refresh token, привязанные к новой сессии
+func (app *Application) UserTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if app.Tokens == nil { //	если ключи подписи JWT не заданы - отвечаем со статусом 501
+		http.Error(w, "JWT authorization is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body) // считываем JSON содержимое тела запроса
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.ErrorLog.Println("JSON body read error:", err.Error())
+		return
+	}
+
+	jsonUser := User{} //	создаём экземпляр структуры для заполнения из JSON
+
+	//	парсим JSON из тела запроса и записываем результат в экземпляр структуры User
+	err = json.Unmarshal(body, &jsonUser)
+
+	if err != nil { //	проверяем успешно ли парсится JSON
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.ErrorLog.Println("JSON body parsing error:", err.Error())
+		return
+	}
+
+	//	проверяем логин/пароль пользователя - секретное значение новой сессии становится refresh token
+	refreshToken, _, err := app.Datasource.UserAuthorise(r.Context(), jsonUser.UserID, jsonUser.Password, sessionMeta(r))
+	if errors.Is(err, storage.ErrLoginPasswordIsWrong) { //	если логин/пароль не совпадают с зарегистрированными
+		http.Error(w, "login or password is wrong", http.StatusUnauthorized)
+		return
+	}
+	if err != nil { //	при всех остальных ошибках авторизации пользователя
+		http.Error(w, "unable to authorise user", http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	//	получаем идентификатор открытой сессии, который войдёт в JWT
+	userID, sessionID, err := app.Datasource.SessionUser(r.Context(), refreshToken)
+	if err != nil {
+		http.Error(w, "unable to authorise user", http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	app.writeTokens(w, userID, sessionID, refreshToken)
+}
+
+//	RefreshTokenHandler - обработчик продления сессии по refresh token
+//	выдаёт новый JWT и новый refresh token, прежний refresh token перестаёт действовать
+func (app *Application) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if app.Tokens == nil { //	если ключи подписи JWT не заданы - отвечаем со статусом 501
+		http.Error(w, "JWT authorization is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	//	описываем структуру для приема refresh token в JSON виде
+	var refresh struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	//	парсим JSON из тела запроса
+	if err := json.NewDecoder(r.Body).Decode(&refresh); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		app.ErrorLog.Println("JSON body parsing error:", err.Error())
+		return
+	}
+
+	//	продлеваем сессию, заменяя её секретное значение
+	userID, sessionID, refreshToken, _, err := app.Datasource.RefreshSession(r.Context(), refresh.RefreshToken)
+	if errors.Is(err, storage.ErrSessionNotFound) { //	если сессия не найдена, истекла или токен уже использован
+		http.Error(w, "refresh token is invalid or expired", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	app.writeTokens(w, userID, sessionID, refreshToken)
+}
+
+//	writeTokens - метод выпускает JWT для сессии sessionID пользователя userID и пишет пару токенов в ответ
+func (app *Application) writeTokens(w http.ResponseWriter, userID, sessionID, refreshToken string) {
+	accessToken, expiresAt, err := app.Tokens.Issue(userID, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	body, err := json.Marshal(tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(expiresAt).Round(time.Second) / time.Second),
+		RefreshToken: refreshToken,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		app.ErrorLog.Println(err.Error())
+		return
+	}
+
+	//	токены не должны сохраняться в кэше клиента или прокси
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK) //	отвечаем со статусом 200
+	w.Write(body)                //	пишем JSON в тело ответа
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+//	AuthenticateAdmin - middleware, пропускающая к административным маршрутам только запросы
+//	с заголовком "Authorization: Bearer <токен администратора>"; если токен администратора не задан в конфигурации,
+//	административные маршруты отклоняют все запросы со статусом 401
+func (app *Application) AuthenticateAdmin(next http.Handler) http.Handler {
+	//	приводим нашу возвращаемую функцию к типу - Handler Function
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		header := r.Header.Get("Authorization")
+		if app.AdminToken == "" || len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+			http.Error(w, "admin token is required", http.StatusUnauthorized)
+			return
+		}
+
+		//	сравниваем hash токенов за постоянное время, чтобы по времени ответа нельзя было подобрать токен
+		got := sha256.Sum256([]byte(strings.TrimSpace(header[len(prefix):])))
+		want := sha256.Sum256([]byte(app.AdminToken))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "admin token is invalid", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
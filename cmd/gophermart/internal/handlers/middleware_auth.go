@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	Principal - пользователь, от имени которого выполняется запрос
+type Principal struct {
+	UserID    string //	идентификатор пользователя
+	SessionID string //	идентификатор сессии пользователя (не секретное значение cookie)
+}
+
+//	contextKey - тип ключей для хранения значений в контексте запроса
+type contextKey string
+
+//	principalKey - ключ, по которому в контексте запроса хранится Principal
+const principalKey contextKey = "principal"
+
+//	principalFrom - функция возвращает пользователя, от имени которого выполняется запрос
+//	значение помещается в контекст запроса middleware Authenticate
+func principalFrom(r *http.Request) Principal {
+	p, _ := r.Context().Value(principalKey).(Principal)
+	return p
+}
+
+//	Authenticate - middleware, определяющая пользователя по cookie "sessionid" или по заголовку "Authorization: Bearer <JWT>"
+//	и помещающая его в контекст запроса; неавторизованные запросы отклоняются со статусом 401
+func (app *Application) Authenticate(next http.Handler) http.Handler {
+	//	приводим нашу возвращаемую функцию к типу - Handler Function
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Principal
+
+		if header := r.Header.Get("Authorization"); header != "" { //	если запрос пришёл с JWT
+			const prefix = "Bearer "
+			if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) || app.Tokens == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+				http.Error(w, "please, authorise previously", http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := app.Tokens.Verify(strings.TrimSpace(header[len(prefix):]))
+			if err != nil { //	при неверной подписи или истёкшем сроке действия - отвечаем со статусом 401
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			//	JWT выдаётся в рамках сессии: после выхода или закрытия сессии токен доступа перестаёт действовать
+			err = app.Datasource.SessionActive(r.Context(), claims.Subject, claims.SessionID)
+			if errors.Is(err, storage.ErrSessionNotFound) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "session is closed", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				app.ErrorLog.Println(err.Error())
+				return
+			}
+			p = Principal{UserID: claims.Subject, SessionID: claims.SessionID}
+		} else { //	иначе - ищем идентификатор сессии в cookie
+			sessionID, err := r.Cookie("sessionid") //	считываем идентификатор сессии из cookie запроса
+			//	если идентификатор сессии отсутствует в cookie - пользователь не авторизован
+			if err != nil || sessionID.Value == "" { // 		отвечаем со статусом 401
+				http.Error(w, "please, authorise previously", http.StatusUnauthorized)
+				return
+			}
+
+			p.UserID, p.SessionID, err = app.Datasource.SessionUser(r.Context(), sessionID.Value)
+			if errors.Is(err, storage.ErrSessionNotFound) { //	если сессия не найдена или истекла - пользователь не авторизован
+				http.Error(w, "please, authorise previously", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				app.ErrorLog.Println(err.Error())
+				return
+			}
+		}
+
+		//	передаём управление следующему хендлеру, поместив пользователя в контекст запроса
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
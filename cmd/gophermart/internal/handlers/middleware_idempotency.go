@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	DefaultIdempotencyTTL - срок хранения ответов по ключам идемпотентности, если он не задан в конфигурации
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+//	maxIdempotencyKeyLength - максимальная длина ключа идемпотентности
+const maxIdempotencyKeyLength = 255
+
+//	Idempotent - middleware, обеспечивающая идемпотентность запросов с заголовком Idempotency-Key:
+//	ответ на первый запрос сохраняется в источнике данных и выдаётся повторно на запросы с тем же ключом и содержимым,
+//	на запрос с тем же ключом, но другим содержимым - отвечаем со статусом 422
+//	ключи хранятся отдельно для каждого пользователя, поэтому middleware подключается после Authenticate
+func (app *Application) Idempotent(next http.Handler) http.Handler {
+	//	приводим нашу возвращаемую функцию к типу - Handler Function
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		user := principalFrom(r) //	пользователь, определённый middleware Authenticate
+		//	запросы без ключа, а также без авторизации, обрабатываются как обычно
+		if key == "" || user.UserID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body) //	считываем тело запроса, чтобы вычислить его hash
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			app.ErrorLog.Println(err.Error())
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body)) //	и возвращаем его в запрос для следующего хендлера
+
+		//	hash запроса включает метод и путь, чтобы один ключ нельзя было использовать для разных операций
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		ttl := app.IdempotencyTTL
+		if ttl <= 0 {
+			ttl = DefaultIdempotencyTTL
+		}
+
+		stored, err := app.Datasource.IdempotencyReserve(r.Context(), key, requestHash, user.UserID, ttl)
+		if errors.Is(err, storage.ErrIdempotencyKeyReused) { //	ключ использован с другим запросом - отвечаем со статусом 422
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, storage.ErrIdempotencyInProgress) { //	запрос с этим ключом ещё выполняется - отвечаем со статусом 409
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			app.ErrorLog.Println(err.Error())
+			return
+		}
+
+		if stored != nil { //	запрос уже выполнялся - повторяем сохранённый ответ
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		//	ключ освобождается и ответ сохраняется, даже если клиент уже отключился и контекст запроса отменён, -
+		//	иначе ключ остался бы зарезервированным до истечения срока хранения
+		saveCtx := context.Background()
+		release := func() {
+			if err := app.Datasource.IdempotencyRelease(saveCtx, key, user.UserID); err != nil {
+				app.ErrorLog.Println(err.Error())
+			}
+		}
+
+		//	при панике хендлера освобождаем ключ и передаём панику дальше - её обработает middleware Recoverer
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		//	выполняем запрос, записывая ответ для сохранения
+		rec := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if rec.statusCode >= http.StatusInternalServerError { //	при ошибке сервера освобождаем ключ - клиент может повторить запрос
+			release()
+			return
+		}
+
+		response := storage.IdempotentResponse{
+			StatusCode:  rec.statusCode,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		}
+		if err := app.Datasource.IdempotencySave(saveCtx, key, user.UserID, response); err != nil {
+			app.ErrorLog.Println(err.Error())
+		}
+	})
+}
+
+//	responseRecorder - обёртка над http.ResponseWriter, запоминающая код статуса и тело ответа
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+//	WriteHeader - метод запоминает код статуса ответа и передаёт его дальше
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if !rec.wroteHeader {
+		rec.statusCode = statusCode
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+//	Write - метод запоминает тело ответа и передаёт его дальше
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	DefaultPageLimit - количество записей на странице списка, если параметр limit не задан
+const DefaultPageLimit = 100
+
+//	MaxPageLimit - максимальное количество записей на странице списка
+const MaxPageLimit = 1000
+
+//	nextCursorHeader - заголовок ответа с курсором следующей страницы списка; отсутствует, если страница последняя
+const nextCursorHeader = "X-Next-Cursor"
+
+//	errInvalidQuery - ошибка возникающая при разборе некорректных параметров запроса списка
+var errInvalidQuery = errors.New("invalid query parameters")
+
+//	parseListParams - функция разбирает параметры постраничной выдачи списка из строки запроса:
+//	limit - количество записей на странице, after - курсор из заголовка X-Next-Cursor предыдущей страницы,
+//	from и to - период в формате RFC3339 (from включительно), sort - направление сортировки по дате: asc или desc
+func parseListParams(r *http.Request) (storage.ListParams, error) {
+	query := r.URL.Query()
+	params := storage.ListParams{Limit: DefaultPageLimit, After: query.Get("after")}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxPageLimit {
+			return storage.ListParams{}, errInvalidQuery
+		}
+		params.Limit = n
+	}
+	for name, value := range map[string]*time.Time{"from": &params.From, "to": &params.To} {
+		if s := query.Get(name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return storage.ListParams{}, errInvalidQuery
+			}
+			*value = t
+		}
+	}
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		params.Desc = true
+	default:
+		return storage.ListParams{}, errInvalidQuery
+	}
+
+	return params, nil
+}
+
+//	queryValues - функция возвращает все значения параметра запроса, заданные повторно или через запятую
+func queryValues(r *http.Request, name string) []string {
+	var values []string
+	for _, value := range r.URL.Query()[name] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
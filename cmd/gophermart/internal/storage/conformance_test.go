@@ -0,0 +1,652 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//	conformanceBackends - хранилища, на которых выполняются общие сценарии: DSN для NewDatasource
+//	PostgreSQL проверяется, если задана переменная окружения TEST_DATABASE_URI - база данных при этом очищается
+func conformanceBackends(t *testing.T) map[string]string {
+	backends := map[string]string{
+		"memory":        memoryScheme,
+		"sqlite memory": "",
+		"sqlite file":   sqliteScheme + filepath.Join(t.TempDir(), "gophermart.db"),
+	}
+	if dsn, ok := os.LookupEnv("TEST_DATABASE_URI"); ok {
+		backends["postgres"] = dsn
+	}
+	return backends
+}
+
+//	openConformance - функция открывает пустое хранилище по DSN для очередного сценария
+func openConformance(t *testing.T, name, dsn string) Datasource {
+	switch name {
+	case "postgres": //	откатываем все миграции - сценарий начинается с пустой базы
+		d, err := OpenDatabase(dsn)
+		require.NoError(t, err)
+		_, err = d.MigrateDown(math.MaxInt32)
+		d.Close()
+		require.NoError(t, err)
+	case "sqlite file": //	у каждого сценария свой файл базы
+		dsn = sqliteScheme + filepath.Join(t.TempDir(), "gophermart.db")
+	}
+
+	datasource, err := NewDatasource(dsn, "")
+	require.NoError(t, err)
+	t.Cleanup(datasource.Close)
+	return datasource
+}
+
+func TestDatasourceConformance(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, ds Datasource)
+	}{
+		{
+			name: "users",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				token, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				userID, _, err := ds.SessionUser(ctx, token)
+				require.NoError(t, err)
+				assert.Equal(t, "test1", userID)
+
+				_, _, err = ds.UserRegister(ctx, "test1", "another_password", SessionMeta{})
+				assert.ErrorIs(t, err, ErrUserAlreadyExist)
+				_, _, err = ds.UserRegister(ctx, "", "test1_password", SessionMeta{})
+				assert.ErrorIs(t, err, ErrEmptyNotAllowed)
+
+				_, _, err = ds.UserAuthorise(ctx, "test1", "wrong_password", SessionMeta{})
+				assert.ErrorIs(t, err, ErrLoginPasswordIsWrong)
+				_, _, err = ds.UserAuthorise(ctx, "unknown", "test1_password", SessionMeta{})
+				assert.ErrorIs(t, err, ErrLoginPasswordIsWrong)
+				_, _, err = ds.UserAuthorise(ctx, "test1", "", SessionMeta{})
+				assert.ErrorIs(t, err, ErrEmptyNotAllowed)
+				_, _, err = ds.UserAuthorise(ctx, "test1", "test1_password", SessionMeta{})
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "sessions",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				first, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{UserAgent: "curl", IP: "127.0.0.1"})
+				require.NoError(t, err)
+				second, _, err := ds.UserAuthorise(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				_, firstID, err := ds.SessionUser(ctx, first)
+				require.NoError(t, err)
+				_, secondID, err := ds.SessionUser(ctx, second)
+				require.NoError(t, err)
+
+				sessions, err := ds.GetSessions(ctx, "test1", secondID)
+				require.NoError(t, err)
+				require.Len(t, sessions, 2)
+				assert.Equal(t, firstID, sessions[0].ID)
+				assert.Equal(t, "curl", sessions[0].UserAgent)
+				assert.False(t, sessions[0].Current)
+				assert.True(t, sessions[1].Current)
+				_, err = ds.GetSessions(ctx, "unknown", secondID)
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+
+				//	refresh token одноразовый
+				_, sessionID, refreshed, _, err := ds.RefreshSession(ctx, second)
+				require.NoError(t, err)
+				assert.Equal(t, secondID, sessionID)
+				_, _, _, _, err = ds.RefreshSession(ctx, second)
+				assert.ErrorIs(t, err, ErrSessionNotFound)
+				_, _, err = ds.SessionUser(ctx, refreshed)
+				assert.NoError(t, err)
+
+				//	закрыть можно только собственную сессию
+				_, _, err = ds.UserRegister(ctx, "test2", "test2_password", SessionMeta{})
+				require.NoError(t, err)
+				assert.ErrorIs(t, ds.DeleteSession(ctx, "test2", firstID), ErrNoDataToAnswer)
+				assert.ErrorIs(t, ds.UserLogout(ctx, "test2", firstID), ErrSessionNotFound)
+				assert.NoError(t, ds.SessionActive(ctx, "test1", firstID))
+				assert.ErrorIs(t, ds.SessionActive(ctx, "test2", firstID), ErrSessionNotFound)
+				require.NoError(t, ds.DeleteSession(ctx, "test1", firstID))
+				_, _, err = ds.SessionUser(ctx, first)
+				assert.ErrorIs(t, err, ErrSessionNotFound)
+				assert.ErrorIs(t, ds.SessionActive(ctx, "test1", firstID), ErrSessionNotFound)
+				require.NoError(t, ds.UserLogout(ctx, "test1", secondID))
+				assert.ErrorIs(t, ds.SessionActive(ctx, "test1", secondID), ErrSessionNotFound)
+				_, _, err = ds.SessionUser(ctx, refreshed)
+				assert.ErrorIs(t, err, ErrSessionNotFound)
+				_, _, err = ds.SessionUser(ctx, "")
+				assert.ErrorIs(t, err, ErrSessionNotFound)
+			},
+		},
+		{
+			name: "orders",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				_, _, err = ds.UserRegister(ctx, "test2", "test2_password", SessionMeta{})
+				require.NoError(t, err)
+
+				_, _, err = ds.GetOrders(ctx, "test1", OrdersFilter{})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				assert.ErrorIs(t, ds.OrderInsert(ctx, "", "test1"), ErrEmptyNotAllowed)
+
+				require.NoError(t, ds.OrderInsert(ctx, "12345678903", "test1"))
+				require.NoError(t, ds.OrderInsert(ctx, "2834832929383747", "test1"))
+				assert.ErrorIs(t, ds.OrderInsert(ctx, "12345678903", "test1"), ErrOrderExistToAccount)
+				assert.ErrorIs(t, ds.OrderInsert(ctx, "12345678903", "test2"), ErrOrderExistToAnother)
+
+				orders, _, err := ds.GetOrders(ctx, "test1", OrdersFilter{})
+				require.NoError(t, err)
+				require.Len(t, orders, 2)
+				assert.Equal(t, "12345678903", orders[0].Number)
+				assert.Equal(t, "NEW", orders[0].Status)
+				assert.Nil(t, orders[0].ProcessedAt)
+				_, _, err = ds.GetOrders(ctx, "test2", OrdersFilter{})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+
+				//	эмулятор сервера начислений начисляет по 100 баллов за заказ
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+				order, err := ds.GetOrder(ctx, "test1", "12345678903")
+				require.NoError(t, err)
+				assert.Equal(t, "PROCESSED", order.Status)
+				assert.Equal(t, Points(100*PointsScale), order.Accrual)
+				assert.NotNil(t, order.ProcessedAt)
+				require.Len(t, order.History, 2)
+				assert.Equal(t, "NEW", order.History[0].Status)
+				assert.Equal(t, "PROCESSED", order.History[1].Status)
+
+				//	чужой и несуществующий заказ неотличимы
+				_, err = ds.GetOrder(ctx, "test2", "12345678903")
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				_, err = ds.GetOrder(ctx, "test1", "79927398713")
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+
+				//	начисление по обработанному заказу проводится один раз
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+				current, _, withdrawn, err := ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(200*PointsScale), current)
+				assert.Equal(t, Points(0), withdrawn)
+			},
+		},
+		{
+			name: "orders pagination",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				//	три обработанных заказа и два новых
+				for _, number := range []string{"1", "2", "3"} {
+					require.NoError(t, ds.OrderInsert(ctx, number, "test1"))
+				}
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+				for _, number := range []string{"4", "5"} {
+					require.NoError(t, ds.OrderInsert(ctx, number, "test1"))
+				}
+
+				//	pages - функция выбирает все страницы списка и возвращает номера заказов на каждой из них
+				pages := func(filter OrdersFilter) [][]string {
+					var result [][]string
+					for {
+						orders, next, err := ds.GetOrders(ctx, "test1", filter)
+						require.NoError(t, err)
+						page := make([]string, 0, len(orders))
+						for _, order := range orders {
+							page = append(page, order.Number)
+						}
+						result = append(result, page)
+						if next == "" {
+							return result
+						}
+						filter.After = next
+					}
+				}
+				assert.Equal(t, [][]string{{"1", "2", "3", "4", "5"}}, pages(OrdersFilter{}))
+				assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}, {"5"}}, pages(OrdersFilter{ListParams: ListParams{Limit: 2}}))
+				assert.Equal(t, [][]string{{"5", "4"}, {"3", "2"}, {"1"}}, pages(OrdersFilter{ListParams: ListParams{Limit: 2, Desc: true}}))
+				assert.Equal(t, [][]string{{"1", "2", "3"}}, pages(OrdersFilter{Statuses: []string{"PROCESSED"}}))
+				assert.Equal(t, [][]string{{"4"}, {"5"}}, pages(OrdersFilter{ListParams: ListParams{Limit: 1}, Statuses: []string{"NEW", "PROCESSING"}}))
+
+				now := time.Now()
+				assert.Equal(t, [][]string{{"1", "2", "3", "4", "5"}}, pages(OrdersFilter{ListParams: ListParams{From: now.Add(-time.Hour), To: now.Add(time.Hour)}}))
+				_, _, err = ds.GetOrders(ctx, "test1", OrdersFilter{ListParams: ListParams{From: now.Add(time.Hour)}})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				_, _, err = ds.GetOrders(ctx, "test1", OrdersFilter{ListParams: ListParams{To: now.Add(-time.Hour)}})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+
+				//	некорректные параметры выборки
+				for _, filter := range []OrdersFilter{
+					{ListParams: ListParams{After: "not a cursor"}},
+					{ListParams: ListParams{Limit: -1}},
+					{ListParams: ListParams{From: now, To: now.Add(-time.Hour)}},
+					{Statuses: []string{"UNKNOWN"}},
+				} {
+					_, _, err = ds.GetOrders(ctx, "test1", filter)
+					assert.ErrorIs(t, err, ErrInvalidListParams)
+				}
+			},
+		},
+		{
+			name: "withdrawals",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+
+				current, _, withdrawn, err := ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(0), current)
+				assert.Equal(t, Points(0), withdrawn)
+				_, _, err = ds.GetWithdrawals(ctx, "test1", ListParams{})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", Points(10*PointsScale), "test1"), ErrInsufficientFundsToAccount)
+
+				require.NoError(t, ds.OrderInsert(ctx, "12345678903", "test1"))
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", 0, "test1"), ErrEmptyNotAllowed)
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", -PointsScale, "test1"), ErrInvalidPoints)
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", Points(101*PointsScale), "test1"), ErrInsufficientFundsToAccount)
+				require.NoError(t, ds.WithdrawRequest(ctx, "2377225624", Points(40*PointsScale)+5, "test1"))
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", PointsScale, "test1"), ErrWithdrawalExist)
+
+				//	заказ, по которому уже было списание, и заказ другого пользователя для списания недоступны
+				_, _, err = ds.UserRegister(ctx, "test2", "test2_password", SessionMeta{})
+				require.NoError(t, err)
+				require.NoError(t, ds.OrderInsert(ctx, "79927398713", "test2"))
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", PointsScale, "test2"), ErrWithdrawalExist)
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "79927398713", PointsScale, "test1"), ErrOrderExistToAnother)
+				//	и наоборот: заказ, в счёт которого списаны баллы, другой пользователь загрузить для начисления не может
+				assert.ErrorIs(t, ds.OrderInsert(ctx, "2377225624", "test2"), ErrOrderExistToAnother)
+
+				current, _, withdrawn, err = ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(59*PointsScale)+95, current)
+				assert.Equal(t, Points(40*PointsScale)+5, withdrawn)
+
+				withdrawals, _, err := ds.GetWithdrawals(ctx, "test1", ListParams{})
+				require.NoError(t, err)
+				require.Len(t, withdrawals, 1)
+				assert.Equal(t, "2377225624", withdrawals[0].Order)
+				assert.Equal(t, Points(40*PointsScale)+5, withdrawals[0].Sum)
+
+				//	из одновременных загрузки заказа одним пользователем и списания в счёт него другим проходит только одна операция
+				for i := 0; i < 5; i++ {
+					number := "race" + strconv.Itoa(i)
+					var wg sync.WaitGroup
+					var insertErr, withdrawErr error
+					wg.Add(2)
+					go func() {
+						defer wg.Done()
+						insertErr = ds.OrderInsert(ctx, number, "test2")
+					}()
+					go func() {
+						defer wg.Done()
+						withdrawErr = ds.WithdrawRequest(ctx, number, PointsScale, "test1")
+					}()
+					wg.Wait()
+					if insertErr == nil {
+						assert.ErrorIs(t, withdrawErr, ErrOrderExistToAnother, number)
+					} else {
+						assert.ErrorIs(t, insertErr, ErrOrderExistToAnother, number)
+						assert.NoError(t, withdrawErr, number)
+					}
+				}
+			},
+		},
+		{
+			name: "withdrawals pagination",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				require.NoError(t, ds.OrderInsert(ctx, "12345678903", "test1"))
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+				for _, order := range []string{"1", "2", "3", "4"} {
+					require.NoError(t, ds.WithdrawRequest(ctx, order, Points(10*PointsScale)+25, "test1"))
+				}
+
+				//	pages - функция выбирает все страницы списка и возвращает номера заказов на каждой из них
+				pages := func(params ListParams) [][]string {
+					var result [][]string
+					for {
+						withdrawals, next, err := ds.GetWithdrawals(ctx, "test1", params)
+						require.NoError(t, err)
+						page := make([]string, 0, len(withdrawals))
+						for _, withdraw := range withdrawals {
+							page = append(page, withdraw.Order)
+						}
+						result = append(result, page)
+						if next == "" {
+							return result
+						}
+						params.After = next
+					}
+				}
+				assert.Equal(t, [][]string{{"1", "2", "3", "4"}}, pages(ListParams{}))
+				assert.Equal(t, [][]string{{"1", "2", "3"}, {"4"}}, pages(ListParams{Limit: 3}))
+				assert.Equal(t, [][]string{{"4", "3"}, {"2", "1"}}, pages(ListParams{Limit: 2, Desc: true}))
+
+				now := time.Now()
+				summary, err := ds.GetWithdrawalsSummary(ctx, "test1", now.Add(-time.Hour), now.Add(time.Hour))
+				require.NoError(t, err)
+				assert.Equal(t, WithdrawalsSummary{Count: 4, Sum: Points(41 * PointsScale)}, summary)
+				summary, err = ds.GetWithdrawalsSummary(ctx, "test1", time.Time{}, time.Time{})
+				require.NoError(t, err)
+				assert.Equal(t, WithdrawalsSummary{Count: 4, Sum: Points(41 * PointsScale)}, summary)
+
+				//	за период без списаний - пустой список и нулевые итоги
+				_, _, err = ds.GetWithdrawals(ctx, "test1", ListParams{From: now.Add(time.Hour)})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				summary, err = ds.GetWithdrawalsSummary(ctx, "test1", now.Add(time.Hour), time.Time{})
+				require.NoError(t, err)
+				assert.Equal(t, WithdrawalsSummary{}, summary)
+				summary, err = ds.GetWithdrawalsSummary(ctx, "unknown", time.Time{}, time.Time{})
+				require.NoError(t, err)
+				assert.Equal(t, WithdrawalsSummary{}, summary)
+
+				_, err = ds.GetWithdrawalsSummary(ctx, "test1", now, now)
+				assert.ErrorIs(t, err, ErrInvalidListParams)
+				_, _, err = ds.GetWithdrawals(ctx, "test1", ListParams{After: "not a cursor"})
+				assert.ErrorIs(t, err, ErrInvalidListParams)
+			},
+		},
+		{
+			name: "refunds",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				_, _, err = ds.UserRegister(ctx, "test2", "test2_password", SessionMeta{})
+				require.NoError(t, err)
+				require.NoError(t, ds.OrderInsert(ctx, "12345678903", "test1"))
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+				require.NoError(t, ds.WithdrawRequest(ctx, "2377225624", Points(40*PointsScale), "test1"))
+
+				//	sum - сумма частичного возврата, nil - возврат всего остатка
+				sum := func(p Points) *Points { return &p }
+
+				//	чужое и несуществующее списание неотличимы
+				_, err = ds.RefundWithdrawal(ctx, "2377225624", nil, "test2")
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				_, err = ds.RefundWithdrawal(ctx, "79927398713", nil, "test1")
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				//	нулевая сумма - не возврат всего остатка, а ошибка, как и отрицательная
+				_, err = ds.RefundWithdrawal(ctx, "2377225624", sum(-PointsScale), "test1")
+				assert.ErrorIs(t, err, ErrInvalidPoints)
+				_, err = ds.RefundWithdrawal(ctx, "2377225624", sum(0), "test1")
+				assert.ErrorIs(t, err, ErrInvalidPoints)
+
+				//	частичный возврат
+				withdraw, err := ds.RefundWithdrawal(ctx, "2377225624", sum(Points(15*PointsScale)+50), "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(40*PointsScale), withdraw.Sum)
+				assert.Equal(t, Points(15*PointsScale)+50, withdraw.Refunded)
+				assert.Equal(t, WithdrawalPartiallyRefunded, withdraw.Status)
+				current, _, withdrawn, err := ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(75*PointsScale)+50, current)
+				assert.Equal(t, Points(24*PointsScale)+50, withdrawn)
+				_, err = ds.RefundWithdrawal(ctx, "2377225624", sum(Points(25*PointsScale)), "test1")
+				assert.ErrorIs(t, err, ErrRefundExceedsWithdrawal)
+
+				//	администратор возвращает остаток списания любого пользователя
+				withdraw, err = ds.RefundWithdrawal(ctx, "2377225624", nil, "")
+				require.NoError(t, err)
+				assert.Equal(t, Points(40*PointsScale), withdraw.Refunded)
+				assert.Equal(t, WithdrawalRefunded, withdraw.Status)
+				_, err = ds.RefundWithdrawal(ctx, "2377225624", nil, "test1")
+				assert.ErrorIs(t, err, ErrWithdrawalRefunded)
+
+				current, _, withdrawn, err = ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(100*PointsScale), current)
+				assert.Equal(t, Points(0), withdrawn)
+
+				//	исходное списание остаётся в списке со статусом возврата
+				withdrawals, _, err := ds.GetWithdrawals(ctx, "test1", ListParams{})
+				require.NoError(t, err)
+				require.Len(t, withdrawals, 1)
+				assert.Equal(t, Points(40*PointsScale), withdrawals[0].Sum)
+				assert.Equal(t, Points(40*PointsScale), withdrawals[0].Refunded)
+				assert.Equal(t, WithdrawalRefunded, withdrawals[0].Status)
+				summary, err := ds.GetWithdrawalsSummary(ctx, "test1", time.Time{}, time.Time{})
+				require.NoError(t, err)
+				assert.Equal(t, WithdrawalsSummary{Count: 1, Sum: Points(40 * PointsScale), Refunded: Points(40 * PointsScale)}, summary)
+
+				//	из 10 параллельных возвратов по 5 баллов из списания в 30 проходят ровно 6
+				require.NoError(t, ds.WithdrawRequest(ctx, "79927398713", Points(30*PointsScale), "test1"))
+				var wg sync.WaitGroup
+				errs := make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := ds.RefundWithdrawal(ctx, "79927398713", sum(Points(5*PointsScale)), "test1")
+						errs <- err
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				succeeded := 0
+				for err := range errs {
+					if err == nil {
+						succeeded++
+						continue
+					}
+					assert.ErrorIs(t, err, ErrWithdrawalRefunded)
+				}
+				assert.Equal(t, 6, succeeded)
+				current, _, withdrawn, err = ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(100*PointsScale), current)
+				assert.Equal(t, Points(0), withdrawn)
+			},
+		},
+		{
+			name: "holds",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				_, _, err = ds.UserRegister(ctx, "test2", "test2_password", SessionMeta{})
+				require.NoError(t, err)
+				require.NoError(t, ds.OrderInsert(ctx, "12345678903", "test1"))
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+
+				//	резерв переносит баллы из доступного остатка в held, не затрагивая списания
+				hold, err := ds.HoldRequest(ctx, "2377225624", Points(30*PointsScale), "test1", time.Hour)
+				require.NoError(t, err)
+				assert.Equal(t, HoldHeld, hold.Status)
+				assert.Equal(t, hold.CreatedAt.Add(time.Hour), hold.ExpiresAt)
+				current, held, withdrawn, err := ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(70*PointsScale), current)
+				assert.Equal(t, Points(30*PointsScale), held)
+				assert.Equal(t, Points(0), withdrawn)
+
+				//	по заказу с действующим резервом нельзя ни повторно зарезервировать, ни списать баллы
+				_, err = ds.HoldRequest(ctx, "2377225624", Points(PointsScale), "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrHoldExist)
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "2377225624", Points(PointsScale), "test1"), ErrHoldExist)
+				_, err = ds.HoldRequest(ctx, "12345678903", Points(PointsScale), "test2", time.Hour)
+				assert.ErrorIs(t, err, ErrOrderExistToAnother)
+				//	зарезервированные баллы недоступны для списаний и других резервов
+				_, err = ds.HoldRequest(ctx, "79927398713", Points(71*PointsScale), "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrInsufficientFundsToAccount)
+				assert.ErrorIs(t, ds.WithdrawRequest(ctx, "79927398713", Points(71*PointsScale), "test1"), ErrInsufficientFundsToAccount)
+
+				//	чужой и несуществующий резерв неотличимы
+				_, err = ds.HoldCapture(ctx, hold.ID, "test2")
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+				_, err = ds.HoldRelease(ctx, "unknown", "test1")
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+
+				//	списание резерва проводится как обычное списание
+				captured, err := ds.HoldCapture(ctx, hold.ID, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, HoldCaptured, captured.Status)
+				require.NotNil(t, captured.ClosedAt)
+				current, held, withdrawn, err = ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(70*PointsScale), current)
+				assert.Equal(t, Points(0), held)
+				assert.Equal(t, Points(30*PointsScale), withdrawn)
+				withdrawals, _, err := ds.GetWithdrawals(ctx, "test1", ListParams{})
+				require.NoError(t, err)
+				require.Len(t, withdrawals, 1)
+				assert.Equal(t, "2377225624", withdrawals[0].Order)
+				_, err = ds.HoldRelease(ctx, hold.ID, "test1")
+				assert.ErrorIs(t, err, ErrHoldClosed)
+				_, err = ds.HoldRequest(ctx, "2377225624", Points(PointsScale), "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrWithdrawalExist)
+
+				//	возврат резерва восстанавливает доступный остаток, заказ можно зарезервировать снова
+				hold, err = ds.HoldRequest(ctx, "79927398713", Points(20*PointsScale), "test1", time.Hour)
+				require.NoError(t, err)
+				released, err := ds.HoldRelease(ctx, hold.ID, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, HoldReleased, released.Status)
+				_, err = ds.HoldCapture(ctx, hold.ID, "test1")
+				assert.ErrorIs(t, err, ErrHoldClosed)
+				current, held, _, err = ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(70*PointsScale), current)
+				assert.Equal(t, Points(0), held)
+
+				//	резервы с истёкшим сроком не списываются и возвращаются в доступный остаток
+				expiring, err := ds.HoldRequest(ctx, "79927398713", Points(10*PointsScale), "test1", time.Second)
+				require.NoError(t, err)
+				_, err = ds.HoldRequest(ctx, "4561261212345467", Points(15*PointsScale), "test1", time.Second)
+				require.NoError(t, err)
+				n, err := ds.ReleaseExpiredHolds(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, 0, n)
+				time.Sleep(time.Until(expiring.ExpiresAt.Add(time.Second)))
+				_, err = ds.HoldCapture(ctx, expiring.ID, "test1")
+				assert.ErrorIs(t, err, ErrHoldExpired)
+				n, err = ds.ReleaseExpiredHolds(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, 1, n)
+				current, held, withdrawn, err = ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(70*PointsScale), current)
+				assert.Equal(t, Points(0), held)
+				assert.Equal(t, Points(30*PointsScale), withdrawn)
+			},
+		},
+		{
+			name: "concurrent withdrawals",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+				require.NoError(t, ds.OrderInsert(ctx, "12345678903", "test1"))
+				require.NoError(t, ds.UpdateOrdersStatus(ctx))
+
+				//	из 10 параллельных заявок по 30 баллов при остатке 100 проходят ровно 3
+				var wg sync.WaitGroup
+				errs := make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						errs <- ds.WithdrawRequest(ctx, "order"+strconv.Itoa(i), Points(30*PointsScale), "test1")
+					}(i)
+				}
+				wg.Wait()
+				close(errs)
+				succeeded := 0
+				for err := range errs {
+					if err == nil {
+						succeeded++
+						continue
+					}
+					assert.ErrorIs(t, err, ErrInsufficientFundsToAccount)
+				}
+				assert.Equal(t, 3, succeeded)
+
+				current, _, withdrawn, err := ds.GetBalance(ctx, "test1")
+				require.NoError(t, err)
+				assert.Equal(t, Points(10*PointsScale), current)
+				assert.Equal(t, Points(90*PointsScale), withdrawn)
+			},
+		},
+		{
+			name: "idempotency",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+
+				_, err = ds.IdempotencyReserve(ctx, "", "hash", "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrEmptyNotAllowed)
+
+				stored, err := ds.IdempotencyReserve(ctx, "key1", "hash1", "test1", time.Hour)
+				require.NoError(t, err)
+				assert.Nil(t, stored)
+				_, err = ds.IdempotencyReserve(ctx, "key1", "hash1", "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrIdempotencyInProgress)
+				_, err = ds.IdempotencyReserve(ctx, "key1", "hash2", "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+
+				response := IdempotentResponse{StatusCode: 200, ContentType: "application/json", Body: []byte(`{"ok":true}`)}
+				require.NoError(t, ds.IdempotencySave(ctx, "key1", "test1", response))
+				stored, err = ds.IdempotencyReserve(ctx, "key1", "hash1", "test1", time.Hour)
+				require.NoError(t, err)
+				require.NotNil(t, stored)
+				assert.Equal(t, response, *stored)
+
+				//	освобождается только ключ, ответ по которому ещё не сохранён
+				require.NoError(t, ds.IdempotencyRelease(ctx, "key1", "test1"))
+				_, err = ds.IdempotencyReserve(ctx, "key1", "hash2", "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+				_, err = ds.IdempotencyReserve(ctx, "key2", "hash1", "test1", time.Hour)
+				require.NoError(t, err)
+				require.NoError(t, ds.IdempotencyRelease(ctx, "key2", "test1"))
+				stored, err = ds.IdempotencyReserve(ctx, "key2", "hash2", "test1", time.Hour)
+				require.NoError(t, err)
+				assert.Nil(t, stored)
+
+				//	резерв запроса, не завершённого за IdempotencyLockTTL, забирает повтор запроса, а сохранённый ответ остаётся
+				defer func(ttl time.Duration) { IdempotencyLockTTL = ttl }(IdempotencyLockTTL)
+				IdempotencyLockTTL = 0
+				stored, err = ds.IdempotencyReserve(ctx, "key2", "hash3", "test1", time.Hour)
+				require.NoError(t, err)
+				assert.Nil(t, stored)
+				_, err = ds.IdempotencyReserve(ctx, "key1", "hash2", "test1", time.Hour)
+				assert.ErrorIs(t, err, ErrIdempotencyKeyReused)
+			},
+		},
+		{
+			name: "cancelled context",
+			run: func(t *testing.T, ctx context.Context, ds Datasource) {
+				_, _, err := ds.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+				require.NoError(t, err)
+
+				cancelled, cancel := context.WithCancel(ctx)
+				cancel()
+				assert.ErrorIs(t, ds.OrderInsert(cancelled, "12345678903", "test1"), context.Canceled)
+				_, _, _, err = ds.GetBalance(cancelled, "test1")
+				assert.ErrorIs(t, err, context.Canceled)
+				assert.NoError(t, ds.UpdateOrdersStatus(cancelled))
+
+				_, _, err = ds.GetOrders(ctx, "test1", OrdersFilter{})
+				assert.ErrorIs(t, err, ErrNoDataToAnswer)
+			},
+		},
+	}
+
+	for name, dsn := range conformanceBackends(t) {
+		name, dsn := name, dsn
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					tt.run(t, context.Background(), openConformance(t, name, dsn))
+				})
+			}
+		})
+	}
+}
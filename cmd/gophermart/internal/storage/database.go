@@ -1,355 +1,504 @@
 package storage
 
 import (
-	"crypto/md5"
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
-	"log"
+	"strings"
 	"time"
-
-	_ "github.com/jackc/pgx/stdlib"
-	_ "github.com/mattn/go-sqlite3"
-	//	"github.com/lib/pq"
 )
 
 //	Database - структура хранилища данных, обертывающая пул подключений к базе данных
 //	реализует интерфейс Datasource
 type Database struct {
-	DB *sql.DB
+	db     dbPool //	пул соединений: pgxpool для PostgreSQL или database/sql для sqlite
+	driver string //	драйвер базы данных: driverPostgres или driverSQLite
+}
+
+//	драйверы баз данных, поддерживаемые хранилищем
+const (
+	driverPostgres = "pgx"
+	driverSQLite   = "sqlite3"
+)
+
+//	lockForUpdate - метод возвращает окончание SQL-запроса, блокирующее выбранные строки таблицы table до конца транзакции
+//	если у таблицы в запросе есть псевдоним, table - это псевдоним: PostgreSQL не принимает в FOR UPDATE OF имя таблицы с псевдонимом
+//	в PostgreSQL это SELECT ... FOR UPDATE, в sqlite построчных блокировок нет - там транзакции сериализуются
+//	единственным соединением с базой "in memory" или блокировкой записи файловой базы (см. OpenDatabase),
+//	поэтому дополнительная блокировка не требуется
+func (d *Database) lockForUpdate(table string) string {
+	if d.driver == driverPostgres {
+		return ` for update of "` + table + `"`
+	}
+	return ""
+}
+
+//	skipLocked - метод возвращает окончание SQL-запроса, блокирующее выбранные строки до конца транзакции
+//	и пропускающее строки, уже заблокированные другими транзакциями, - так параллельные обработчики не ждут друг друга
+//	в sqlite, как и для lockForUpdate, блокировка не требуется
+func (d *Database) skipLocked() string {
+	if d.driver == driverPostgres {
+		return ` for update skip locked`
+	}
+	return ""
+}
+
+//	orderLockSpace - пространство advisory lock PostgreSQL, в котором блокируются номера заказов
+const orderLockSpace = 4250308
+
+//	lockOrderNumber - метод блокирует номер заказа order до конца транзакции tx, даже если такого заказа ещё нет в базе:
+//	загрузка заказа для начисления и списание баллов в счёт того же номера выполняются по очереди
+//	и видят результат друг друга; в sqlite, как и для lockForUpdate, блокировка не требуется
+func (d *Database) lockOrderNumber(ctx context.Context, tx dbTx, order string) error {
+	if d.driver != driverPostgres {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `select pg_advisory_xact_lock($1, hashtext($2))`, orderLockSpace, order)
+	return err
+}
+
+//	timestampType - метод возвращает тип столбцов с датой и временем: в PostgreSQL это timestamptz,
+//	в sqlite - timestamp, значения которого драйвер sqlite3 сам преобразует в time.Time
+func (d *Database) timestampType() string {
+	if d.driver == driverPostgres {
+		return "TIMESTAMPTZ"
+	}
+	return "TIMESTAMP"
 }
 
 //	UserRegister - метод создания нового пользователя в системе лояльности
-func (d *Database) UserRegister(userID, password string) (token string, err error) {
+//	и открытия ему первой сессии
+func (d *Database) UserRegister(ctx context.Context, userID, password string, meta SessionMeta) (token string, expiresAt time.Time, err error) {
 	//	пустые значения password или UserID к вставке в хранилище не допускаются
 	if userID == "" || password == "" {
-		return "", ErrEmptyNotAllowed
+		return "", time.Time{}, ErrEmptyNotAllowed
 	}
 
 	// проверяем, есть ли пользователь с таким login в нашей базе
 	var userIDfromDB string
-	stmt := `select "userid" from "users" where "userid" = $1`
-	err = d.DB.QueryRow(stmt, userID).Scan(&userIDfromDB)
-	if !errors.Is(err, sql.ErrNoRows) { //	если в базе уже есть пользователь с таким login
-		return "", ErrUserAlreadyExist
+	stmt := `select "login" from "users" where "login" = $1`
+	err = d.db.QueryRow(ctx, stmt, userID).Scan(&userIDfromDB)
+	if err == nil { //	если в базе уже есть пользователь с таким login
+		return "", time.Time{}, ErrUserAlreadyExist
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", time.Time{}, err
 	}
 
 	//	если пользователя с таким login нет в нашей базе - начинаем тразакцию
-	tx, err := d.DB.Begin()
+	tx, err := d.db.Begin(ctx)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
-	defer tx.Rollback() //	при ошибке выполнения - откатываем транзакцию
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
 
-	//	готовим SQL-statement для вставки в базу нового пользователя
-	stmtInsert, err := tx.Prepare(`insert into "users" ("userid", "password", "session_id") values ($1, $2, $3)`)
+	//	преобразуем пароль в hash рабочим алгоритмом - так и храним в базе из соображений безопасности
+	hash, err := Hasher.Hash(password)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
-	defer stmtInsert.Close()
 
-	//	преобразуем комбинацию логин/пароль в hash - так и храним в базе из соображений безопасности
-	mdSum := md5.Sum([]byte(userID + password + userID))
-	hash := fmt.Sprintf("%x", mdSum)
+	//	вставляем в базу нового пользователя
+	if _, err := tx.Exec(ctx, `insert into "users" ("login", "password") values ($1, $2)`, userID, hash); err != nil {
+		return "", time.Time{}, err
+	}
+
+	//	заводим новому пользователю нулевой баланс
+	stmtBalance := `insert into "balances" ("user_id", "current", "withdrawn") select "id", 0, 0 from "users" where "login" = $1`
+	if _, err := tx.Exec(ctx, stmtBalance, userID); err != nil {
+		return "", time.Time{}, err
+	}
 
-	//	генерируем новый идентификатор сессии пользователя
-	sessionID := newSessionID()
-	//	 запускаем SQL-statement на исполнение
-	if _, err := stmtInsert.Exec(userID, hash, sessionID); err != nil {
-		return "", err
+	//	открываем пользователю новую сессию
+	token, expiresAt, err = createSession(ctx, tx, userID, meta)
+	if err != nil {
+		return "", time.Time{}, err
 	}
 
 	//	при успешном выполнении вставки - фиксируем транзакцию и возращаем идентификатор сесии
-	return sessionID, tx.Commit()
+	return token, expiresAt, tx.Commit(ctx)
 }
 
 //	UserAuthorise - метод авторизации пользователя в системе лояльности
-func (d *Database) UserAuthorise(userID, password string) (token string, err error) {
+//	при успешной авторизации открывает пользователю новую сессию, не затрагивая остальные его сессии
+func (d *Database) UserAuthorise(ctx context.Context, userID, password string, meta SessionMeta) (token string, expiresAt time.Time, err error) {
 
 	//	пустые значения password или UserID не допускаются
 	if userID == "" || password == "" {
-		return "", ErrEmptyNotAllowed
+		return "", time.Time{}, ErrEmptyNotAllowed
 	}
 
 	// проверяем, есть ли пользователь с таким login в нашей базе
 	var passwordFromDB string
-	stmt := `select "password" from "users" where "userid" = $1`
-	err = d.DB.QueryRow(stmt, userID).Scan(&passwordFromDB)
+	stmt := `select "password" from "users" where "login" = $1`
+	err = d.db.QueryRow(ctx, stmt, userID).Scan(&passwordFromDB)
 
 	if errors.Is(err, sql.ErrNoRows) { //	если запрос не вернул строк - в базе нет пользователя с таким login
-		return "", ErrLoginPasswordIsWrong
+		return "", time.Time{}, ErrLoginPasswordIsWrong
 	}
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
 
-	//	преобразуем комбинацию входящих логин/пароль в hash - как мы храним их в нашей базе из соображений безопасности
-	mdSum := md5.Sum([]byte(userID + password + userID))
-	hash := fmt.Sprintf("%x", mdSum)
-
-	if passwordFromDB != hash { //	если hash пароля в базе не совпадает с hash присланного пароля
-		return "", ErrLoginPasswordIsWrong
+	//	проверяем присланный пароль по hash из нашей базы - алгоритм определяется по формату hash
+	ok, rehash, err := checkPassword(userID, password, passwordFromDB)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !ok { //	если hash пароля в базе не совпадает с hash присланного пароля
+		return "", time.Time{}, ErrLoginPasswordIsWrong
 	}
 
-	//	если логин/пароль совпали выдаём идентификатор сессии - начинаем тразакцию
-	tx, err := d.DB.Begin()
+	//	если логин/пароль совпали открываем новую сессию - начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
-	defer tx.Rollback() //	при ошибке выполнения - откатываем транзакцию
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
 
-	//	готовим SQL-statement для обновления в базе информации об идентификаторе сессии
-	stmtInsert, err := tx.Prepare(`update "users" set "session_id" = $1 where "userid" = $2`)
+	token, expiresAt, err = createSession(ctx, tx, userID, meta)
 	if err != nil {
-		return "", err
+		return "", time.Time{}, err
 	}
-	defer stmtInsert.Close()
 
-	//	генерируем новый идентификатор сессии пользователя
-	sessionID := newSessionID()
-	//	 запускаем SQL-statement на исполнение
-	if _, err := stmtInsert.Exec(sessionID, userID); err != nil {
-		return "", err
+	//	если hash пароля получен устаревшим алгоритмом или с устаревшими параметрами - пересчитываем его рабочим алгоритмом
+	if rehash {
+		hash, err := Hasher.Hash(password)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		stmtRehash := `update "users" set "password" = $1 where "login" = $2 and "password" = $3`
+		if _, err := tx.Exec(ctx, stmtRehash, hash, userID, passwordFromDB); err != nil {
+			return "", time.Time{}, err
+		}
 	}
 
 	//	при успешном выполнении обновления в базе - фиксируем транзакцию и возвращаем идентификатор сессии
-	return sessionID, tx.Commit()
+	return token, expiresAt, tx.Commit(ctx)
 }
 
-//	GetOrders - метод, который возвращает список всех заказов для начисления баллов на счёт данного пользователя
-func (d *Database) GetOrders(sessionID string) ([]Order, error) {
-	var orderNum string
-	var accrual float32
-	var status, processed string
+//	GetOrders - метод, который возвращает страницу списка заказов для начисления баллов на счёт данного пользователя
+//	вместе с курсором следующей страницы; курсор пустой, если страница последняя
+//	выборка по пользователю, статусу и дате загрузки покрыта индексами orders_user_id_idx и orders_user_status_idx
+func (d *Database) GetOrders(ctx context.Context, userID string, filter OrdersFilter) ([]Order, string, error) {
+	cursor, hasCursor, err := filter.validate()
+	if err != nil {
+		return nil, "", err
+	}
 	orders := make([]Order, 0)
 
-	stmt := `select "order", "status", "accrual", "uploaded_at" from "orders", "users" where "orders"."userid" = "users"."userid" and "session_id" = $1 order by "uploaded_at"`
-	rows, err := d.DB.Query(stmt, sessionID)
+	args := queryArgs{userID}
+	conditions := []string{`u."login" = $1`}
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, 0, len(filter.Statuses))
+		for _, status := range filter.Statuses {
+			placeholders = append(placeholders, args.add(status))
+		}
+		conditions = append(conditions, `o."status" in (`+strings.Join(placeholders, ", ")+`)`)
+	}
+	pageConditions, tail := args.page(filter.ListParams, cursor, hasCursor, `o."uploaded_at"`, `o."order"`)
+	conditions = append(conditions, pageConditions...)
+
+	stmt := `select o."order", o."status", o."accrual", o."uploaded_at", o."status_changed_at", o."processed_at"
+		from "orders" o join "users" u on u."id" = o."user_id" where ` + strings.Join(conditions, " and ") + tail
+	rows, err := d.db.Query(ctx, stmt, args...)
 	if errors.Is(err, sql.ErrNoRows) {
-		return nil, ErrNoDataToAnswer
+		return nil, "", ErrNoDataToAnswer
 	}
-	if err != nil || rows.Err() != nil {
-		return nil, err
+	if err != nil {
+		return nil, "", err
 	}
 	defer rows.Close()
 	//	перебираем все строки выборки, добавляя записи order в исходящий срез orders
 	for rows.Next() {
-		err := rows.Scan(&orderNum, &status, &accrual, &processed)
+		var order Order
+		err := rows.Scan(&order.Number, &order.Status, &order.Accrual, &order.UploadedAt, &order.StatusChangedAt, &order.ProcessedAt)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		orders = append(orders, Order{Number: orderNum, Accrual: accrual, Status: status, UploadedAt: processed})
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
 	}
 
 	if len(orders) == 0 { //	если заказов на начисление баллов не было
-		return nil, ErrNoDataToAnswer
+		return nil, "", ErrNoDataToAnswer
 	}
 
-	return orders, nil
+	orders, next := ordersPage(orders, filter.Limit)
+	return orders, next, nil
 }
 
-// GetBalance - метод, который возвращает все текущие начисления и списания пользователя
-func (d *Database) GetBalance(sessionID string) (accrualSum, withdrawSum float32, err error) {
+// GetBalance - метод, который возвращает доступный остаток, сумму зарезервированных баллов и сумму всех списаний пользователя
+//	значения читаются из материализованного баланса, который обновляется в одной транзакции с журналом баллов
+func (d *Database) GetBalance(ctx context.Context, userID string) (current, held, withdrawSum Points, err error) {
 
-	// выбираем заказы пользователя в статусе PROCESSED и считаем по ним общую сумму начислений
-	stmt := `select SUM("accrual") from "orders", "users" where "orders"."userid" = "users"."userid" and "session_id" = $1 and "status" = $2 group by "orders"."userid"`
-	err = d.DB.QueryRow(stmt, sessionID, "PROCESSED").Scan(&accrualSum)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			accrualSum = 0
-		} else {
-			return 0, 0, err
-		}
+	stmt := `select b."current", b."held", b."withdrawn" from "balances" b join "users" u on u."id" = b."user_id" where u."login" = $1`
+	err = d.db.QueryRow(ctx, stmt, userID).Scan(&current, &held, &withdrawSum)
+	if errors.Is(err, sql.ErrNoRows) { //	если движений по счёту не было - баланс нулевой
+		return 0, 0, 0, nil
 	}
-
-	// выбираем все списания пользователя за всё время
-	stmt = `select SUM("sum") from "withdrawals", "users" where "withdrawals"."userid" = "users"."userid" and "session_id" = $1 group by "withdrawals"."userid"`
-	err = d.DB.QueryRow(stmt, sessionID).Scan(&withdrawSum)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			withdrawSum = 0
-		} else {
-			return 0, 0, err
-		}
+		return 0, 0, 0, err
 	}
 
-	return accrualSum - withdrawSum, withdrawSum, nil
+	return current, held, withdrawSum, nil
 }
 
-//	GetWithdrawals - метод, который возвращает список всех списаний баллов со счёта данного пользователя
-func (d *Database) GetWithdrawals(sessionID string) ([]Withdraw, error) {
+//	GetWithdrawals - метод, который возвращает страницу списка списаний баллов со счёта данного пользователя
+//	вместе с курсором следующей страницы; курсор пустой, если страница последняя
+func (d *Database) GetWithdrawals(ctx context.Context, userID string, params ListParams) ([]Withdraw, string, error) {
+	cursor, hasCursor, err := params.validate()
+	if err != nil {
+		return nil, "", err
+	}
 	var order string
-	var sum float32
-	var processed string
+	var sum, refunded Points
+	var processed time.Time
 	withdrawals := make([]Withdraw, 0)
 
-	stmt := `select "order", "sum", "processed_at" from "withdrawals", "users" where "withdrawals"."userid" = "users"."userid" and "session_id" = $1 order by "processed_at"`
-	rows, err := d.DB.Query(stmt, sessionID)
-	if err != nil || rows.Err() != nil {
-		return nil, err
+	args := queryArgs{userID}
+	conditions, tail := args.page(params, cursor, hasCursor, `w."processed_at"`, `w."order"`)
+	conditions = append([]string{`u."login" = $1`}, conditions...)
+
+	stmt := `select w."order", w."sum", w."refunded", w."processed_at"
+		from "withdrawals" w join "users" u on u."id" = w."user_id" where ` + strings.Join(conditions, " and ") + tail
+	rows, err := d.db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, "", err
 	}
 	defer rows.Close()
 	//	перебираем все строки выборки, добавляя записи withdraw в исходящий срез withdrawals
 	for rows.Next() {
-		err := rows.Scan(&order, &sum, &processed)
+		err := rows.Scan(&order, &sum, &refunded, &processed)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
-		withdrawals = append(withdrawals, Withdraw{Order: order, Sum: sum, ProcessedAt: processed})
+		withdrawals = append(withdrawals, Withdraw{Order: order, Sum: sum, Refunded: refunded, Status: withdrawalStatus(sum, refunded), ProcessedAt: processed})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
 	}
 
 	if len(withdrawals) == 0 { //	если списаний не было
-		return nil, ErrNoDataToAnswer
+		return nil, "", ErrNoDataToAnswer
 	}
 
-	return withdrawals, nil
+	withdrawals, next := withdrawalsPage(withdrawals, params.Limit)
+	return withdrawals, next, nil
+}
+
+//	GetWithdrawalsSummary - метод, который возвращает количество и сумму списаний пользователя за период [from, to),
+//	а также сумму баллов, возвращённых по этим списаниям
+//	нулевые from и to не ограничивают период; если списаний за период не было - итоги нулевые
+func (d *Database) GetWithdrawalsSummary(ctx context.Context, userID string, from, to time.Time) (WithdrawalsSummary, error) {
+	var summary WithdrawalsSummary
+	if err := (ListParams{From: from, To: to}).validatePeriod(); err != nil {
+		return summary, err
+	}
+
+	args := queryArgs{userID}
+	conditions, _ := args.page(ListParams{From: from, To: to}, listCursor{}, false, `w."processed_at"`, `w."order"`)
+	conditions = append([]string{`u."login" = $1`}, conditions...)
+
+	stmt := `select count(*), coalesce(sum(w."sum"), 0), coalesce(sum(w."refunded"), 0)
+		from "withdrawals" w join "users" u on u."id" = w."user_id" where ` + strings.Join(conditions, " and ")
+	if err := d.db.QueryRow(ctx, stmt, args...).Scan(&summary.Count, &summary.Sum, &summary.Refunded); err != nil {
+		return WithdrawalsSummary{}, err
+	}
+
+	return summary, nil
 }
 
 //	OrderInsert - метод вносящий новый заказ в список программы лояльности
-func (d *Database) OrderInsert(order string, sessonID string) error {
-	//	пустые значения order или sessonID к вставке в хранилище не допускаются
-	if order == "" || sessonID == "" {
+func (d *Database) OrderInsert(ctx context.Context, order string, userID string) error {
+	//	пустые значения order или userID к вставке в хранилище не допускаются
+	if order == "" || userID == "" {
 		return ErrEmptyNotAllowed
 	}
 
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	//	номер заказа блокируем - иначе другой пользователь мог бы одновременно списать баллы в счёт этого заказа
+	if err := d.lockOrderNumber(ctx, tx, order); err != nil {
+		return err
+	}
+
 	// проверяем, не содержится ли заказ уже в нашей базе
-	var sessIDfromDB string
-	stmt := `select "session_id" from "orders", "users" where "orders"."userid" = "users"."userid" and "order" = $1`
-	err := d.DB.QueryRow(stmt, order).Scan(&sessIDfromDB)
-	if !errors.Is(err, sql.ErrNoRows) { //	если в базе уже есть строка с таким номером заказа
-		if sessIDfromDB == sessonID {
+	var userIDfromDB string
+	stmt := `select u."login" from "orders" o join "users" u on u."id" = o."user_id" where o."order" = $1`
+	err = tx.QueryRow(ctx, stmt, order).Scan(&userIDfromDB)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err == nil { //	если в базе уже есть строка с таким номером заказа
+		if userIDfromDB == userID {
 			return ErrOrderExistToAccount //	если заказ уже привязан к аккаунту этого пользователя
 		} else {
 			return ErrOrderExistToAnother //	если заказ уже привязан к аккаунту другого пользователя
 		}
 	}
 
-	//	если такого заказа ещё нет в базе - начинаем тразакцию
-	tx, err := d.DB.Begin()
-	if err != nil {
+	//	заказ, в счёт которого другой пользователь уже списал или зарезервировал баллы, тоже считается заказом другого пользователя
+	var paid int
+	stmtPaid := `select 1 from "withdrawals" w join "users" u on u."id" = w."user_id" where w."order" = $1 and u."login" <> $2
+		union all
+		select 1 from "holds" h join "users" u on u."id" = h."user_id" where h."order" = $3 and h."status" = $4 and u."login" <> $5`
+	err = tx.QueryRow(ctx, stmtPaid, order, userID, order, HoldHeld, userID).Scan(&paid)
+	if err == nil {
+		return ErrOrderExistToAnother
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
-	defer tx.Rollback() //	при ошибке выполнения - откатываем транзакцию
 
-	//	готовим SQL-statement для вставки в базу нового заказа
-	stmtInsert, err := tx.Prepare(`insert into "orders" ("order", "status", "accrual", "uploaded_at", "userid") values ($1, 'NEW', 0, $2, (select "userid" from "users" where "session_id" = $3))`)
-	if err != nil {
+	//	вставляем в базу новый заказ
+	now := time.Now().UTC().Truncate(time.Second) //	даты хранятся с точностью до секунды, как в ответах API
+	stmtInsert := `insert into "orders" ("order", "status", "accrual", "uploaded_at", "status_changed_at", "user_id")
+		values ($1, 'NEW', 0, $2, $2, (select "id" from "users" where "login" = $3))`
+	if _, err := tx.Exec(ctx, stmtInsert, order, now, userID); err != nil {
+		return err
+	}
+
+	//	в той же транзакции ставим заказ в очередь синхронизации - он опрашивается на ближайшем цикле
+	if err := enqueueSyncJob(ctx, tx, order, now); err != nil {
 		return err
 	}
-	defer stmtInsert.Close()
 
-	//	 запускаем SQL-statement на исполнение
-	if _, err := stmtInsert.Exec(order, time.Now().Format(time.RFC3339), sessonID); err != nil {
+	//	история статусов заказа начинается со статуса NEW
+	if err := recordOrderStatus(ctx, tx, order, "NEW", now); err != nil {
 		return err
 	}
 
-	return tx.Commit() //	при успешном выполнении вставки - фиксируем транзакцию
+	return tx.Commit(ctx) //	при успешном выполнении вставки - фиксируем транзакцию
 }
 
 //	WithdrawRequest - метод создаёт новую заявку на оплату заказа баллами программы лояльности
-func (d *Database) WithdrawRequest(order string, sum float32, sessionID string) error {
+//	проверка остатка и списание выполняются в одной транзакции под блокировкой строки баланса пользователя,
+//	поэтому параллельные заявки одного пользователя обрабатываются строго по очереди и не могут увести баланс в минус
+func (d *Database) WithdrawRequest(ctx context.Context, order string, sum Points, userID string) error {
 
 	//	пустые значения order или UserID к вставке в хранилище не допускаются
-	if order == "" || sum == 0 || sessionID == "" {
+	if order == "" || sum == 0 || userID == "" {
 		return ErrEmptyNotAllowed
 	}
+	if sum < 0 { //	отрицательная сумма списания не допускается
+		return ErrInvalidPoints
+	}
 
-	// проверяем, достаточно ли средств на балансе пользователя
-	accrualSum, withdrawSum, errSum := d.GetBalance(sessionID)
-	if errSum != nil {
-		return errSum
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return err
 	}
-	if sum > accrualSum-withdrawSum {
-		return ErrInsufficientFundsToAccount
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	//	по заказу не должно быть списания или действующего резерва, и он не должен принадлежать другому пользователю
+	if err := d.checkWithdrawOrder(ctx, tx, order, userID); err != nil {
+		return err
 	}
 
-	//	если средств на счёте достаточно для списания по запросу - начинаем тразакцию
-	tx, err := d.DB.Begin()
+	//	блокируем строку баланса пользователя и проверяем, достаточно ли на нём средств
+	var current Points
+	stmtBalance := `select "current" from "balances" where "user_id" = (select "id" from "users" where "login" = $1)` + d.lockForUpdate("balances")
+	err = tx.QueryRow(ctx, stmtBalance, userID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) { //	если баланса у пользователя нет - списывать нечего
+		return ErrInsufficientFundsToAccount
+	}
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback() //	при ошибке выполнения - откатываем транзакцию
+	if sum > current {
+		return ErrInsufficientFundsToAccount
+	}
 
-	//	готовим SQL-statement для вставки в базу нового заказа
-	stmt, err := tx.Prepare(`insert into "withdrawals" ("order", "sum", "processed_at", "userid") values ($1, $2, $3, (select "userid" from "users" where "session_id" = $4))`)
+	//	вставляем в базу заявку на списание, в качестве даты вставляем текущее время с точностью до секунды
+	//	если списание по тому же заказу параллельно провёл другой пользователь - строка не вставляется
+	stmt := `insert into "withdrawals" ("order", "sum", "processed_at", "user_id") values ($1, $2, $3, (select "id" from "users" where "login" = $4))
+		on conflict ("order") do nothing`
+	inserted, err := tx.Exec(ctx, stmt, order, sum, time.Now().UTC().Truncate(time.Second), userID)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if inserted == 0 {
+		return ErrWithdrawalExist
+	}
 
-	//	 запускаем SQL-statement на исполнение, в качестве даты вставляем текущее время в формате RFC3339
-	if _, err := stmt.Exec(order, sum, time.Now().Format(time.RFC3339), sessionID); err != nil {
+	//	проводим списание по журналу баллов
+	if err := postLedger(ctx, tx, userID, LedgerWithdrawal, AccountRedemption, order, -sum); err != nil {
 		return err
 	}
 
-	return tx.Commit() //	при успешном выполнении вставки - фиксируем транзакцию
-}
-
-//	Close - метод, закрывающий connect к базе данных
-func (d *Database) Close() {
-	//	при остановке сервера connect к базе данных
-	d.DB.Close()
-	time.Sleep(3 * time.Second)
+	return tx.Commit(ctx) //	при успешном выполнении вставки - фиксируем транзакцию
 }
 
-//	UpdateOrdersStatus - метод синхронизации статусов заказов и начисленных баллов с внешним сервисом расчёта бонусных баллов
-func (d *Database) UpdateOrdersStatus() error {
-
-	//	выбираем из базы заказы, находящиеся в НЕ финальных статусах - NEW и PROCESSING
-	stmt := `select "order", "uploaded_at" from "orders" where "orders"."status" = 'NEW' or "orders"."status" = 'PROCESSING'`
-
-	rows, err := d.DB.Query(stmt) //	готовим и компилируем SQL-statement
-	if err != nil || rows.Err() != nil {
-		return err
+//	RefundWithdrawal - метод возвращает на счёт пользователя sum баллов, списанных в счёт заказа order, например при отмене заказа
+//	sum = nil - возврат всех ещё не возвращённых баллов; возвратов по одному списанию может быть несколько, но не больше его суммы
+//	исходное списание сохраняется, возврат проводится по журналу баллов компенсирующей операцией REVERSAL
+//	пустой userID - возврат от имени администратора по списанию любого пользователя
+func (d *Database) RefundWithdrawal(ctx context.Context, order string, sum *Points, userID string) (Withdraw, error) {
+	if order == "" {
+		return Withdraw{}, ErrEmptyNotAllowed
 	}
-	defer rows.Close()
-
-	var orderNum, uploadTime string
-	orders := make([]Order, 0)
-
-	for rows.Next() { //	перебираем все строки выборки
-		err := rows.Scan(&orderNum, &uploadTime)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				return nil
-			}
-			return err
-		}
-		//	и формируем из них список orders для синхронизации с системой начисления баллов
-		orders = append(orders, Order{Number: orderNum, Accrual: 0, Status: "PROCESSING", UploadedAt: uploadTime})
-		//	до синхронизации переводим все новые заказы в статус PROCESSING, с суммой начисленных баллов = 0
+	if sum != nil && *sum <= 0 { //	нулевая и отрицательная суммы возврата не допускаются
+		return Withdraw{}, ErrInvalidPoints
 	}
 
-	//	если заказов для синхронизации не нашлось - то завершаем на этом процесс синхронизации
-	if len(orders) == 0 { //	если заказов на начисление баллов не было
-		return nil
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return Withdraw{}, err
 	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
 
-	//	если заказы нашлись, то синхронизуем их статусы и начисления с сервером начисления бонусных баллов
-	err = Syncer.SyncOrderStatus(orders)
+	//	блокируем строку списания - параллельные возвраты по нему обрабатываются строго по очереди
+	var owner string
+	withdraw := Withdraw{Order: order}
+	stmt := `select u."login", w."sum", w."refunded", w."processed_at" from "withdrawals" w join "users" u on u."id" = w."user_id"
+		where w."order" = $1` + d.lockForUpdate("w")
+	err = tx.QueryRow(ctx, stmt, order).Scan(&owner, &withdraw.Sum, &withdraw.Refunded, &withdraw.ProcessedAt)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && userID != "" && owner != userID) { //	чужое и несуществующее списание неотличимы
+		return Withdraw{}, ErrNoDataToAnswer
+	}
 	if err != nil {
-		return err
+		return Withdraw{}, err
 	}
 
-	//	теперь в списке orders лежит обновленная информация по заказам на начисление баллов - обновим нашу базу
-	tx, err := d.DB.Begin() //	начинаем транзакцию
-	if err != nil {
-		return err
+	rest := withdraw.Sum - withdraw.Refunded
+	if rest <= 0 {
+		return Withdraw{}, ErrWithdrawalRefunded
 	}
-	defer tx.Rollback() //	при ошибке выполнения - откатываем транзакцию
+	refund := rest
+	if sum != nil {
+		refund = *sum
+	}
+	if refund > rest {
+		return Withdraw{}, ErrRefundExceedsWithdrawal
+	}
+	withdraw.Refunded += refund
+	withdraw.Status = withdrawalStatus(withdraw.Sum, withdraw.Refunded)
 
-	//	готовим SQL-statement для обновления в базе информации по заказам
-	stmtInsert, err := tx.Prepare(`update "orders" set "status" = $1, "accrual" = $2, "uploaded_at" = $3 where "order" = $4`)
-	if err != nil {
-		return err
+	stmt = `update "withdrawals" set "refunded" = $1 where "order" = $2`
+	if _, err := tx.Exec(ctx, stmt, withdraw.Refunded, order); err != nil {
+		return Withdraw{}, err
 	}
-	defer stmtInsert.Close()
 
-	for i := range orders { //	 запускаем обновление для каждого элемента списка на исполнение
-		if _, err := stmtInsert.Exec(orders[i].Status, orders[i].Accrual, orders[i].UploadedAt, orders[i].Number); err != nil {
-			log.Println(err.Error()) //	если при вставке произошла ошибка, то заносим её в журнал
-		}
+	//	возвращаем баллы на счёт владельца списания по журналу баллов
+	if err := postLedger(ctx, tx, owner, LedgerReversal, AccountRedemption, order, refund); err != nil {
+		return Withdraw{}, err
 	}
 
-	return tx.Commit() //	фиксируем транзакцию, и результат фиксации возвращаем в вызывающую функцию
+	return withdraw, tx.Commit(ctx) //	при успешном выполнении возврата - фиксируем транзакцию
+}
+
+//	Close - метод, закрывающий connect к базе данных
+func (d *Database) Close() {
+	//	при остановке сервера закрываем пул соединений с базой данных
+	d.db.Close()
 }
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBalanceReconciles(t *testing.T) {
+	ctx := context.Background()
+	//	для тестов используется виртуальная база данных SQLlite в режиме "in memory"
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+
+	//	три заказа, эмулятор сервиса начислений начисляет по 100 баллов за каждый
+	for _, order := range []string{"2834832929383747", "12345678903", "79927398713"} {
+		require.NoError(t, datasource.OrderInsert(ctx, order, "test1"))
+	}
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+
+	//	1000 списаний по 0.1 балла - в float32 такая серия заметно расходится с точной суммой
+	step, err := ParsePoints("0.1")
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, datasource.WithdrawRequest(ctx, "w"+strconv.Itoa(i), step, "test1"))
+	}
+
+	current, _, withdrawn, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, "200", current.String())
+	assert.Equal(t, "100", withdrawn.String())
+	assert.Equal(t, Points(300*PointsScale), current+withdrawn)
+
+	//	сумма списаний по GetWithdrawals совпадает с балансом до копейки
+	withdrawals, _, err := datasource.GetWithdrawals(ctx, "test1", ListParams{})
+	require.NoError(t, err)
+	var sum Points
+	for _, w := range withdrawals {
+		sum += w.Sum
+	}
+	assert.Equal(t, withdrawn, sum)
+
+	//	списание сверх остатка отклоняется, остаток не меняется
+	err = datasource.WithdrawRequest(ctx, "overdraft", current+1, "test1")
+	assert.ErrorIs(t, err, ErrInsufficientFundsToAccount)
+}
+
+func TestLedgerIsSourceOfBalances(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "2834832929383747", "test1"))
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	//	повторная синхронизация не должна начислять баллы повторно
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	require.NoError(t, datasource.WithdrawRequest(ctx, "2377225624", 1150, "test1"))
+
+	//	каждая операция журнала сбалансирована: сумма проводок равна нулю
+	var unbalanced int
+	err = d.db.QueryRow(ctx, `select count(*) from (select "tx_id" from "ledger" group by "tx_id" having sum("amount") <> 0) as t`).Scan(&unbalanced)
+	require.NoError(t, err)
+	assert.Equal(t, 0, unbalanced)
+
+	var entries int
+	require.NoError(t, d.db.QueryRow(ctx, `select count(*) from "ledger"`).Scan(&entries))
+	assert.Equal(t, 4, entries)
+
+	current, _, withdrawn, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(8850), current)
+	assert.Equal(t, Points(1150), withdrawn)
+
+	//	пересчёт материализованного баланса из журнала даёт те же значения
+	_, err = d.db.Exec(ctx, `update "balances" set "current" = 0, "withdrawn" = 0`)
+	require.NoError(t, err)
+	require.NoError(t, d.refreshBalances())
+
+	current, _, withdrawn, err = datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(8850), current)
+	assert.Equal(t, Points(1150), withdrawn)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	defer func(ttl time.Duration) { SessionTTL = ttl }(SessionTTL)
+
+	//	сессия с истёкшим сроком действия не принимается сервером, даже если клиент прислал cookie
+	SessionTTL = -time.Minute
+	expired, expiresAt, err := datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{UserAgent: "test", IP: "127.0.0.1"})
+	require.NoError(t, err)
+	assert.True(t, expiresAt.Before(time.Now()))
+
+	_, _, err = datasource.SessionUser(ctx, expired)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	SessionTTL = time.Hour
+	active, _, err := datasource.UserAuthorise(ctx, "test1", "test1_password", SessionMeta{UserAgent: "test", IP: "127.0.0.1"})
+	require.NoError(t, err)
+
+	userID, sessionID, err := datasource.SessionUser(ctx, active)
+	require.NoError(t, err)
+	assert.Equal(t, "test1", userID)
+
+	//	истёкшая сессия удалена и не попадает в список сессий пользователя
+	sessions, err := datasource.GetSessions(ctx, userID, sessionID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].Current)
+	assert.Equal(t, "test", sessions[0].UserAgent)
+	assert.Equal(t, "127.0.0.1", sessions[0].IP)
+
+	//	refresh token одноразовый: после продления сессии прежнее значение не действует
+	_, refreshedID, refreshed, _, err := datasource.RefreshSession(ctx, active)
+	require.NoError(t, err)
+	assert.Equal(t, sessionID, refreshedID)
+	_, _, _, _, err = datasource.RefreshSession(ctx, active)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	_, _, err = datasource.SessionUser(ctx, refreshed)
+	assert.NoError(t, err)
+}
+
+func TestUpdateOrdersStatusKeepsUploadedAt(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "2834832929383747", "test1"))
+
+	orders, _, err := datasource.GetOrders(ctx, "test1", OrdersFilter{})
+	require.NoError(t, err)
+	uploadedAt := orders[0].UploadedAt
+	assert.WithinDuration(t, time.Now(), uploadedAt, 5*time.Second)
+	assert.Equal(t, uploadedAt, orders[0].StatusChangedAt)
+	assert.Nil(t, orders[0].ProcessedAt)
+
+	//	синхронизация меняет статус и даты его смены, но не дату загрузки заказа
+	time.Sleep(time.Second)
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+
+	orders, _, err = datasource.GetOrders(ctx, "test1", OrdersFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", orders[0].Status)
+	assert.True(t, uploadedAt.Equal(orders[0].UploadedAt), orders[0].UploadedAt)
+	assert.True(t, orders[0].StatusChangedAt.After(uploadedAt), orders[0].StatusChangedAt)
+	require.NotNil(t, orders[0].ProcessedAt)
+	assert.True(t, orders[0].ProcessedAt.Equal(orders[0].StatusChangedAt))
+}
+
+func TestCancelledContext(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+
+	//	запросы с отменённым контекстом - например, клиент разорвал соединение - к базе данных не выполняются
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, _, err = datasource.GetOrders(cancelled, "test1", OrdersFilter{})
+	assert.ErrorIs(t, err, context.Canceled)
+	_, _, _, err = datasource.GetBalance(cancelled, "test1")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, datasource.OrderInsert(cancelled, "12345678903", "test1"), context.Canceled)
+
+	//	заказ не создан, а источник данных продолжает обслуживать другие запросы
+	_, _, err = datasource.GetOrders(ctx, "test1", OrdersFilter{})
+	assert.ErrorIs(t, err, ErrNoDataToAnswer)
+}
+
+//	brokenRowsPool - пул соединений, выборки которого обрываются ошибкой errRowsBroken до первой строки
+type brokenRowsPool struct {
+	dbPool
+}
+
+var errRowsBroken = errors.New("connection reset while reading rows")
+
+func (p brokenRowsPool) Query(ctx context.Context, stmt string, args ...interface{}) (dbRows, error) {
+	rows, err := p.dbPool.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	return brokenRows{rows}, nil
+}
+
+//	brokenRows - выборка, оборванная ошибкой errRowsBroken
+type brokenRows struct {
+	dbRows
+}
+
+func (r brokenRows) Next() bool { return false }
+func (r brokenRows) Err() error { return errRowsBroken }
+
+func TestRowsError(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	token, _, err := datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "12345678903", "test1"))
+	_, sessionID, err := datasource.SessionUser(ctx, token)
+	require.NoError(t, err)
+
+	//	ошибка чтения выборки возвращается вызывающему, а не подменяется пустым результатом
+	d.db = brokenRowsPool{d.db}
+	_, _, err = d.GetOrders(ctx, "test1", OrdersFilter{})
+	assert.ErrorIs(t, err, errRowsBroken)
+	_, _, err = d.GetWithdrawals(ctx, "test1", ListParams{})
+	assert.ErrorIs(t, err, errRowsBroken)
+	_, err = d.GetSessions(ctx, "test1", sessionID)
+	assert.ErrorIs(t, err, errRowsBroken)
+	_, err = d.GetOrder(ctx, "test1", "12345678903")
+	assert.ErrorIs(t, err, errRowsBroken)
+	_, _, err = d.leaseSyncJobs(ctx, time.Now().UTC())
+	assert.ErrorIs(t, err, errRowsBroken)
+}
+
+func TestSQLiteFile(t *testing.T) {
+	ctx := context.Background()
+	dsn := "sqlite://" + filepath.Join(t.TempDir(), "gophermart.db")
+
+	datasource, err := NewDatasource(dsn, "")
+	require.NoError(t, err)
+
+	//	база работает в режиме журнала WAL
+	var journalMode string
+	require.NoError(t, datasource.(*Database).db.QueryRow(ctx, `pragma journal_mode`).Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+
+	//	пользователь с начисленными по заказу 100 баллами
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "12345678903", "test1"))
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+
+	//	параллельные списания не уводят баланс в минус: из 10 заявок по 30 баллов проходят только 3
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- datasource.WithdrawRequest(ctx, "order"+strconv.Itoa(i), Points(30*PointsScale), "test1")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrInsufficientFundsToAccount)
+	}
+	assert.Equal(t, 3, succeeded)
+	datasource.Close()
+
+	//	после перезапуска данные сохраняются, а повторный запуск миграций ничего не меняет
+	datasource, err = NewDatasource(dsn, "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	current, _, withdrawn, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(10*PointsScale), current)
+	assert.Equal(t, Points(90*PointsScale), withdrawn)
+	_, _, err = datasource.UserAuthorise(ctx, "test1", "test1_password", SessionMeta{})
+	assert.NoError(t, err)
+	status, err := datasource.(*Database).MigrationStatus()
+	require.NoError(t, err)
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt, s.Name)
+	}
+
+	//	путь к файлу базы обязателен
+	_, err = OpenDatabase("sqlite://")
+	assert.Error(t, err)
+}
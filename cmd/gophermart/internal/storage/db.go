@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//	Хранилище работает с PostgreSQL напрямую через пул соединений pgx (pgxpool), а с sqlite - через database/sql.
+//	Запросы к обеим базам выполняются через общий интерфейс dbPool, все методы которого принимают context.Context:
+//	при отмене запроса клиентом прерывается и выполнение SQL в базе данных.
+
+//	параметры пула соединений с PostgreSQL, размер пула ограничивает и количество соединений с файловой базой sqlite
+var (
+	DatabaseMaxConns          = 10              //	максимальное количество соединений в пуле
+	DatabaseMinConns          = 0               //	количество соединений, которые пул держит открытыми постоянно
+	DatabaseConnectTimeout    = 5 * time.Second //	время на установку соединения с базой данных
+	DatabaseHealthCheckPeriod = time.Minute     //	период проверки простаивающих соединений пула
+)
+
+//	SQLiteBusyTimeout - время, в течение которого соединение с файловой базой sqlite ждёт освобождения блокировки записи
+var SQLiteBusyTimeout = 5 * time.Second
+
+//	dbQuerier - запросы к базе данных, общие для пула соединений, отдельного соединения и транзакции
+//	в sqlite параметры $N нумеруются в порядке их появления в запросе, в PostgreSQL - по номеру
+type dbQuerier interface {
+	Exec(ctx context.Context, stmt string, args ...interface{}) (rowsAffected int64, err error) //	выполнение запроса без выборки
+	Query(ctx context.Context, stmt string, args ...interface{}) (dbRows, error)                //	выполнение запроса с выборкой
+	QueryRow(ctx context.Context, stmt string, args ...interface{}) dbRow                       //	выполнение запроса с выборкой одной строки
+}
+
+//	dbRows - выборка строк запроса
+type dbRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close()
+}
+
+//	dbRow - строка выборки; если запрос не вернул строк, Scan возвращает sql.ErrNoRows для обеих баз данных
+type dbRow interface {
+	Scan(dest ...interface{}) error
+}
+
+//	dbTx - транзакция
+type dbTx interface {
+	dbQuerier
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+//	dbConn - соединение, взятое из пула в монопольное пользование, - например, для блокировки миграций
+type dbConn interface {
+	dbQuerier
+	Begin(ctx context.Context) (dbTx, error)
+	Release()
+}
+
+//	dbPool - пул соединений с базой данных
+type dbPool interface {
+	dbQuerier
+	Begin(ctx context.Context) (dbTx, error)
+	Acquire(ctx context.Context) (dbConn, error)
+	Close()
+}
+
+//	newPgxPool - функция открывает пул соединений с PostgreSQL с параметрами Database* и проверяет доступность базы
+func newPgxPool(ctx context.Context, DatabaseDSN string) (dbPool, error) {
+	cfg, err := pgxpool.ParseConfig(DatabaseDSN)
+	if err != nil {
+		return nil, err
+	}
+	if DatabaseMaxConns > 0 {
+		cfg.MaxConns = int32(DatabaseMaxConns)
+	}
+	cfg.MinConns = int32(DatabaseMinConns)
+	if DatabaseConnectTimeout > 0 {
+		cfg.ConnConfig.ConnectTimeout = DatabaseConnectTimeout
+	}
+	if DatabaseHealthCheckPeriod > 0 {
+		cfg.HealthCheckPeriod = DatabaseHealthCheckPeriod
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := pool.Ping(ctx); err != nil { //	если база недоступна, пул не открываем
+		pool.Close()
+		return nil, err
+	}
+
+	return pgxPool{pgxQuerier{pool}, pool}, nil
+}
+
+//	pgxExecutor - запросы pgx, общие для пула, соединения и транзакции
+type pgxExecutor interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+//	pgxQuerier - реализация dbQuerier для PostgreSQL
+type pgxQuerier struct {
+	q pgxExecutor
+}
+
+func (p pgxQuerier) Exec(ctx context.Context, stmt string, args ...interface{}) (int64, error) {
+	tag, err := p.q.Exec(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (p pgxQuerier) Query(ctx context.Context, stmt string, args ...interface{}) (dbRows, error) {
+	rows, err := p.q.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (p pgxQuerier) QueryRow(ctx context.Context, stmt string, args ...interface{}) dbRow {
+	return pgxRow{p.q.QueryRow(ctx, stmt, args...)}
+}
+
+//	pgxRow - строка выборки pgx, возвращающая sql.ErrNoRows для пустой выборки, как и database/sql
+type pgxRow struct {
+	row pgx.Row
+}
+
+func (r pgxRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+//	pgxPool - реализация dbPool на пуле соединений pgxpool
+type pgxPool struct {
+	pgxQuerier
+	pool *pgxpool.Pool
+}
+
+func (p pgxPool) Begin(ctx context.Context) (dbTx, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgxTx{pgxQuerier{tx}, tx}, nil
+}
+
+func (p pgxPool) Acquire(ctx context.Context) (dbConn, error) {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgxConn{pgxQuerier{conn}, conn}, nil
+}
+
+func (p pgxPool) Close() {
+	p.pool.Close()
+}
+
+//	pgxConn - реализация dbConn на соединении pgxpool
+type pgxConn struct {
+	pgxQuerier
+	conn *pgxpool.Conn
+}
+
+func (c pgxConn) Begin(ctx context.Context) (dbTx, error) {
+	tx, err := c.conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgxTx{pgxQuerier{tx}, tx}, nil
+}
+
+func (c pgxConn) Release() {
+	c.conn.Release()
+}
+
+//	pgxTx - реализация dbTx на транзакции pgx
+type pgxTx struct {
+	pgxQuerier
+	tx pgx.Tx
+}
+
+func (t pgxTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t pgxTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback(ctx)
+}
+
+//	sqlExecutor - запросы database/sql, общие для *sql.DB, *sql.Conn и *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+//	sqlQuerier - реализация dbQuerier для sqlite
+type sqlQuerier struct {
+	q sqlExecutor
+}
+
+func (s sqlQuerier) Exec(ctx context.Context, stmt string, args ...interface{}) (int64, error) {
+	res, err := s.q.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s sqlQuerier) Query(ctx context.Context, stmt string, args ...interface{}) (dbRows, error) {
+	rows, err := s.q.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlRows{rows}, nil
+}
+
+func (s sqlQuerier) QueryRow(ctx context.Context, stmt string, args ...interface{}) dbRow {
+	return s.q.QueryRowContext(ctx, stmt, args...)
+}
+
+//	sqlRows - выборка database/sql
+type sqlRows struct {
+	*sql.Rows
+}
+
+func (r sqlRows) Close() {
+	r.Rows.Close()
+}
+
+//	sqlPool - реализация dbPool на пуле соединений database/sql
+type sqlPool struct {
+	sqlQuerier
+	db *sql.DB
+}
+
+//	newSQLPool - функция оборачивает пул соединений database/sql в dbPool
+func newSQLPool(db *sql.DB) dbPool {
+	return sqlPool{sqlQuerier{db}, db}
+}
+
+func (p sqlPool) Begin(ctx context.Context) (dbTx, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{sqlQuerier{tx}, tx}, nil
+}
+
+func (p sqlPool) Acquire(ctx context.Context) (dbConn, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sqlConn{sqlQuerier{conn}, conn}, nil
+}
+
+func (p sqlPool) Close() {
+	p.db.Close()
+}
+
+//	sqlConn - реализация dbConn на соединении database/sql
+type sqlConn struct {
+	sqlQuerier
+	conn *sql.Conn
+}
+
+func (c sqlConn) Begin(ctx context.Context) (dbTx, error) {
+	tx, err := c.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{sqlQuerier{tx}, tx}, nil
+}
+
+func (c sqlConn) Release() {
+	c.conn.Close()
+}
+
+//	sqlTx - реализация dbTx на транзакции database/sql - контекст транзакции задаётся при её открытии
+type sqlTx struct {
+	sqlQuerier
+	tx *sql.Tx
+}
+
+func (t sqlTx) Commit(context.Context) error {
+	return t.tx.Commit()
+}
+
+func (t sqlTx) Rollback(context.Context) error {
+	return t.tx.Rollback()
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//	Двухфазное списание баллов: при оформлении корзины баллы резервируются (HoldRequest) - они перестают быть
+//	доступными для других списаний, но ещё не считаются потраченными; после оплаты заказа резерв списывается
+//	(HoldCapture) как обычное списание WithdrawRequest, а при отказе от заказа - возвращается в доступный остаток (HoldRelease).
+//	Резерв, не списанный и не возвращённый до истечения срока, возвращается в доступный остаток фоновой задачей ReleaseExpiredHolds.
+//	Журнал баллов фиксирует только фактическое списание при HoldCapture; сумма действующих резервов пользователя
+//	хранится в материализованном балансе (held), а доступный остаток current - это остаток по журналу за вычетом резервов.
+
+//	статусы резерва баллов
+const (
+	HoldHeld     = "HELD"     //	баллы зарезервированы
+	HoldCaptured = "CAPTURED" //	резерв списан в счёт оплаты заказа
+	HoldReleased = "RELEASED" //	резерв возвращён в доступный остаток
+	HoldExpired  = "EXPIRED"  //	резерв возвращён в доступный остаток по истечении срока
+)
+
+//	DefaultHoldTTL - срок действия резерва баллов, если он не задан
+const DefaultHoldTTL = 15 * time.Minute
+
+//	Hold - структура для передачи информации о резерве баллов в счёт оплаты заказа
+//	используется в методах HoldRequest, HoldCapture и HoldRelease
+type Hold struct {
+	ID        string     `json:"id"`                  //  идентификатор резерва
+	Order     string     `json:"order"`               //  номер заказа, в счёт которого зарезервированы баллы
+	Sum       Points     `json:"sum"`                 //  сумма зарезервированных баллов
+	Status    string     `json:"status"`              //  статус резерва: HELD, CAPTURED, RELEASED или EXPIRED
+	CreatedAt time.Time  `json:"created_at"`          //  дата резервирования
+	ExpiresAt time.Time  `json:"expires_at"`          //  срок действия резерва
+	ClosedAt  *time.Time `json:"closed_at,omitempty"` //  дата списания или возврата резерва
+}
+
+//	ErrHoldExist - ошибка возникающая при попытке зарезервировать или списать баллы в счёт заказа, по которому уже действует резерв
+var ErrHoldExist = errors.New("points are already held for this order")
+
+//	ErrHoldClosed - ошибка возникающая при попытке списать или вернуть резерв, который уже списан или возвращён
+var ErrHoldClosed = errors.New("hold is already captured or released")
+
+//	ErrHoldExpired - ошибка возникающая при попытке списать резерв, срок действия которого истёк
+var ErrHoldExpired = errors.New("hold is expired")
+
+//	HoldRequest - метод резервирует sum баллов пользователя в счёт оплаты заказа order на срок ttl
+//	проверки те же, что и у WithdrawRequest; резерв уменьшает доступный остаток и увеличивает сумму резервов в одной транзакции
+func (d *Database) HoldRequest(ctx context.Context, order string, sum Points, userID string, ttl time.Duration) (Hold, error) {
+	if order == "" || sum == 0 || userID == "" {
+		return Hold{}, ErrEmptyNotAllowed
+	}
+	if sum < 0 { //	отрицательная сумма резерва не допускается
+		return Hold{}, ErrInvalidPoints
+	}
+	if ttl <= 0 {
+		ttl = DefaultHoldTTL
+	}
+
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	if err := d.checkWithdrawOrder(ctx, tx, order, userID); err != nil {
+		return Hold{}, err
+	}
+
+	//	блокируем строку баланса пользователя и проверяем, достаточно ли на нём доступных средств
+	var current Points
+	stmtBalance := `select "current" from "balances" where "user_id" = (select "id" from "users" where "login" = $1)` + d.lockForUpdate("balances")
+	err = tx.QueryRow(ctx, stmtBalance, userID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) { //	если баланса у пользователя нет - резервировать нечего
+		return Hold{}, ErrInsufficientFundsToAccount
+	}
+	if err != nil {
+		return Hold{}, err
+	}
+	if sum > current {
+		return Hold{}, ErrInsufficientFundsToAccount
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	hold := Hold{ID: newSessionID(), Order: order, Sum: sum, Status: HoldHeld, CreatedAt: now, ExpiresAt: now.Add(ttl)}
+
+	//	если резерв по тому же заказу параллельно оформил другой пользователь - строка не вставляется
+	stmt := `insert into "holds" ("id", "order", "user_id", "sum", "status", "created_at", "expires_at")
+		values ($1, $2, (select "id" from "users" where "login" = $3), $4, $5, $6, $7) on conflict do nothing`
+	inserted, err := tx.Exec(ctx, stmt, hold.ID, order, userID, sum, HoldHeld, hold.CreatedAt, hold.ExpiresAt)
+	if err != nil {
+		return Hold{}, err
+	}
+	if inserted == 0 {
+		return Hold{}, ErrHoldExist
+	}
+
+	stmt = `update "balances" set "current" = round("current" - $1, 2), "held" = round("held" + $1, 2)
+		where "user_id" = (select "id" from "users" where "login" = $2)`
+	if _, err := tx.Exec(ctx, stmt, sum, userID); err != nil {
+		return Hold{}, err
+	}
+
+	return hold, tx.Commit(ctx) //	при успешном выполнении резервирования - фиксируем транзакцию
+}
+
+//	checkWithdrawOrder - метод проверяет, можно ли списать или зарезервировать баллы пользователя userID в счёт заказа order:
+//	по заказу не должно быть ни списания, ни действующего резерва, и заказ не должен быть зарегистрирован для начисления другим пользователем
+func (d *Database) checkWithdrawOrder(ctx context.Context, tx dbTx, order, userID string) error {
+	//	номер заказа блокируем до конца транзакции - иначе другой пользователь мог бы одновременно загрузить этот заказ
+	if err := d.lockOrderNumber(ctx, tx, order); err != nil {
+		return err
+	}
+
+	//	в счёт одного заказа баллы списываются только один раз
+	var exists int
+	err := tx.QueryRow(ctx, `select 1 from "withdrawals" where "order" = $1`, order).Scan(&exists)
+	if err == nil {
+		return ErrWithdrawalExist
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	//	и только по одному резерву
+	err = tx.QueryRow(ctx, `select 1 from "holds" where "order" = $1 and "status" = $2`, order, HoldHeld).Scan(&exists)
+	if err == nil {
+		return ErrHoldExist
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	//	списывать баллы в счёт заказа, зарегистрированного для начисления другим пользователем, нельзя
+	var owner string
+	stmtOwner := `select u."login" from "orders" o join "users" u on u."id" = o."user_id" where o."order" = $1`
+	err = tx.QueryRow(ctx, stmtOwner, order).Scan(&owner)
+	if err == nil && owner != userID {
+		return ErrOrderExistToAnother
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return nil
+}
+
+//	HoldCapture - метод списывает резерв id пользователя userID в счёт оплаты заказа, для которого он оформлен
+//	списание проводится так же, как и WithdrawRequest; резерв с истёкшим сроком не списывается, а возвращается в доступный остаток
+func (d *Database) HoldCapture(ctx context.Context, id, userID string) (Hold, error) {
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	hold, holderID, err := d.lockHold(ctx, tx, id, userID)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if !hold.ExpiresAt.After(now) { //	срок резерва истёк - возвращаем его в доступный остаток, не дожидаясь фоновой задачи
+		if err := closeHold(ctx, tx, &hold, holderID, HoldExpired, now); err != nil {
+			return Hold{}, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return Hold{}, err
+		}
+		return Hold{}, ErrHoldExpired
+	}
+
+	//	вставляем в базу списание по заказу резерва
+	stmt := `insert into "withdrawals" ("order", "sum", "processed_at", "user_id") values ($1, $2, $3, $4) on conflict ("order") do nothing`
+	inserted, err := tx.Exec(ctx, stmt, hold.Order, hold.Sum, now, holderID)
+	if err != nil {
+		return Hold{}, err
+	}
+	if inserted == 0 {
+		return Hold{}, ErrWithdrawalExist
+	}
+
+	//	закрываем резерв - баллы возвращаются в доступный остаток и сразу же списываются по журналу баллов
+	if err := closeHold(ctx, tx, &hold, holderID, HoldCaptured, now); err != nil {
+		return Hold{}, err
+	}
+	if err := postLedger(ctx, tx, userID, LedgerWithdrawal, AccountRedemption, hold.Order, -hold.Sum); err != nil {
+		return Hold{}, err
+	}
+
+	return hold, tx.Commit(ctx) //	при успешном выполнении списания - фиксируем транзакцию
+}
+
+//	HoldRelease - метод возвращает резерв id пользователя userID в доступный остаток, например при отказе от заказа
+func (d *Database) HoldRelease(ctx context.Context, id, userID string) (Hold, error) {
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	hold, holderID, err := d.lockHold(ctx, tx, id, userID)
+	if err != nil {
+		return Hold{}, err
+	}
+	if err := closeHold(ctx, tx, &hold, holderID, HoldReleased, time.Now().UTC().Truncate(time.Second)); err != nil {
+		return Hold{}, err
+	}
+
+	return hold, tx.Commit(ctx) //	при успешном выполнении возврата - фиксируем транзакцию
+}
+
+//	lockHold - метод блокирует до конца транзакции действующий резерв id пользователя userID
+//	и возвращает его вместе с идентификатором владельца в таблице users
+func (d *Database) lockHold(ctx context.Context, tx dbTx, id, userID string) (hold Hold, holderID int64, err error) {
+	var owner string
+	stmt := `select h."order", h."sum", h."status", h."created_at", h."expires_at", h."user_id", u."login"
+		from "holds" h join "users" u on u."id" = h."user_id" where h."id" = $1` + d.lockForUpdate("h")
+	err = tx.QueryRow(ctx, stmt, id).Scan(&hold.Order, &hold.Sum, &hold.Status, &hold.CreatedAt, &hold.ExpiresAt, &holderID, &owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID) { //	чужой и несуществующий резерв неотличимы
+		return Hold{}, 0, ErrNoDataToAnswer
+	}
+	if err != nil {
+		return Hold{}, 0, err
+	}
+	if hold.Status != HoldHeld {
+		return Hold{}, 0, ErrHoldClosed
+	}
+	hold.ID = id
+	return hold, holderID, nil
+}
+
+//	closeHold - функция закрывает резерв hold в статусе status в рамках транзакции tx
+//	и возвращает его сумму из резервов в доступный остаток владельца holderID
+func closeHold(ctx context.Context, tx dbTx, hold *Hold, holderID int64, status string, closedAt time.Time) error {
+	stmt := `update "holds" set "status" = $1, "closed_at" = $2 where "id" = $3`
+	if _, err := tx.Exec(ctx, stmt, status, closedAt, hold.ID); err != nil {
+		return err
+	}
+	stmt = `update "balances" set "current" = round("current" + $1, 2), "held" = round("held" - $1, 2) where "user_id" = $2`
+	if _, err := tx.Exec(ctx, stmt, hold.Sum, holderID); err != nil {
+		return err
+	}
+	hold.Status = status
+	hold.ClosedAt = &closedAt
+	return nil
+}
+
+//	ReleaseExpiredHolds - метод возвращает в доступный остаток все резервы с истёкшим сроком и возвращает их количество
+//	вызывается фоновой задачей; резервы, заблокированные параллельным списанием или возвратом, пропускаются до следующего вызова
+func (d *Database) ReleaseExpiredHolds(ctx context.Context) (int, error) {
+	//	начинаем тразакцию
+	tx, err := d.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	now := time.Now().UTC().Truncate(time.Second)
+	stmt := `select "id", "sum", "user_id" from "holds" where "status" = $1 and "expires_at" <= $2` + d.skipLocked()
+	rows, err := tx.Query(ctx, stmt, HoldHeld, now)
+	if err != nil {
+		return 0, err
+	}
+	type expiredHold struct {
+		hold     Hold
+		holderID int64
+	}
+	var expired []expiredHold
+	for rows.Next() {
+		var e expiredHold
+		if err := rows.Scan(&e.hold.ID, &e.hold.Sum, &e.holderID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i := range expired {
+		if err := closeHold(ctx, tx, &expired[i].hold, expired[i].holderID, HoldExpired, now); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(expired), tx.Commit(ctx)
+}
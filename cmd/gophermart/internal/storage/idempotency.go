@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//	IdempotencyLockTTL - срок, в течение которого ключ идемпотентности остаётся зарезервированным за выполняющимся запросом:
+//	если сервер упал, не сохранив ответ и не освободив ключ, по истечении этого срока ключ может зарезервировать повтор запроса
+var IdempotencyLockTTL = 5 * time.Minute
+
+//	IdempotencyReserve - метод резервирует ключ идемпотентности key для пользователя перед выполнением запроса
+//	если ключ свободен - он резервируется на время ttl и метод возвращает nil: запрос нужно выполнить и сохранить ответ через IdempotencySave;
+//	если по ключу уже сохранён ответ на такой же запрос (requestHash) - метод возвращает этот ответ для повторной выдачи клиенту;
+//	если ключ использован с другим запросом - возвращается ErrIdempotencyKeyReused, если запрос ещё выполняется - ErrIdempotencyInProgress;
+//	резерв запроса, не завершённого за IdempotencyLockTTL, считается брошенным, и ключ резервируется заново
+func (d *Database) IdempotencyReserve(ctx context.Context, key, requestHash, userID string, ttl time.Duration) (*IdempotentResponse, error) {
+	//	пустые значения key, requestHash или userID не допускаются
+	if key == "" || requestHash == "" || userID == "" {
+		return nil, ErrEmptyNotAllowed
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	//	удаляем ключи с истёкшим сроком хранения и брошенные резервы запросов, не завершённых за IdempotencyLockTTL
+	stmt := `delete from "idempotency_keys" where "expires_at" < $1 or ("status_code" = 0 and "created_at" <= $2)`
+	if _, err := d.db.Exec(ctx, stmt, now, now.Add(-IdempotencyLockTTL)); err != nil {
+		return nil, err
+	}
+
+	//	пробуем зарезервировать ключ: код статуса 0 означает, что запрос ещё выполняется
+	n, err := d.db.Exec(ctx, `insert into "idempotency_keys" ("key", "user_id", "request_hash", "status_code", "content_type", "response", "created_at", "expires_at")
+		values ($1, (select "id" from "users" where "login" = $2), $3, 0, '', '', $4, $5) on conflict ("user_id", "key") do nothing`,
+		key, userID, requestHash, now, now.Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+	if n == 1 { //	ключ свободен и теперь зарезервирован за этим запросом
+		return nil, nil
+	}
+
+	//	ключ уже использовался - сверяем запрос и выдаём сохранённый ответ
+	var hashFromDB, response string
+	stored := IdempotentResponse{}
+	stmt = `select "request_hash", "status_code", "content_type", "response" from "idempotency_keys"
+		where "user_id" = (select "id" from "users" where "login" = $1) and "key" = $2`
+	err = d.db.QueryRow(ctx, stmt, userID, key).Scan(&hashFromDB, &stored.StatusCode, &stored.ContentType, &response)
+	if errors.Is(err, sql.ErrNoRows) { //	ключ успели освободить - клиенту стоит повторить запрос
+		return nil, ErrIdempotencyInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hashFromDB != requestHash { //	ключ использован с другим содержимым запроса
+		return nil, ErrIdempotencyKeyReused
+	}
+	if stored.StatusCode == 0 { //	запрос с этим ключом ещё выполняется
+		return nil, ErrIdempotencyInProgress
+	}
+	stored.Body = []byte(response)
+
+	return &stored, nil
+}
+
+//	IdempotencySave - метод сохраняет ответ на запрос, выполненный с ключом идемпотентности key
+func (d *Database) IdempotencySave(ctx context.Context, key, userID string, response IdempotentResponse) error {
+	stmt := `update "idempotency_keys" set "status_code" = $1, "content_type" = $2, "response" = $3 where "key" = $4 and "user_id" = (select "id" from "users" where "login" = $5)`
+	_, err := d.db.Exec(ctx, stmt, response.StatusCode, response.ContentType, string(response.Body), key, userID)
+
+	return err
+}
+
+//	IdempotencyRelease - метод освобождает ключ идемпотентности key, если запрос не удалось выполнить,
+//	чтобы клиент мог повторить запрос с тем же ключом
+func (d *Database) IdempotencyRelease(ctx context.Context, key, userID string) error {
+	stmt := `delete from "idempotency_keys" where "key" = $1 and "status_code" = 0 and "user_id" = (select "id" from "users" where "login" = $2)`
+	_, err := d.db.Exec(ctx, stmt, key, userID)
+
+	return err
+}
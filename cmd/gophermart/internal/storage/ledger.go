@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+//	Журнал баллов (ledger) - единственный источник истины о движении баллов лояльности.
+//	Журнал ведётся по принципу двойной записи: каждая операция (tx_id) состоит из двух проводок -
+//	по счёту баллов пользователя (AccountUser) и по системному счёту-корреспонденту,
+//	сумма проводок одной операции всегда равна нулю. Записи журнала только добавляются и никогда не изменяются.
+//	Таблица balances - материализованный остаток по счетам пользователя, обновляется в той же транзакции,
+//	что и журнал, и пересчитывается из журнала после применения миграций, изменивших схему (см. MigrateUp и rebuildBalances).
+//	Резервы баллов (holds) в журнал не проводятся: они лишь переносят баллы из доступного остатка current в held.
+
+//	типы операций журнала баллов
+const (
+	LedgerAccrual    = "ACCRUAL"    //	начисление баллов за заказ
+	LedgerWithdrawal = "WITHDRAWAL" //	списание баллов в счёт оплаты заказа
+	LedgerReversal   = "REVERSAL"   //	сторнирование ранее проведённой операции
+	LedgerAdjustment = "ADJUSTMENT" //	ручная корректировка баланса
+)
+
+//	счета журнала баллов
+const (
+	AccountUser       = "USER"       //	счёт баллов пользователя
+	AccountAccrual    = "ACCRUAL"    //	системный счёт - источник начисленных баллов
+	AccountRedemption = "REDEMPTION" //	системный счёт - баллы, потраченные пользователем на оплату заказов
+)
+
+//	postLedger - функция проводит операцию по журналу баллов в рамках транзакции tx:
+//	amount зачисляется на счёт пользователя (отрицательное значение - списание), а с противоположным знаком - на счёт counterAccount;
+//	материализованный баланс пользователя обновляется в той же транзакции
+func postLedger(ctx context.Context, tx dbTx, userID, entryType, counterAccount, order string, amount Points) error {
+	txID := newSessionID() //	идентификатор операции, объединяющий обе проводки
+	createdAt := time.Now().UTC().Truncate(time.Second)
+
+	//	SQL-statement для вставки проводок в журнал
+	stmt := `insert into "ledger" ("entry_id", "tx_id", "user_id", "account", "entry_type", "amount", "order", "created_at")
+		values ($1, $2, (select "id" from "users" where "login" = $3), $4, $5, $6, $7, $8)`
+
+	//	проводка по счёту пользователя
+	if _, err := tx.Exec(ctx, stmt, newSessionID(), txID, userID, AccountUser, entryType, amount, order, createdAt); err != nil {
+		return err
+	}
+	//	встречная проводка по системному счёту
+	if _, err := tx.Exec(ctx, stmt, newSessionID(), txID, userID, counterAccount, entryType, -amount, order, createdAt); err != nil {
+		return err
+	}
+
+	//	сумма списанных баллов - это остаток системного счёта REDEMPTION в разрезе пользователя
+	var withdrawn Points
+	if counterAccount == AccountRedemption {
+		withdrawn = -amount
+	}
+
+	//	обновляем материализованный баланс пользователя
+	_, err := tx.Exec(ctx, `insert into "balances" ("user_id", "current", "withdrawn") values ((select "id" from "users" where "login" = $1), $2, $3)
+		on conflict ("user_id") do update set
+			"current" = round("balances"."current" + excluded."current", 2),
+			"withdrawn" = round("balances"."withdrawn" + excluded."withdrawn", 2)`, userID, amount, withdrawn)
+
+	return err
+}
+
+//	refreshBalances - метод пересчитывает материализованные балансы пользователей из журнала баллов под блокировкой миграций
+func (d *Database) refreshBalances() error {
+	return d.withMigrationLock(func(ctx context.Context, conn dbConn, _ map[int]time.Time) error {
+		return d.rebuildBalances(ctx, conn)
+	})
+}
+
+//	rebuildBalances - метод приводит материализованные балансы пользователей в соответствие с журналом баллов:
+//	переносит в журнал начисления и списания, проведённые до его появления, и пересчитывает остатки из журнала
+//	вызывается под блокировкой миграций, поэтому пересчёт выполняет один экземпляр сервера;
+//	таблица balances блокируется до конца пересчёта - операции других экземпляров ждут его завершения
+//	и затем применяют свои изменения к уже пересчитанным остаткам
+func (d *Database) rebuildBalances(ctx context.Context, conn dbConn) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	if d.driver == driverPostgres { //	в sqlite транзакции и так сериализуются (см. lockForUpdate)
+		if _, err := tx.Exec(ctx, `lock table "balances" in exclusive mode`); err != nil {
+			return err
+		}
+	}
+
+	stmts := []string{
+		//	проводки по начислениям за заказы, обработанные до появления журнала
+		`insert into "ledger" ("entry_id", "tx_id", "user_id", "account", "entry_type", "amount", "order", "created_at")
+			select 'backfill-accrual-user-' || "order", 'backfill-accrual-' || "order", "user_id", 'USER', 'ACCRUAL', "accrual", "order", "uploaded_at"
+			from "orders" where "status" = 'PROCESSED' and "accrual" <> 0 and not exists
+				(select 1 from "ledger" where "ledger"."order" = "orders"."order" and "ledger"."entry_type" = 'ACCRUAL' and "ledger"."account" = 'USER')`,
+		`insert into "ledger" ("entry_id", "tx_id", "user_id", "account", "entry_type", "amount", "order", "created_at")
+			select 'backfill-accrual-system-' || "order", 'backfill-accrual-' || "order", "user_id", 'ACCRUAL', 'ACCRUAL', -"accrual", "order", "uploaded_at"
+			from "orders" where "status" = 'PROCESSED' and "accrual" <> 0 and not exists
+				(select 1 from "ledger" where "ledger"."order" = "orders"."order" and "ledger"."entry_type" = 'ACCRUAL' and "ledger"."account" = 'ACCRUAL')`,
+		//	проводки по списаниям, выполненным до появления журнала
+		`insert into "ledger" ("entry_id", "tx_id", "user_id", "account", "entry_type", "amount", "order", "created_at")
+			select 'backfill-withdrawal-user-' || "order", 'backfill-withdrawal-' || "order", "user_id", 'USER', 'WITHDRAWAL', -"sum", "order", "processed_at"
+			from "withdrawals" where not exists
+				(select 1 from "ledger" where "ledger"."order" = "withdrawals"."order" and "ledger"."entry_type" = 'WITHDRAWAL' and "ledger"."account" = 'USER')`,
+		`insert into "ledger" ("entry_id", "tx_id", "user_id", "account", "entry_type", "amount", "order", "created_at")
+			select 'backfill-withdrawal-system-' || "order", 'backfill-withdrawal-' || "order", "user_id", 'REDEMPTION', 'WITHDRAWAL', "sum", "order", "processed_at"
+			from "withdrawals" where not exists
+				(select 1 from "ledger" where "ledger"."order" = "withdrawals"."order" and "ledger"."entry_type" = 'WITHDRAWAL' and "ledger"."account" = 'REDEMPTION')`,
+		//	у каждого пользователя должна быть строка баланса
+		`insert into "balances" ("user_id", "current", "withdrawn")
+			select "id", 0, 0 from "users" where not exists (select 1 from "balances" where "balances"."user_id" = "users"."id")`,
+		//	пересчитываем остатки по журналу; доступный остаток - это остаток по журналу за вычетом действующих резервов
+		`update "balances" set
+			"held" = round(coalesce((select sum("sum") from "holds" where "holds"."user_id" = "balances"."user_id" and "holds"."status" = 'HELD'), 0), 2),
+			"current" = round(coalesce((select sum("amount") from "ledger" where "ledger"."user_id" = "balances"."user_id" and "ledger"."account" = 'USER'), 0) -
+				coalesce((select sum("sum") from "holds" where "holds"."user_id" = "balances"."user_id" and "holds"."status" = 'HELD'), 0), 2),
+			"withdrawn" = round(coalesce((select sum("amount") from "ledger" where "ledger"."user_id" = "balances"."user_id" and "ledger"."account" = 'REDEMPTION'), 0), 2)`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
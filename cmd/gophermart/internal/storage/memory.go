@@ -0,0 +1,1060 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+//	errUserNotFound - ошибка возникающая при обращении от имени пользователя, которого нет в хранилище
+var errUserNotFound = errors.New("user is not found")
+
+//	MemoryStore - хранилище данных в оперативной памяти на основе map, не требующее базы данных и cgo
+//	реализует интерфейс Datasource с той же логикой, что и Database: журнал баллов, история статусов заказов,
+//	очередь синхронизации с сервером начислений; все данные защищены одним мьютексом
+//	при перезапуске сервера всё содержимое хранилища теряется - используется в тестах и для демонстрации
+type MemoryStore struct {
+	mu          sync.Mutex
+	users       map[string]*memoryUser        //	пользователи по login
+	sessions    map[string]*memorySession     //	сессии по идентификатору
+	tokens      map[string]string             //	идентификаторы сессий по hash секретного значения
+	orders      map[string]*memoryOrder       //	заказы по номеру
+	jobs        map[string]*memorySyncJob     //	задания синхронизации по номеру заказа
+	withdrawals map[string]string             //	владельцы списаний по номеру заказа
+	holds       map[string]*memoryHold        //	резервы баллов по идентификатору
+	heldOrders  map[string]string             //	идентификаторы действующих резервов по номеру заказа
+	ledger      []memoryLedgerEntry           //	журнал баллов
+	keys        map[memoryKey]*memoryResponse //	ключи идемпотентности
+	seq         int64                         //	счётчик, задающий порядок записей с одинаковой датой
+}
+
+//	memoryUser - пользователь и его материализованный баланс
+type memoryUser struct {
+	password    string     //	hash пароля
+	current     Points     //	доступный остаток баллов
+	held        Points     //	сумма зарезервированных баллов
+	withdrawn   Points     //	сумма списанных баллов
+	orders      []string   //	номера заказов пользователя в порядке загрузки
+	withdrawals []Withdraw //	списания пользователя в порядке их выполнения
+}
+
+//	memorySession - сессия пользователя
+type memorySession struct {
+	Session
+	userID    string //	владелец сессии
+	tokenHash string //	hash секретного значения сессии
+	seq       int64
+}
+
+//	memoryOrder - заказ пользователя с историей смены его статусов
+type memoryOrder struct {
+	Order
+	userID  string
+	history []OrderStatusChange
+}
+
+//	memorySyncJob - задание синхронизации заказа с сервером начислений
+type memorySyncJob struct {
+	status      string    //	syncJobPending или syncJobDead
+	attempts    int       //	количество выполненных опросов
+	failures    int       //	количество неудачных опросов подряд
+	lastError   string    //	ошибка последнего неудачного опроса
+	runAt       time.Time //	срок очередного опроса
+	leaseID     string    //	аренда задания обработчиком
+	lockedUntil time.Time //	срок аренды
+	seq         int64
+}
+
+//	memoryHold - резерв баллов пользователя
+type memoryHold struct {
+	Hold
+	userID string
+}
+
+//	memoryLedgerEntry - проводка журнала баллов
+type memoryLedgerEntry struct {
+	txID      string
+	userID    string
+	account   string
+	entryType string
+	amount    Points
+	order     string
+	createdAt time.Time
+}
+
+//	memoryKey - ключ идемпотентности пользователя
+type memoryKey struct {
+	userID string
+	key    string
+}
+
+//	memoryResponse - запрос и сохранённый ответ по ключу идемпотентности
+type memoryResponse struct {
+	IdempotentResponse
+	requestHash string
+	createdAt   time.Time
+	expiresAt   time.Time
+}
+
+//	NewMemoryStore - функция конструктор, инициализирующая пустое хранилище в оперативной памяти
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       make(map[string]*memoryUser),
+		sessions:    make(map[string]*memorySession),
+		tokens:      make(map[string]string),
+		orders:      make(map[string]*memoryOrder),
+		jobs:        make(map[string]*memorySyncJob),
+		withdrawals: make(map[string]string),
+		holds:       make(map[string]*memoryHold),
+		heldOrders:  make(map[string]string),
+		keys:        make(map[memoryKey]*memoryResponse),
+	}
+}
+
+//	truncatedNow - функция возвращает текущее время с точностью до секунды, как и в базе данных
+func truncatedNow() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+//	nextSeq - метод возвращает следующее значение счётчика порядка записей
+func (m *MemoryStore) nextSeq() int64 {
+	m.seq++
+	return m.seq
+}
+
+//	UserRegister - метод создания нового пользователя в системе лояльности и открытия ему первой сессии
+func (m *MemoryStore) UserRegister(ctx context.Context, userID, password string, meta SessionMeta) (token string, expiresAt time.Time, err error) {
+	if userID == "" || password == "" {
+		return "", time.Time{}, ErrEmptyNotAllowed
+	}
+	if err := ctx.Err(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	//	hash пароля вычисляется до блокировки хранилища - это самая долгая часть регистрации
+	hash, err := Hasher.Hash(password)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userID]; ok {
+		return "", time.Time{}, ErrUserAlreadyExist
+	}
+	m.users[userID] = &memoryUser{password: hash}
+
+	token, expiresAt = m.createSession(userID, meta)
+	return token, expiresAt, nil
+}
+
+//	UserAuthorise - метод авторизации пользователя, при успешной авторизации открывает пользователю новую сессию
+func (m *MemoryStore) UserAuthorise(ctx context.Context, userID, password string, meta SessionMeta) (token string, expiresAt time.Time, err error) {
+	if userID == "" || password == "" {
+		return "", time.Time{}, ErrEmptyNotAllowed
+	}
+	if err := ctx.Err(); err != nil {
+		return "", time.Time{}, err
+	}
+
+	m.mu.Lock()
+	user, ok := m.users[userID]
+	var passwordFromStore string
+	if ok {
+		passwordFromStore = user.password
+	}
+	m.mu.Unlock()
+	if !ok {
+		return "", time.Time{}, ErrLoginPasswordIsWrong
+	}
+
+	//	пароль проверяется без блокировки хранилища
+	ok, rehash, err := checkPassword(userID, password, passwordFromStore)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !ok {
+		return "", time.Time{}, ErrLoginPasswordIsWrong
+	}
+	var hash string
+	if rehash {
+		if hash, err = Hasher.Hash(password); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//	hash пересчитывается, только если пароль не успели сменить параллельно
+	if rehash && user.password == passwordFromStore {
+		user.password = hash
+	}
+	token, expiresAt = m.createSession(userID, meta)
+	return token, expiresAt, nil
+}
+
+//	createSession - метод открывает новую сессию пользователя, вызывается под блокировкой хранилища
+func (m *MemoryStore) createSession(userID string, meta SessionMeta) (token string, expiresAt time.Time) {
+	now := truncatedNow()
+	expiresAt = now.Add(SessionTTL)
+	token = newSessionID()
+
+	//	удаляем сессии с истёкшим сроком действия
+	for id, s := range m.sessions {
+		if s.ExpiresAt.Before(now) {
+			m.deleteSession(id)
+		}
+	}
+
+	s := &memorySession{
+		Session: Session{
+			ID:         newSessionID(),
+			CreatedAt:  now,
+			LastSeenAt: now,
+			ExpiresAt:  expiresAt,
+			UserAgent:  meta.UserAgent,
+			IP:         meta.IP,
+		},
+		userID:    userID,
+		tokenHash: tokenHash(token),
+		seq:       m.nextSeq(),
+	}
+	m.sessions[s.ID] = s
+	m.tokens[s.tokenHash] = s.ID
+
+	return token, expiresAt
+}
+
+//	deleteSession - метод удаляет сессию id, вызывается под блокировкой хранилища
+func (m *MemoryStore) deleteSession(id string) {
+	if s, ok := m.sessions[id]; ok {
+		delete(m.tokens, s.tokenHash)
+		delete(m.sessions, id)
+	}
+}
+
+//	sessionByToken - метод возвращает действующую сессию с секретным значением token и отмечает обращение к ней
+//	истёкшая сессия удаляется; вызывается под блокировкой хранилища
+func (m *MemoryStore) sessionByToken(token string) (*memorySession, error) {
+	if token == "" {
+		return nil, ErrSessionNotFound
+	}
+	s, ok := m.sessions[m.tokens[tokenHash(token)]]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	now := truncatedNow()
+	if !now.Before(s.ExpiresAt) {
+		m.deleteSession(s.ID)
+		return nil, ErrSessionNotFound
+	}
+	s.LastSeenAt = now
+
+	return s, nil
+}
+
+//	SessionUser - метод возвращает пользователя и идентификатор действующей сессии с секретным значением token
+func (m *MemoryStore) SessionUser(ctx context.Context, token string) (userID, sessionID string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.sessionByToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	return s.userID, s.ID, nil
+}
+
+//	SessionActive - метод проверяет, что сессия sessionID пользователя userID не закрыта и не истекла
+func (m *MemoryStore) SessionActive(ctx context.Context, userID, sessionID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[sessionID]
+	if !ok || s.userID != userID {
+		return ErrSessionNotFound
+	}
+	now := truncatedNow()
+	if !now.Before(s.ExpiresAt) {
+		m.deleteSession(s.ID)
+		return ErrSessionNotFound
+	}
+	s.LastSeenAt = now
+
+	return nil
+}
+
+//	RefreshSession - метод продлевает действующую сессию по её секретному значению token, выдавая ей новое секретное значение
+func (m *MemoryStore) RefreshSession(ctx context.Context, token string) (userID, sessionID, newToken string, expiresAt time.Time, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", "", time.Time{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, err := m.sessionByToken(token)
+	if err != nil {
+		return "", "", "", time.Time{}, err
+	}
+
+	newToken = newSessionID()
+	delete(m.tokens, s.tokenHash)
+	s.tokenHash = tokenHash(newToken)
+	s.ExpiresAt = s.LastSeenAt.Add(SessionTTL)
+	m.tokens[s.tokenHash] = s.ID
+
+	return s.userID, s.ID, newToken, s.ExpiresAt, nil
+}
+
+//	UserLogout - метод закрывает сессию sessionID пользователя userID
+func (m *MemoryStore) UserLogout(ctx context.Context, userID, sessionID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[sessionID]
+	if !ok || s.userID != userID {
+		return ErrSessionNotFound
+	}
+	m.deleteSession(sessionID)
+
+	return nil
+}
+
+//	GetSessions - метод возвращает список действующих сессий пользователя userID, сессия sessionID отмечается как текущая
+func (m *MemoryStore) GetSessions(ctx context.Context, userID, sessionID string) ([]Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	found := make([]*memorySession, 0)
+	for _, s := range m.sessions {
+		if s.userID == userID && !s.ExpiresAt.Before(now) {
+			found = append(found, s)
+		}
+	}
+	if len(found) == 0 { //	если действующих сессий нет
+		return nil, ErrNoDataToAnswer
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].seq < found[j].seq })
+
+	sessions := make([]Session, 0, len(found))
+	for _, s := range found {
+		session := s.Session
+		session.Current = s.ID == sessionID
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+//	DeleteSession - метод закрывает сессию id пользователя userID
+func (m *MemoryStore) DeleteSession(ctx context.Context, userID, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || s.userID != userID { //	закрыть можно только собственную сессию пользователя
+		return ErrNoDataToAnswer
+	}
+	m.deleteSession(id)
+
+	return nil
+}
+
+//	GetOrders - метод возвращает страницу списка заказов пользователя и курсор следующей страницы
+func (m *MemoryStore) GetOrders(ctx context.Context, userID string, filter OrdersFilter) ([]Order, string, error) {
+	cursor, hasCursor, err := filter.validate()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, "", ErrNoDataToAnswer
+	}
+
+	statuses := make(map[string]bool, len(filter.Statuses))
+	for _, status := range filter.Statuses {
+		statuses[status] = true
+	}
+	orders := make([]Order, 0, len(user.orders))
+	for _, number := range user.orders {
+		order := m.orders[number]
+		switch {
+		case len(statuses) > 0 && !statuses[order.Status],
+			!inPeriod(order.UploadedAt, filter.From, filter.To),
+			hasCursor && !cursor.after(order.UploadedAt, order.Number, filter.Desc):
+			continue
+		}
+		orders = append(orders, order.copyOrder())
+	}
+	if len(orders) == 0 { //	если заказов на начисление баллов не было
+		return nil, "", ErrNoDataToAnswer
+	}
+
+	//	порядок тот же, что и в базе данных: по дате загрузки и номеру заказа
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadedAt.Equal(orders[j].UploadedAt) {
+			return orders[i].UploadedAt.Before(orders[j].UploadedAt) != filter.Desc
+		}
+		return (orders[i].Number < orders[j].Number) != filter.Desc
+	})
+	orders, next := ordersPage(orders, filter.Limit)
+	return orders, next, nil
+}
+
+//	copyOrder - метод возвращает копию заказа, не разделяющую память с хранилищем
+func (o *memoryOrder) copyOrder() Order {
+	order := o.Order
+	if o.ProcessedAt != nil {
+		processedAt := *o.ProcessedAt
+		order.ProcessedAt = &processedAt
+	}
+	return order
+}
+
+//	GetOrder - метод возвращает заказ number пользователя userID вместе с историей смены его статусов
+func (m *MemoryStore) GetOrder(ctx context.Context, userID, number string) (OrderDetails, error) {
+	if err := ctx.Err(); err != nil {
+		return OrderDetails{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, ok := m.orders[number]
+	if !ok || order.userID != userID {
+		return OrderDetails{}, ErrNoDataToAnswer
+	}
+
+	details := OrderDetails{Order: order.copyOrder(), History: make([]OrderStatusChange, len(order.history))}
+	copy(details.History, order.history)
+
+	return details, nil
+}
+
+//	GetBalance - метод возвращает доступный остаток, сумму зарезервированных баллов и сумму всех списаний пользователя
+func (m *MemoryStore) GetBalance(ctx context.Context, userID string) (current, held, withdrawSum Points, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok { //	если движений по счёту не было - баланс нулевой
+		return 0, 0, 0, nil
+	}
+	return user.current, user.held, user.withdrawn, nil
+}
+
+//	GetWithdrawals - метод возвращает страницу списка списаний баллов со счёта пользователя и курсор следующей страницы
+func (m *MemoryStore) GetWithdrawals(ctx context.Context, userID string, params ListParams) ([]Withdraw, string, error) {
+	cursor, hasCursor, err := params.validate()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, "", ErrNoDataToAnswer
+	}
+
+	withdrawals := make([]Withdraw, 0, len(user.withdrawals))
+	for _, withdraw := range user.withdrawals {
+		if !inPeriod(withdraw.ProcessedAt, params.From, params.To) ||
+			(hasCursor && !cursor.after(withdraw.ProcessedAt, withdraw.Order, params.Desc)) {
+			continue
+		}
+		withdrawals = append(withdrawals, withdraw)
+	}
+	if len(withdrawals) == 0 { //	если списаний не было
+		return nil, "", ErrNoDataToAnswer
+	}
+
+	//	порядок тот же, что и в базе данных: по дате списания и номеру заказа
+	sort.Slice(withdrawals, func(i, j int) bool {
+		if !withdrawals[i].ProcessedAt.Equal(withdrawals[j].ProcessedAt) {
+			return withdrawals[i].ProcessedAt.Before(withdrawals[j].ProcessedAt) != params.Desc
+		}
+		return (withdrawals[i].Order < withdrawals[j].Order) != params.Desc
+	})
+	withdrawals, next := withdrawalsPage(withdrawals, params.Limit)
+	return withdrawals, next, nil
+}
+
+//	GetWithdrawalsSummary - метод возвращает количество, сумму списаний пользователя за период [from, to) и сумму возвратов по ним
+func (m *MemoryStore) GetWithdrawalsSummary(ctx context.Context, userID string, from, to time.Time) (WithdrawalsSummary, error) {
+	var summary WithdrawalsSummary
+	if err := (ListParams{From: from, To: to}).validatePeriod(); err != nil {
+		return summary, err
+	}
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		for _, withdraw := range user.withdrawals {
+			if inPeriod(withdraw.ProcessedAt, from, to) {
+				summary.Count++
+				summary.Sum += withdraw.Sum
+				summary.Refunded += withdraw.Refunded
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+//	inPeriod - функция проверяет, попадает ли дата at в период [from, to); нулевые from и to период не ограничивают
+func inPeriod(at, from, to time.Time) bool {
+	return (from.IsZero() || !at.Before(from)) && (to.IsZero() || at.Before(to))
+}
+
+//	OrderInsert - метод вносит новый заказ пользователя и ставит его в очередь синхронизации
+func (m *MemoryStore) OrderInsert(ctx context.Context, order string, userID string) error {
+	if order == "" || userID == "" {
+		return ErrEmptyNotAllowed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.orders[order]; ok {
+		if existing.userID == userID {
+			return ErrOrderExistToAccount //	если заказ уже привязан к аккаунту этого пользователя
+		}
+		return ErrOrderExistToAnother //	если заказ уже привязан к аккаунту другого пользователя
+	}
+	//	заказ, в счёт которого другой пользователь уже списал или зарезервировал баллы, тоже считается заказом другого пользователя
+	if owner, ok := m.withdrawals[order]; ok && owner != userID {
+		return ErrOrderExistToAnother
+	}
+	if id, ok := m.heldOrders[order]; ok && m.holds[id].userID != userID {
+		return ErrOrderExistToAnother
+	}
+	user, ok := m.users[userID]
+	if !ok {
+		return errUserNotFound
+	}
+
+	now := truncatedNow()
+	m.orders[order] = &memoryOrder{
+		Order:   Order{Number: order, Status: "NEW", UploadedAt: now, StatusChangedAt: now},
+		userID:  userID,
+		history: []OrderStatusChange{{Status: "NEW", ChangedAt: now}},
+	}
+	user.orders = append(user.orders, order)
+
+	//	заказ сразу ставится в очередь синхронизации - он опрашивается на ближайшем цикле
+	m.jobs[order] = &memorySyncJob{status: syncJobPending, runAt: now, seq: m.nextSeq()}
+
+	return nil
+}
+
+//	WithdrawRequest - метод списывает баллы пользователя в счёт оплаты заказа order
+//	проверка остатка и списание выполняются под блокировкой хранилища, поэтому баланс не может уйти в минус
+func (m *MemoryStore) WithdrawRequest(ctx context.Context, order string, sum Points, userID string) error {
+	if order == "" || sum == 0 || userID == "" {
+		return ErrEmptyNotAllowed
+	}
+	if sum < 0 { //	отрицательная сумма списания не допускается
+		return ErrInvalidPoints
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkWithdrawOrder(order, userID); err != nil {
+		return err
+	}
+	user, ok := m.users[userID]
+	if !ok || sum > user.current {
+		return ErrInsufficientFundsToAccount
+	}
+
+	m.withdrawals[order] = userID
+	user.withdrawals = append(user.withdrawals, Withdraw{Order: order, Sum: sum, Status: WithdrawalWithdrawn, ProcessedAt: truncatedNow()})
+	m.postLedger(userID, LedgerWithdrawal, AccountRedemption, order, -sum)
+
+	return nil
+}
+
+//	RefundWithdrawal - метод возвращает на счёт пользователя sum баллов, списанных в счёт заказа order;
+//	sum = nil - возврат всех ещё не возвращённых баллов, пустой userID - возврат от имени администратора
+func (m *MemoryStore) RefundWithdrawal(ctx context.Context, order string, sum *Points, userID string) (Withdraw, error) {
+	if order == "" {
+		return Withdraw{}, ErrEmptyNotAllowed
+	}
+	if sum != nil && *sum <= 0 { //	нулевая и отрицательная суммы возврата не допускаются
+		return Withdraw{}, ErrInvalidPoints
+	}
+	if err := ctx.Err(); err != nil {
+		return Withdraw{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	owner, ok := m.withdrawals[order]
+	if !ok || (userID != "" && owner != userID) { //	чужое и несуществующее списание неотличимы
+		return Withdraw{}, ErrNoDataToAnswer
+	}
+	user := m.users[owner]
+	var withdraw *Withdraw
+	for i := range user.withdrawals {
+		if user.withdrawals[i].Order == order {
+			withdraw = &user.withdrawals[i]
+		}
+	}
+
+	rest := withdraw.Sum - withdraw.Refunded
+	if rest <= 0 {
+		return Withdraw{}, ErrWithdrawalRefunded
+	}
+	refund := rest
+	if sum != nil {
+		refund = *sum
+	}
+	if refund > rest {
+		return Withdraw{}, ErrRefundExceedsWithdrawal
+	}
+	withdraw.Refunded += refund
+	withdraw.Status = withdrawalStatus(withdraw.Sum, withdraw.Refunded)
+	m.postLedger(owner, LedgerReversal, AccountRedemption, order, refund)
+
+	return *withdraw, nil
+}
+
+//	checkWithdrawOrder - метод проверяет, можно ли списать или зарезервировать баллы пользователя userID в счёт заказа order
+//	вызывается под блокировкой хранилища
+func (m *MemoryStore) checkWithdrawOrder(order, userID string) error {
+	if _, ok := m.withdrawals[order]; ok { //	в счёт одного заказа баллы списываются только один раз
+		return ErrWithdrawalExist
+	}
+	if _, ok := m.heldOrders[order]; ok { //	и резервируются только один раз
+		return ErrHoldExist
+	}
+	if accrual, ok := m.orders[order]; ok && accrual.userID != userID { //	и не в счёт заказа другого пользователя
+		return ErrOrderExistToAnother
+	}
+	return nil
+}
+
+//	HoldRequest - метод резервирует sum баллов пользователя в счёт оплаты заказа order на срок ttl
+//	проверки те же, что и у WithdrawRequest
+func (m *MemoryStore) HoldRequest(ctx context.Context, order string, sum Points, userID string, ttl time.Duration) (Hold, error) {
+	if order == "" || sum == 0 || userID == "" {
+		return Hold{}, ErrEmptyNotAllowed
+	}
+	if sum < 0 { //	отрицательная сумма резерва не допускается
+		return Hold{}, ErrInvalidPoints
+	}
+	if ttl <= 0 {
+		ttl = DefaultHoldTTL
+	}
+	if err := ctx.Err(); err != nil {
+		return Hold{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkWithdrawOrder(order, userID); err != nil {
+		return Hold{}, err
+	}
+	user, ok := m.users[userID]
+	if !ok || sum > user.current {
+		return Hold{}, ErrInsufficientFundsToAccount
+	}
+
+	now := truncatedNow()
+	hold := &memoryHold{Hold: Hold{ID: newSessionID(), Order: order, Sum: sum, Status: HoldHeld, CreatedAt: now, ExpiresAt: now.Add(ttl)}, userID: userID}
+	m.holds[hold.ID] = hold
+	m.heldOrders[order] = hold.ID
+	user.current -= sum
+	user.held += sum
+
+	return hold.Hold, nil
+}
+
+//	HoldCapture - метод списывает резерв id пользователя userID в счёт оплаты заказа, для которого он оформлен
+//	резерв с истёкшим сроком не списывается, а возвращается в доступный остаток
+func (m *MemoryStore) HoldCapture(ctx context.Context, id, userID string) (Hold, error) {
+	if err := ctx.Err(); err != nil {
+		return Hold{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hold, err := m.activeHold(id, userID)
+	if err != nil {
+		return Hold{}, err
+	}
+	now := truncatedNow()
+	if !hold.ExpiresAt.After(now) { //	срок резерва истёк - возвращаем его в доступный остаток
+		m.closeHold(hold, HoldExpired, now)
+		return Hold{}, ErrHoldExpired
+	}
+	if _, ok := m.withdrawals[hold.Order]; ok {
+		return Hold{}, ErrWithdrawalExist
+	}
+
+	//	закрываем резерв и проводим списание так же, как WithdrawRequest
+	m.closeHold(hold, HoldCaptured, now)
+	m.withdrawals[hold.Order] = userID
+	user := m.users[userID]
+	user.withdrawals = append(user.withdrawals, Withdraw{Order: hold.Order, Sum: hold.Sum, Status: WithdrawalWithdrawn, ProcessedAt: now})
+	m.postLedger(userID, LedgerWithdrawal, AccountRedemption, hold.Order, -hold.Sum)
+
+	return hold.copyHold(), nil
+}
+
+//	HoldRelease - метод возвращает резерв id пользователя userID в доступный остаток
+func (m *MemoryStore) HoldRelease(ctx context.Context, id, userID string) (Hold, error) {
+	if err := ctx.Err(); err != nil {
+		return Hold{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hold, err := m.activeHold(id, userID)
+	if err != nil {
+		return Hold{}, err
+	}
+	m.closeHold(hold, HoldReleased, truncatedNow())
+
+	return hold.copyHold(), nil
+}
+
+//	ReleaseExpiredHolds - метод возвращает в доступный остаток все резервы с истёкшим сроком и возвращает их количество
+func (m *MemoryStore) ReleaseExpiredHolds(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := truncatedNow()
+	released := 0
+	for _, id := range m.heldOrders {
+		if hold := m.holds[id]; !hold.ExpiresAt.After(now) {
+			m.closeHold(hold, HoldExpired, now)
+			released++
+		}
+	}
+	return released, nil
+}
+
+//	activeHold - метод возвращает действующий резерв id пользователя userID
+//	вызывается под блокировкой хранилища
+func (m *MemoryStore) activeHold(id, userID string) (*memoryHold, error) {
+	hold, ok := m.holds[id]
+	if !ok || hold.userID != userID { //	чужой и несуществующий резерв неотличимы
+		return nil, ErrNoDataToAnswer
+	}
+	if hold.Status != HoldHeld {
+		return nil, ErrHoldClosed
+	}
+	return hold, nil
+}
+
+//	closeHold - метод закрывает резерв в статусе status и возвращает его сумму в доступный остаток владельца
+//	вызывается под блокировкой хранилища
+func (m *MemoryStore) closeHold(hold *memoryHold, status string, closedAt time.Time) {
+	hold.Status = status
+	hold.ClosedAt = &closedAt
+	delete(m.heldOrders, hold.Order)
+	user := m.users[hold.userID]
+	user.held -= hold.Sum
+	user.current += hold.Sum
+}
+
+//	copyHold - метод возвращает копию резерва, не связанную с хранилищем
+func (h *memoryHold) copyHold() Hold {
+	hold := h.Hold
+	if h.ClosedAt != nil {
+		closedAt := *h.ClosedAt
+		hold.ClosedAt = &closedAt
+	}
+	return hold
+}
+
+//	postLedger - метод проводит операцию по журналу баллов и обновляет баланс пользователя, как и функция postLedger для базы данных
+//	вызывается под блокировкой хранилища
+func (m *MemoryStore) postLedger(userID, entryType, counterAccount, order string, amount Points) {
+	txID := newSessionID()
+	createdAt := truncatedNow()
+	m.ledger = append(m.ledger,
+		memoryLedgerEntry{txID: txID, userID: userID, account: AccountUser, entryType: entryType, amount: amount, order: order, createdAt: createdAt},
+		memoryLedgerEntry{txID: txID, userID: userID, account: counterAccount, entryType: entryType, amount: -amount, order: order, createdAt: createdAt})
+
+	user := m.users[userID]
+	user.current += amount
+	if counterAccount == AccountRedemption {
+		user.withdrawn -= amount
+	}
+}
+
+//	IdempotencyReserve - метод резервирует ключ идемпотентности key для пользователя перед выполнением запроса
+//	поведение совпадает с Database.IdempotencyReserve
+func (m *MemoryStore) IdempotencyReserve(ctx context.Context, key, requestHash, userID string, ttl time.Duration) (*IdempotentResponse, error) {
+	if key == "" || requestHash == "" || userID == "" {
+		return nil, ErrEmptyNotAllowed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := truncatedNow()
+	//	удаляем ключи с истёкшим сроком хранения и брошенные резервы запросов, не завершённых за IdempotencyLockTTL
+	for k, r := range m.keys {
+		if r.expiresAt.Before(now) || (r.StatusCode == 0 && !r.createdAt.After(now.Add(-IdempotencyLockTTL))) {
+			delete(m.keys, k)
+		}
+	}
+
+	k := memoryKey{userID: userID, key: key}
+	stored, ok := m.keys[k]
+	if !ok { //	ключ свободен и теперь зарезервирован за этим запросом: код статуса 0 означает, что запрос ещё выполняется
+		m.keys[k] = &memoryResponse{requestHash: requestHash, createdAt: now, expiresAt: now.Add(ttl)}
+		return nil, nil
+	}
+
+	if stored.requestHash != requestHash { //	ключ использован с другим содержимым запроса
+		return nil, ErrIdempotencyKeyReused
+	}
+	if stored.StatusCode == 0 { //	запрос с этим ключом ещё выполняется
+		return nil, ErrIdempotencyInProgress
+	}
+	response := stored.IdempotentResponse
+	response.Body = append([]byte(nil), stored.Body...)
+
+	return &response, nil
+}
+
+//	IdempotencySave - метод сохраняет ответ на запрос, выполненный с ключом идемпотентности key
+func (m *MemoryStore) IdempotencySave(ctx context.Context, key, userID string, response IdempotentResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.keys[memoryKey{userID: userID, key: key}]; ok {
+		stored.IdempotentResponse = response
+		stored.Body = append([]byte(nil), response.Body...)
+	}
+
+	return nil
+}
+
+//	IdempotencyRelease - метод освобождает ключ идемпотентности key, если запрос не удалось выполнить
+func (m *MemoryStore) IdempotencyRelease(ctx context.Context, key, userID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := memoryKey{userID: userID, key: key}
+	if stored, ok := m.keys[k]; ok && stored.StatusCode == 0 {
+		delete(m.keys, k)
+	}
+
+	return nil
+}
+
+//	Close - метод закрытия хранилища - в памяти закрывать нечего
+func (m *MemoryStore) Close() {}
+
+//	UpdateOrdersStatus - метод синхронизации статусов заказов и начисленных баллов с внешним сервисом расчёта бонусных баллов
+//	очередь заданий и правила их обработки совпадают с Database.UpdateOrdersStatus
+func (m *MemoryStore) UpdateOrdersStatus(ctx context.Context) error {
+	if ctx.Err() != nil { //	сервер останавливается - новые задания не арендуем
+		return nil
+	}
+
+	leaseID, orders := m.leaseSyncJobs(truncatedNow())
+	if len(orders) == 0 {
+		return nil
+	}
+
+	claim := func(i int) bool {
+		err := m.renewSyncJob(leaseID, orders[i].Number, truncatedNow())
+		if err != nil {
+			log.Println("sync job for order", orders[i].Number, "is not polled:", err.Error())
+		}
+		return err == nil
+	}
+	syncOrders(ctx, orders, claim, func(i int, syncErr error) {
+		if syncErr != nil {
+			log.Println(syncErr.Error()) //	если при опросе произошла ошибка, то заносим её в журнал
+		}
+		if err := m.ackSyncJob(leaseID, orders[i], syncErr, truncatedNow()); err != nil {
+			log.Println("sync job for order", orders[i].Number, "is not saved:", err.Error())
+		}
+	})
+
+	//	задания, которые не успели опросить до остановки, освобождаем
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, job := range m.jobs {
+		if job.leaseID == leaseID {
+			job.leaseID, job.lockedUntil = "", time.Time{}
+		}
+	}
+
+	return nil
+}
+
+//	leaseSyncJobs - метод арендует не более syncBatchSize заданий, срок опроса которых наступил, на срок SyncLeaseTTL
+//	и возвращает заказы этих заданий в порядке сроков их опроса
+func (m *MemoryStore) leaseSyncJobs(now time.Time) (leaseID string, orders []Order) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	type due struct {
+		order string
+		job   *memorySyncJob
+	}
+	found := make([]due, 0)
+	for order, job := range m.jobs {
+		if job.status == syncJobPending && !job.runAt.After(now) && (job.leaseID == "" || !job.lockedUntil.After(now)) {
+			found = append(found, due{order, job})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].job.runAt.Equal(found[j].job.runAt) {
+			return found[i].job.runAt.Before(found[j].job.runAt)
+		}
+		return found[i].job.seq < found[j].job.seq
+	})
+	if size := syncBatchSize(now); len(found) > size {
+		found = found[:size]
+	}
+
+	leaseID = newSessionID()
+	for _, d := range found {
+		d.job.leaseID, d.job.lockedUntil = leaseID, now.Add(SyncLeaseTTL)
+		orders = append(orders, Order{Number: d.order, Status: m.orders[d.order].Status})
+	}
+
+	return leaseID, orders
+}
+
+//	renewSyncJob - метод продлевает аренду задания по заказу order перед его опросом, как и Database.renewSyncJob
+func (m *MemoryStore) renewSyncJob(leaseID, order string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[order]
+	if !ok || job.leaseID != leaseID {
+		return errSyncLeaseLost
+	}
+	job.lockedUntil = now.Add(SyncLeaseTTL)
+	return nil
+}
+
+//	ackSyncJob - метод сохраняет результат опроса заказа order по заданию, арендованному под leaseID
+//	правила переноса, перевода в статус DEAD и удаления задания совпадают с Database.ackSyncJob
+func (m *MemoryStore) ackSyncJob(leaseID string, order Order, syncErr error, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job, ok := m.jobs[order.Number]
+	if !ok || job.leaseID != leaseID {
+		return errSyncLeaseLost
+	}
+	job.leaseID, job.lockedUntil = "", time.Time{}
+
+	if errors.Is(syncErr, ErrAccrualUnavailable) { //	сервер начислений недоступен - ошибка не засчитывается заказу
+		job.attempts++
+		job.lastError = syncErr.Error()
+		job.runAt = now.Add(syncBackoff(job.attempts))
+		return nil
+	}
+	if syncErr != nil {
+		job.failures++
+		job.lastError = syncErr.Error()
+		job.runAt = now.Add(syncBackoff(job.failures))
+		if job.failures >= SyncMaxFailures {
+			job.status = syncJobDead
+			log.Println("sync job for order", order.Number, "is dead after", job.failures, "failures:", syncErr.Error())
+		}
+		return nil
+	}
+
+	stored := m.orders[order.Number]
+	if order.Status != "PROCESSED" && order.Status != "INVALID" {
+		//	расчёт по заказу ещё не завершён - переносим задание на следующий опрос
+		job.attempts++
+		job.failures, job.lastError = 0, ""
+		job.runAt = now.Add(syncBackoff(job.attempts))
+		if stored.Status != "PROCESSED" {
+			stored.setStatus(order.Status, now)
+		}
+		return nil
+	}
+
+	//	заказ перешёл в финальный статус - задание выполнено и удаляется из очереди
+	delete(m.jobs, order.Number)
+	if stored.Status == "PROCESSED" { //	начисление по заказу в статусе PROCESSED проводится ровно один раз
+		return nil
+	}
+	stored.setStatus(order.Status, now)
+	processedAt := now
+	stored.ProcessedAt = &processedAt
+	stored.Accrual = order.Accrual
+
+	if order.Status == "PROCESSED" && order.Accrual != 0 {
+		m.postLedger(stored.userID, LedgerAccrual, AccountAccrual, order.Number, order.Accrual)
+	}
+
+	return nil
+}
+
+//	setStatus - метод переводит заказ в статус status и записывает переход в историю, если статус изменился
+func (o *memoryOrder) setStatus(status string, changedAt time.Time) {
+	if o.Status == status {
+		return
+	}
+	o.Status, o.StatusChangedAt = status, changedAt
+	o.history = append(o.history, OrderStatusChange{Status: status, ChangedAt: changedAt})
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//	migrationFiles - SQL-файлы миграций схемы базы данных, отдельно для PostgreSQL и sqlite
+//	имя файла: <версия>_<название>.up.sql - применение миграции, <версия>_<название>.down.sql - её откат
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+//	migrationName - формат имени файла миграции
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+//	migrationLockID - ключ advisory lock PostgreSQL, под которым миграции выполняются одним экземпляром сервера
+const migrationLockID = 4250307
+
+//	Migration - миграция схемы базы данных
+type Migration struct {
+	Version int    //	версия схемы, к которой приводит миграция; миграции применяются по возрастанию версий
+	Name    string //	название миграции
+	up      string //	SQL применения миграции
+	down    string //	SQL отката миграции
+}
+
+//	MigrationStatus - состояние миграции в базе данных
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time //	дата применения миграции, nil - миграция ещё не применена
+}
+
+//	migrationsDir - метод возвращает каталог миграций для драйвера базы данных
+func (d *Database) migrationsDir() string {
+	if d.driver == driverPostgres {
+		return "migrations/postgres"
+	}
+	return "migrations/sqlite"
+}
+
+//	loadMigrations - функция считывает миграции из каталога dir в порядке возрастания версий
+//	у каждой миграции должны быть и применение, и откат, версии не должны повторяться
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file %s: name must be <version>_<name>.up.sql or <version>_<name>.down.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		body, err := fs.ReadFile(migrationFiles, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+//	withMigrationLock - метод выполняет fn на отдельном соединении с базой данных под блокировкой миграций:
+//	в PostgreSQL - под advisory lock, поэтому экземпляры сервера, запущенные одновременно, применяют миграции по очереди;
+//	база sqlite обслуживает единственный экземпляр сервера, и дополнительная блокировка не требуется
+//	таблица schema_migrations с версиями применённых миграций создаётся при первом вызове
+func (d *Database) withMigrationLock(fn func(ctx context.Context, conn dbConn, applied map[int]time.Time) error) error {
+	ctx := context.Background()
+	conn, err := d.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if d.driver == driverPostgres {
+		if _, err := conn.Exec(ctx, `select pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+		defer conn.Exec(ctx, `select pg_advisory_unlock($1)`, migrationLockID)
+	}
+
+	stmt := `create table if not exists "schema_migrations" (
+					"version" INTEGER constraint schema_migrations_pk primary key not null,
+					"name" TEXT not null,
+					"applied_at" ` + d.timestampType() + ` not null)`
+	if _, err := conn.Exec(ctx, stmt); err != nil {
+		return err
+	}
+
+	//	считываем версии применённых миграций - уже под блокировкой, поэтому другой экземпляр их не изменит
+	rows, err := conn.Query(ctx, `select "version", "applied_at" from "schema_migrations"`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close() //	освобождаем соединение до выполнения миграций
+
+	return fn(ctx, conn, applied)
+}
+
+//	runMigration - функция выполняет SQL миграции и фиксирует её в schema_migrations в одной транзакции
+func runMigration(ctx context.Context, conn dbConn, stmt string, record string, args ...interface{}) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	//	SQL миграции без параметров pgx выполняет простым протоколом - поэтому в одной миграции может быть несколько запросов
+	if _, err := tx.Exec(ctx, stmt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+//	MigrateUp - метод применяет к базе данных все ещё не применённые миграции и возвращает их список
+//	если хотя бы одна миграция применена, балансы пользователей пересчитываются из журнала баллов (см. rebuildBalances)
+func (d *Database) MigrateUp() ([]Migration, error) {
+	migrations, err := loadMigrations(d.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	done := make([]Migration, 0)
+	err = d.withMigrationLock(func(ctx context.Context, conn dbConn, applied map[int]time.Time) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			record := `insert into "schema_migrations" ("version", "name", "applied_at") values ($1, $2, $3)`
+			if err := runMigration(ctx, conn, m.up, record, m.Version, m.Name, time.Now().UTC().Truncate(time.Second)); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		if len(done) == 0 { //	схема не менялась - балансы соответствуют журналу баллов
+			return nil
+		}
+		//	миграции могли перенести данные - приводим балансы в соответствие с журналом под той же блокировкой
+		if err := d.rebuildBalances(ctx, conn); err != nil {
+			return fmt.Errorf("rebuild balances: %w", err)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//	MigrateDown - метод откатывает steps последних применённых миграций и возвращает их список
+func (d *Database) MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := loadMigrations(d.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	done := make([]Migration, 0)
+	err = d.withMigrationLock(func(ctx context.Context, conn dbConn, applied map[int]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			record := `delete from "schema_migrations" where "version" = $1`
+			if err := runMigration(ctx, conn, m.down, record, m.Version); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//	MigrationStatus - метод возвращает состояние всех миграций в порядке возрастания версий
+func (d *Database) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(d.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]MigrationStatus, 0, len(migrations))
+	err = d.withMigrationLock(func(ctx context.Context, conn dbConn, applied map[int]time.Time) error {
+		for _, m := range migrations {
+			s := MigrationStatus{Migration: m}
+			if appliedAt, ok := applied[m.Version]; ok {
+				s.AppliedAt = &appliedAt
+			}
+			status = append(status, s)
+		}
+		return nil
+	})
+	return status, err
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	postgres, err := loadMigrations("migrations/postgres")
+	require.NoError(t, err)
+	sqlite, err := loadMigrations("migrations/sqlite")
+	require.NoError(t, err)
+
+	//	миграции для PostgreSQL и sqlite совпадают по версиям и названиям и идут по возрастанию версий
+	require.Equal(t, len(postgres), len(sqlite))
+	for i := range postgres {
+		assert.Equal(t, postgres[i].Version, sqlite[i].Version)
+		assert.Equal(t, postgres[i].Name, sqlite[i].Name)
+		if i > 0 {
+			assert.Greater(t, postgres[i].Version, postgres[i-1].Version)
+		}
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	ctx := context.Background()
+	d, err := OpenDatabase("")
+	require.NoError(t, err)
+	defer d.Close()
+
+	tableExists := func(table string) bool {
+		var n int
+		require.NoError(t, d.db.QueryRow(ctx, `select count(*) from sqlite_master where "type" = 'table' and "name" = $1`, table).Scan(&n))
+		return n > 0
+	}
+
+	//	миграции применяются по порядку, повторное применение ничего не меняет
+	done, err := d.MigrateUp()
+	require.NoError(t, err)
+	require.NotEmpty(t, done)
+	last := done[len(done)-1]
+
+	again, err := d.MigrateUp()
+	require.NoError(t, err)
+	assert.Empty(t, again)
+
+	status, err := d.MigrationStatus()
+	require.NoError(t, err)
+	require.Len(t, status, len(done))
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt, s.Name)
+	}
+
+	//	откат последней миграции отмечает её неприменённой, остальные остаются применёнными
+	reverted, err := d.MigrateDown(1)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1)
+	assert.Equal(t, last.Version, reverted[0].Version)
+	assert.True(t, tableExists("orders"))
+
+	status, err = d.MigrationStatus()
+	require.NoError(t, err)
+	assert.Nil(t, status[len(status)-1].AppliedAt)
+	assert.NotNil(t, status[0].AppliedAt)
+
+	//	после повторного применения схема снова рабочая
+	done, err = d.MigrateUp()
+	require.NoError(t, err)
+	require.Len(t, done, 1)
+	assert.Equal(t, last.Version, done[0].Version)
+
+	//	откат всех миграций удаляет все таблицы
+	reverted, err = d.MigrateDown(len(status) + 1)
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(status))
+	for _, table := range []string{"users", "sessions", "orders", "withdrawals", "ledger", "balances", "order_status_history", "idempotency_keys", "sync_jobs"} {
+		assert.False(t, tableExists(table), table)
+	}
+}
+
+func TestMigrateNormalizeSchema(t *testing.T) {
+	ctx := context.Background()
+	d, err := OpenDatabase("")
+	require.NoError(t, err)
+	defer d.Close()
+
+	//	приводим схему к версии 5, в которой пользователь определяется по login
+	_, err = d.MigrateUp()
+	require.NoError(t, err)
+	status, err := d.MigrationStatus()
+	require.NoError(t, err)
+	steps := 0
+	for _, s := range status {
+		if s.Version > 5 {
+			steps++
+		}
+	}
+	_, err = d.MigrateDown(steps)
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, stmt := range []string{
+		`insert into "users" ("userid", "password") values ('test1', 'hash')`,
+		`insert into "orders" ("order", "status", "accrual", "uploaded_at", "status_changed_at", "processed_at", "userid")
+			values ('12345678903', 'PROCESSED', 100, $1, $1, $1, 'test1')`,
+		`insert into "withdrawals" ("order", "sum", "processed_at", "userid") values ('2377225624', 40, '2022-05-01T10:00:00Z', 'test1')`,
+		//	строки пользователя, которого нет в "users"
+		`insert into "orders" ("order", "status", "accrual", "uploaded_at", "status_changed_at", "userid") values ('79927398713', 'NEW', 0, $1, $1, 'ghost')`,
+		`insert into "order_status_history" ("entry_id", "order", "status", "changed_at", "seq") values ('ghost-1', '79927398713', 'NEW', $1, 1)`,
+		`insert into "sync_jobs" ("order", "status", "run_at", "created_at") values ('79927398713', 'PENDING', $1, $1)`,
+		`insert into "withdrawals" ("order", "sum", "processed_at", "userid") values ('4561261212345467', 10, $1, 'ghost')`,
+		`insert into "ledger" ("entry_id", "tx_id", "userid", "account", "entry_type", "amount", "order", "created_at") values ('ghost-1', 'ghost-1', 'ghost', 'USER', 'ADJUSTMENT', 10, '', $1)`,
+	} {
+		_, err := d.db.Exec(ctx, stmt, now)
+		require.NoError(t, err)
+	}
+
+	//	данные переносятся в нормализованную схему, балансы пересчитываются из журнала, и всё читается методами хранилища
+	_, err = d.MigrateUp()
+	require.NoError(t, err)
+
+	//	строки несуществующего пользователя удалены
+	for _, table := range []string{"orders", "order_status_history", "sync_jobs", "withdrawals", "ledger"} {
+		var n int
+		require.NoError(t, d.db.QueryRow(ctx, `select count(*) from "`+table+`" where "order" in ('79927398713', '4561261212345467') or "order" = ''`).Scan(&n))
+		assert.Zero(t, n, table)
+	}
+
+	orders, _, err := d.GetOrders(ctx, "test1", OrdersFilter{})
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "12345678903", orders[0].Number)
+	assert.True(t, now.Equal(orders[0].UploadedAt))
+
+	current, _, withdrawn, err := d.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(60*PointsScale), current)
+	assert.Equal(t, Points(40*PointsScale), withdrawn)
+
+	//	без новых миграций балансы при запуске не пересчитываются
+	_, err = d.db.Exec(ctx, `update "balances" set "current" = 0`)
+	require.NoError(t, err)
+	done, err := d.MigrateUp()
+	require.NoError(t, err)
+	assert.Empty(t, done)
+	current, _, _, err = d.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(0), current)
+	require.NoError(t, d.refreshBalances())
+
+	//	при пересчёте балансов действующие резервы вычитаются из доступного остатка
+	_, err = d.HoldRequest(ctx, "79927398713", Points(10*PointsScale), "test1", time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, d.refreshBalances())
+	current, held, _, err := d.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(50*PointsScale), current)
+	assert.Equal(t, Points(10*PointsScale), held)
+
+	withdrawals, _, err := d.GetWithdrawals(ctx, "test1", ListParams{})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.True(t, time.Date(2022, 5, 1, 10, 0, 0, 0, time.UTC).Equal(withdrawals[0].ProcessedAt))
+
+	//	внешние ключи и ограничения на статусы проверяются базой данных
+	_, err = d.db.Exec(ctx, `insert into "orders" ("order", "status", "accrual", "uploaded_at", "status_changed_at", "user_id") values ('1', 'NEW', 0, $1, $1, 999)`, now)
+	assert.Error(t, err)
+	_, err = d.db.Exec(ctx, `update "orders" set "status" = 'UNKNOWN' where "order" = '12345678903'`)
+	assert.Error(t, err)
+
+	//	откат возвращает ссылки на пользователя по login
+	_, err = d.MigrateDown(steps)
+	require.NoError(t, err)
+	var userID string
+	require.NoError(t, d.db.QueryRow(ctx, `select "userid" from "orders" where "order" = '12345678903'`).Scan(&userID))
+	assert.Equal(t, "test1", userID)
+}
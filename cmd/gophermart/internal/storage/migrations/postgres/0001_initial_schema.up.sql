@@ -0,0 +1,54 @@
+-- пользователи, сессии, заказы и списания баллов
+-- миграция применима и к базе, созданной версиями сервера без миграций, - поэтому все изменения условные
+
+create table if not exists "users" (
+	"userid" TEXT constraint userid_pk primary key not null,
+	"password" TEXT not null);
+
+-- сессии пользователей хранятся в отдельной таблице sessions - удаляем устаревший столбец с единственной сессией
+alter table "users" drop column if exists "session_id";
+
+-- секретное значение сессии из cookie в базе не хранится - только его hash
+create table if not exists "sessions" (
+	"session_id" TEXT constraint sessions_pk primary key not null,
+	"token_hash" TEXT constraint token_hash_uniq unique not null,
+	"userid" TEXT not null,
+	"created_at" TEXT not null,
+	"last_seen_at" TEXT not null,
+	"expires_at" TEXT not null,
+	"user_agent" TEXT not null,
+	"ip" TEXT not null);
+
+create index if not exists sessions_userid_idx on "sessions" ("userid");
+
+-- uploaded_at - дата загрузки заказа, status_changed_at - дата последней смены статуса,
+-- processed_at - дата перехода в финальный статус PROCESSED или INVALID
+create table if not exists "orders" (
+	"order" TEXT constraint orders_pk primary key not null,
+	"status" TEXT not null,
+	"accrual" NUMERIC(18, 2) not null,
+	"uploaded_at" TIMESTAMPTZ not null,
+	"userid" TEXT not null,
+	"status_changed_at" TIMESTAMPTZ not null,
+	"processed_at" TIMESTAMPTZ);
+
+-- в ранее созданной таблице заказов дата загрузки хранилась текстом - переводим её на тип даты и времени
+do $$
+begin
+	if exists (select 1 from information_schema.columns where "table_schema" = current_schema()
+		and "table_name" = 'orders' and "column_name" = 'uploaded_at' and "data_type" = 'text') then
+		alter table "orders" alter column "uploaded_at" type timestamptz using "uploaded_at"::timestamptz;
+	end if;
+end $$;
+
+-- дата последней смены статуса ранее загруженных заказов неизвестна - считаем ей дату загрузки
+alter table "orders" add column if not exists "status_changed_at" TIMESTAMPTZ;
+alter table "orders" add column if not exists "processed_at" TIMESTAMPTZ;
+update "orders" set "status_changed_at" = "uploaded_at" where "status_changed_at" is null;
+alter table "orders" alter column "status_changed_at" set not null;
+
+create table if not exists "withdrawals" (
+	"order" TEXT constraint withdrawals_pk primary key not null,
+	"sum" NUMERIC(18, 2) not null,
+	"processed_at" TEXT not null,
+	"userid" TEXT not null);
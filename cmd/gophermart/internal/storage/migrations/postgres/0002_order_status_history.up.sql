@@ -0,0 +1,22 @@
+-- история смены статусов заказов; seq задаёт хронологию переходов, совершённых в пределах одной секунды
+create table if not exists "order_status_history" (
+	"entry_id" TEXT constraint order_status_history_pk primary key not null,
+	"order" TEXT not null,
+	"status" TEXT not null,
+	"changed_at" TIMESTAMPTZ not null,
+	"seq" INTEGER not null);
+
+do $$
+begin
+	if exists (select 1 from information_schema.columns where "table_schema" = current_schema()
+		and "table_name" = 'order_status_history' and "column_name" = 'changed_at' and "data_type" = 'text') then
+		alter table "order_status_history" alter column "changed_at" type timestamptz using "changed_at"::timestamptz;
+	end if;
+end $$;
+
+create unique index if not exists order_status_history_order_idx on "order_status_history" ("order", "seq");
+
+-- для заказов, загруженных до ведения истории, история начинается с их текущего статуса на дату загрузки
+insert into "order_status_history" ("entry_id", "order", "status", "changed_at", "seq")
+	select 'legacy-' || "order", "order", "status", "uploaded_at", 1 from "orders"
+	where not exists (select 1 from "order_status_history" h where h."order" = "orders"."order");
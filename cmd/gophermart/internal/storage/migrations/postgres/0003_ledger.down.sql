@@ -0,0 +1,2 @@
+drop table if exists "balances";
+drop table if exists "ledger";
@@ -0,0 +1,60 @@
+-- возврат к ссылкам на пользователя по login и датам в текстовых столбцах
+
+alter table "idempotency_keys" add column "userid" TEXT;
+update "idempotency_keys" k set "userid" = u."login" from "users" u where u."id" = k."user_id";
+alter table "idempotency_keys" drop column "user_id";
+alter table "idempotency_keys" alter column "userid" set not null;
+alter table "idempotency_keys" add constraint idempotency_keys_pk primary key ("userid", "key");
+alter table "idempotency_keys" alter column "created_at" type TEXT using to_char("created_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+alter table "idempotency_keys" alter column "expires_at" type TEXT using to_char("expires_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+
+alter table "balances" add column "userid" TEXT;
+update "balances" b set "userid" = u."login" from "users" u where u."id" = b."user_id";
+alter table "balances" drop column "user_id";
+alter table "balances" alter column "userid" set not null;
+alter table "balances" add constraint balances_pk primary key ("userid");
+
+drop index if exists ledger_order_idx;
+alter table "ledger" drop constraint ledger_entry_type_check;
+alter table "ledger" drop constraint ledger_account_check;
+alter table "ledger" add column "userid" TEXT;
+update "ledger" l set "userid" = u."login" from "users" u where u."id" = l."user_id";
+alter table "ledger" drop column "user_id";
+alter table "ledger" alter column "userid" set not null;
+alter table "ledger" alter column "created_at" type TEXT using to_char("created_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+
+alter table "withdrawals" add column "userid" TEXT;
+update "withdrawals" w set "userid" = u."login" from "users" u where u."id" = w."user_id";
+alter table "withdrawals" drop column "user_id";
+alter table "withdrawals" alter column "userid" set not null;
+alter table "withdrawals" alter column "processed_at" type TEXT using to_char("processed_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+
+drop index if exists sync_jobs_lease_id_idx;
+alter table "sync_jobs" drop constraint sync_jobs_status_check;
+alter table "sync_jobs" drop constraint sync_jobs_order_fk;
+alter table "order_status_history" drop constraint order_status_history_status_check;
+alter table "order_status_history" drop constraint order_status_history_order_fk;
+
+drop index if exists orders_status_idx;
+alter table "orders" drop constraint orders_status_check;
+alter table "orders" add column "userid" TEXT;
+update "orders" o set "userid" = u."login" from "users" u where u."id" = o."user_id";
+alter table "orders" drop column "user_id";
+alter table "orders" alter column "userid" set not null;
+
+drop index if exists sessions_expires_at_idx;
+alter table "sessions" add column "userid" TEXT;
+update "sessions" s set "userid" = u."login" from "users" u where u."id" = s."user_id";
+alter table "sessions" drop column "user_id";
+alter table "sessions" alter column "userid" set not null;
+alter table "sessions" alter column "created_at" type TEXT using to_char("created_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+alter table "sessions" alter column "last_seen_at" type TEXT using to_char("last_seen_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+alter table "sessions" alter column "expires_at" type TEXT using to_char("expires_at" at time zone 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"');
+create index if not exists sessions_userid_idx on "sessions" ("userid");
+
+alter table "users" drop column "created_at";
+alter table "users" drop constraint users_login_uniq;
+alter table "users" drop constraint users_pk;
+alter table "users" drop column "id";
+alter table "users" rename column "login" to "userid";
+alter table "users" add constraint userid_pk primary key ("userid");
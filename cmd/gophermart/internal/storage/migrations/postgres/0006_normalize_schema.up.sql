@@ -0,0 +1,84 @@
+-- нормализация схемы: суррогатный идентификатор пользователя и внешние ключи на него,
+-- даты и время в столбцах timestamptz, ограничения на статусы и индексы под все запросы хранилища
+
+-- пользователи: login остаётся уникальным, а ссылки на пользователя ведутся по суррогатному идентификатору id
+alter table "users" rename column "userid" to "login";
+alter table "users" drop constraint "userid_pk";
+alter table "users" add column "id" BIGINT generated always as identity;
+alter table "users" add constraint users_pk primary key ("id");
+alter table "users" add constraint users_login_uniq unique ("login");
+alter table "users" add column "created_at" TIMESTAMPTZ not null default date_trunc('second', now());
+
+-- сессии
+alter table "sessions" add column "user_id" BIGINT;
+update "sessions" s set "user_id" = u."id" from "users" u where u."login" = s."userid";
+delete from "sessions" where "user_id" is null;
+alter table "sessions" alter column "user_id" set not null;
+alter table "sessions" drop column "userid";
+alter table "sessions" add constraint sessions_user_fk foreign key ("user_id") references "users" ("id") on delete cascade;
+alter table "sessions" alter column "created_at" type timestamptz using "created_at"::timestamptz;
+alter table "sessions" alter column "last_seen_at" type timestamptz using "last_seen_at"::timestamptz;
+alter table "sessions" alter column "expires_at" type timestamptz using "expires_at"::timestamptz;
+create index sessions_user_id_idx on "sessions" ("user_id", "created_at");
+create index sessions_expires_at_idx on "sessions" ("expires_at");
+
+-- заказы: заказы пользователей, которых нет в "users", удаляются вместе с их историей и заданиями синхронизации
+alter table "orders" add column "user_id" BIGINT;
+update "orders" o set "user_id" = u."id" from "users" u where u."login" = o."userid";
+delete from "order_status_history" h using "orders" o where o."order" = h."order" and o."user_id" is null;
+delete from "sync_jobs" j using "orders" o where o."order" = j."order" and o."user_id" is null;
+delete from "orders" where "user_id" is null;
+alter table "orders" alter column "user_id" set not null;
+alter table "orders" drop column "userid";
+alter table "orders" add constraint orders_user_fk foreign key ("user_id") references "users" ("id");
+alter table "orders" add constraint orders_status_check check ("status" in ('NEW', 'REGISTERED', 'PROCESSING', 'PROCESSED', 'INVALID'));
+create index orders_user_id_idx on "orders" ("user_id", "uploaded_at");
+create index orders_status_idx on "orders" ("status");
+
+alter table "order_status_history" add constraint order_status_history_order_fk foreign key ("order") references "orders" ("order") on delete cascade;
+alter table "order_status_history" add constraint order_status_history_status_check check ("status" in ('NEW', 'REGISTERED', 'PROCESSING', 'PROCESSED', 'INVALID'));
+
+alter table "sync_jobs" add constraint sync_jobs_order_fk foreign key ("order") references "orders" ("order") on delete cascade;
+alter table "sync_jobs" add constraint sync_jobs_status_check check ("status" in ('PENDING', 'DEAD'));
+create index sync_jobs_lease_id_idx on "sync_jobs" ("lease_id");
+
+-- списания баллов: списания пользователей, которых нет в "users", удаляются
+alter table "withdrawals" add column "user_id" BIGINT;
+update "withdrawals" w set "user_id" = u."id" from "users" u where u."login" = w."userid";
+delete from "withdrawals" where "user_id" is null;
+alter table "withdrawals" alter column "user_id" set not null;
+alter table "withdrawals" drop column "userid";
+alter table "withdrawals" add constraint withdrawals_user_fk foreign key ("user_id") references "users" ("id");
+alter table "withdrawals" alter column "processed_at" type timestamptz using "processed_at"::timestamptz;
+create index withdrawals_user_id_idx on "withdrawals" ("user_id", "processed_at");
+
+-- журнал баллов: проводки по счетам пользователей, которых нет в "users", удаляются
+alter table "ledger" add column "user_id" BIGINT;
+update "ledger" l set "user_id" = u."id" from "users" u where u."login" = l."userid";
+delete from "ledger" where "user_id" is null;
+alter table "ledger" alter column "user_id" set not null;
+alter table "ledger" drop column "userid";
+alter table "ledger" add constraint ledger_user_fk foreign key ("user_id") references "users" ("id");
+alter table "ledger" alter column "created_at" type timestamptz using "created_at"::timestamptz;
+alter table "ledger" add constraint ledger_account_check check ("account" in ('USER', 'ACCRUAL', 'REDEMPTION'));
+alter table "ledger" add constraint ledger_entry_type_check check ("entry_type" in ('ACCRUAL', 'WITHDRAWAL', 'REVERSAL', 'ADJUSTMENT'));
+create index ledger_user_id_idx on "ledger" ("user_id", "account");
+create index ledger_order_idx on "ledger" ("order", "entry_type", "account");
+
+-- материализованные балансы: первичный ключ по userid удаляется вместе со столбцом
+alter table "balances" add column "user_id" BIGINT;
+update "balances" b set "user_id" = u."id" from "users" u where u."login" = b."userid";
+delete from "balances" where "user_id" is null;
+alter table "balances" drop column "userid";
+alter table "balances" add constraint balances_pk primary key ("user_id");
+alter table "balances" add constraint balances_user_fk foreign key ("user_id") references "users" ("id") on delete cascade;
+
+-- ключи идемпотентности: первичный ключ по (userid, key) удаляется вместе со столбцом
+alter table "idempotency_keys" add column "user_id" BIGINT;
+update "idempotency_keys" k set "user_id" = u."id" from "users" u where u."login" = k."userid";
+delete from "idempotency_keys" where "user_id" is null;
+alter table "idempotency_keys" drop column "userid";
+alter table "idempotency_keys" add constraint idempotency_keys_pk primary key ("user_id", "key");
+alter table "idempotency_keys" add constraint idempotency_keys_user_fk foreign key ("user_id") references "users" ("id") on delete cascade;
+alter table "idempotency_keys" alter column "created_at" type timestamptz using "created_at"::timestamptz;
+alter table "idempotency_keys" alter column "expires_at" type timestamptz using "expires_at"::timestamptz;
@@ -0,0 +1,3 @@
+drop index if exists orders_user_status_idx;
+drop index if exists orders_user_id_idx;
+create index orders_user_id_idx on "orders" ("user_id", "uploaded_at");
@@ -0,0 +1,5 @@
+-- индексы под постраничную выдачу заказов пользователя: сортировка по дате загрузки и номеру заказа,
+-- в том числе с фильтром по статусу
+drop index if exists orders_user_id_idx;
+create index orders_user_id_idx on "orders" ("user_id", "uploaded_at", "order");
+create index orders_user_status_idx on "orders" ("user_id", "status", "uploaded_at", "order");
@@ -0,0 +1,3 @@
+-- индекс под постраничную выдачу и итоги списаний пользователя за период: сортировка по дате списания и номеру заказа
+drop index if exists withdrawals_user_id_idx;
+create index withdrawals_user_id_idx on "withdrawals" ("user_id", "processed_at", "order");
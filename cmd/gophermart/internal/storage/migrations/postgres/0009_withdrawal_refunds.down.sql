@@ -0,0 +1,2 @@
+alter table "withdrawals" drop constraint if exists withdrawals_refunded_check;
+alter table "withdrawals" drop column "refunded";
@@ -0,0 +1,3 @@
+-- сумма баллов, возвращённых по списанию при отмене оплаченного заказа; возвраты проводятся в журнале баллов как REVERSAL
+alter table "withdrawals" add column "refunded" NUMERIC(18, 2) not null default 0;
+alter table "withdrawals" add constraint withdrawals_refunded_check check ("refunded" >= 0 and "refunded" <= "sum");
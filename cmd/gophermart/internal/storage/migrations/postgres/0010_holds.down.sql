@@ -0,0 +1,4 @@
+-- действующие резервы возвращаются в доступный остаток
+update "balances" set "current" = "current" + "held";
+alter table "balances" drop column "held";
+drop table if exists "holds";
@@ -0,0 +1,19 @@
+-- двухфазное списание: баллы резервируются (hold) при оформлении корзины и списываются (capture) после оплаты
+-- или возвращаются на счёт (release), в том числе автоматически по истечении срока резерва
+create table if not exists "holds" (
+	"id" TEXT constraint holds_pk primary key not null,
+	"order" TEXT not null,
+	"user_id" BIGINT not null constraint holds_user_fk references "users" ("id"),
+	"sum" NUMERIC(18, 2) not null constraint holds_sum_check check ("sum" > 0),
+	"status" TEXT not null constraint holds_status_check check ("status" in ('HELD', 'CAPTURED', 'RELEASED', 'EXPIRED')),
+	"created_at" TIMESTAMPTZ not null,
+	"expires_at" TIMESTAMPTZ not null,
+	"closed_at" TIMESTAMPTZ);
+
+-- по одному заказу действует не более одного резерва
+create unique index holds_order_held_idx on "holds" ("order") where "status" = 'HELD';
+create index holds_expires_at_idx on "holds" ("status", "expires_at");
+create index holds_user_id_idx on "holds" ("user_id", "created_at");
+
+-- зарезервированные баллы в материализованном балансе: "current" - доступный остаток за вычетом резервов
+alter table "balances" add column "held" NUMERIC(18, 2) not null default 0;
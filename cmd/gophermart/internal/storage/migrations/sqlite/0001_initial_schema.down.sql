@@ -0,0 +1,4 @@
+drop table if exists "withdrawals";
+drop table if exists "orders";
+drop table if exists "sessions";
+drop table if exists "users";
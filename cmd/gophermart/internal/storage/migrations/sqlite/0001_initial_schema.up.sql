@@ -0,0 +1,35 @@
+-- пользователи, сессии, заказы и списания баллов
+
+create table if not exists "users" (
+	"userid" TEXT constraint userid_pk primary key not null,
+	"password" TEXT not null);
+
+-- секретное значение сессии из cookie в базе не хранится - только его hash
+create table if not exists "sessions" (
+	"session_id" TEXT constraint sessions_pk primary key not null,
+	"token_hash" TEXT constraint token_hash_uniq unique not null,
+	"userid" TEXT not null,
+	"created_at" TEXT not null,
+	"last_seen_at" TEXT not null,
+	"expires_at" TEXT not null,
+	"user_agent" TEXT not null,
+	"ip" TEXT not null);
+
+create index if not exists sessions_userid_idx on "sessions" ("userid");
+
+-- uploaded_at - дата загрузки заказа, status_changed_at - дата последней смены статуса,
+-- processed_at - дата перехода в финальный статус PROCESSED или INVALID
+create table if not exists "orders" (
+	"order" TEXT constraint orders_pk primary key not null,
+	"status" TEXT not null,
+	"accrual" NUMERIC(18, 2) not null,
+	"uploaded_at" TIMESTAMP not null,
+	"userid" TEXT not null,
+	"status_changed_at" TIMESTAMP not null,
+	"processed_at" TIMESTAMP);
+
+create table if not exists "withdrawals" (
+	"order" TEXT constraint withdrawals_pk primary key not null,
+	"sum" NUMERIC(18, 2) not null,
+	"processed_at" TEXT not null,
+	"userid" TEXT not null);
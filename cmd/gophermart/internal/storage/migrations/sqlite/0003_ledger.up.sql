@@ -0,0 +1,15 @@
+-- журнал баллов с двойной записью и материализованные балансы пользователей
+create table if not exists "ledger" (
+	"entry_id" TEXT constraint ledger_pk primary key not null,
+	"tx_id" TEXT not null,
+	"userid" TEXT not null,
+	"account" TEXT not null,
+	"entry_type" TEXT not null,
+	"amount" NUMERIC(18, 2) not null,
+	"order" TEXT not null,
+	"created_at" TEXT not null);
+
+create table if not exists "balances" (
+	"userid" TEXT constraint balances_pk primary key not null,
+	"current" NUMERIC(18, 2) not null,
+	"withdrawn" NUMERIC(18, 2) not null);
@@ -0,0 +1,13 @@
+-- сохранённые ответы на запросы с заголовком Idempotency-Key
+create table if not exists "idempotency_keys" (
+	"key" TEXT not null,
+	"userid" TEXT not null,
+	"request_hash" TEXT not null,
+	"status_code" INTEGER not null,
+	"content_type" TEXT not null,
+	"response" TEXT not null,
+	"created_at" TEXT not null,
+	"expires_at" TEXT not null,
+	constraint idempotency_keys_pk primary key ("userid", "key"));
+
+create index if not exists idempotency_keys_expires_at_idx on "idempotency_keys" ("expires_at");
@@ -0,0 +1,21 @@
+-- задания синхронизации заказов с сервером начислений: status - PENDING или DEAD,
+-- attempts - количество выполненных опросов, failures - количество неудачных опросов подряд,
+-- run_at - срок очередного опроса, lease_id и locked_until - обработчик, арендовавший задание, и срок аренды
+create table if not exists "sync_jobs" (
+	"order" TEXT constraint sync_jobs_pk primary key not null,
+	"status" TEXT not null,
+	"attempts" INTEGER not null default 0,
+	"failures" INTEGER not null default 0,
+	"last_error" TEXT not null default '',
+	"run_at" TIMESTAMP not null,
+	"lease_id" TEXT,
+	"locked_until" TIMESTAMP,
+	"created_at" TIMESTAMP not null);
+
+create index if not exists sync_jobs_run_at_idx on "sync_jobs" ("status", "run_at");
+
+-- для заказов в НЕ финальных статусах, загруженных до появления заданий, создаём задания с опросом на ближайшем цикле
+insert into "sync_jobs" ("order", "status", "run_at", "created_at")
+	select "order", 'PENDING', CURRENT_TIMESTAMP, CURRENT_TIMESTAMP from "orders"
+	where "status" in ('NEW', 'REGISTERED', 'PROCESSING')
+	and not exists (select 1 from "sync_jobs" j where j."order" = "orders"."order");
@@ -0,0 +1,114 @@
+-- возврат к ссылкам на пользователя по login: таблицы пересоздаются в схеме версии 5 с переносом данных
+
+create table "users_v5" (
+	"userid" TEXT constraint userid_pk primary key not null,
+	"password" TEXT not null);
+insert into "users_v5" select "login", "password" from "users";
+
+create table "sessions_v5" (
+	"session_id" TEXT constraint sessions_pk primary key not null,
+	"token_hash" TEXT constraint token_hash_uniq unique not null,
+	"userid" TEXT not null,
+	"created_at" TEXT not null,
+	"last_seen_at" TEXT not null,
+	"expires_at" TEXT not null,
+	"user_agent" TEXT not null,
+	"ip" TEXT not null);
+insert into "sessions_v5" select s."session_id", s."token_hash", u."login", s."created_at", s."last_seen_at", s."expires_at", s."user_agent", s."ip"
+	from "sessions" s join "users" u on u."id" = s."user_id";
+
+create table "orders_v5" (
+	"order" TEXT constraint orders_pk primary key not null,
+	"status" TEXT not null,
+	"accrual" NUMERIC(18, 2) not null,
+	"uploaded_at" TIMESTAMP not null,
+	"userid" TEXT not null,
+	"status_changed_at" TIMESTAMP not null,
+	"processed_at" TIMESTAMP);
+insert into "orders_v5" select o."order", o."status", o."accrual", o."uploaded_at", u."login", o."status_changed_at", o."processed_at"
+	from "orders" o join "users" u on u."id" = o."user_id";
+
+create table "order_status_history_v5" (
+	"entry_id" TEXT constraint order_status_history_pk primary key not null,
+	"order" TEXT not null,
+	"status" TEXT not null,
+	"changed_at" TIMESTAMP not null,
+	"seq" INTEGER not null);
+insert into "order_status_history_v5" select * from "order_status_history";
+
+create table "sync_jobs_v5" (
+	"order" TEXT constraint sync_jobs_pk primary key not null,
+	"status" TEXT not null,
+	"attempts" INTEGER not null default 0,
+	"failures" INTEGER not null default 0,
+	"last_error" TEXT not null default '',
+	"run_at" TIMESTAMP not null,
+	"lease_id" TEXT,
+	"locked_until" TIMESTAMP,
+	"created_at" TIMESTAMP not null);
+insert into "sync_jobs_v5" select * from "sync_jobs";
+
+create table "withdrawals_v5" (
+	"order" TEXT constraint withdrawals_pk primary key not null,
+	"sum" NUMERIC(18, 2) not null,
+	"processed_at" TEXT not null,
+	"userid" TEXT not null);
+insert into "withdrawals_v5" select w."order", w."sum", w."processed_at", u."login"
+	from "withdrawals" w join "users" u on u."id" = w."user_id";
+
+create table "ledger_v5" (
+	"entry_id" TEXT constraint ledger_pk primary key not null,
+	"tx_id" TEXT not null,
+	"userid" TEXT not null,
+	"account" TEXT not null,
+	"entry_type" TEXT not null,
+	"amount" NUMERIC(18, 2) not null,
+	"order" TEXT not null,
+	"created_at" TEXT not null);
+insert into "ledger_v5" select l."entry_id", l."tx_id", u."login", l."account", l."entry_type", l."amount", l."order", l."created_at"
+	from "ledger" l join "users" u on u."id" = l."user_id";
+
+create table "balances_v5" (
+	"userid" TEXT constraint balances_pk primary key not null,
+	"current" NUMERIC(18, 2) not null,
+	"withdrawn" NUMERIC(18, 2) not null);
+insert into "balances_v5" select u."login", b."current", b."withdrawn"
+	from "balances" b join "users" u on u."id" = b."user_id";
+
+create table "idempotency_keys_v5" (
+	"key" TEXT not null,
+	"userid" TEXT not null,
+	"request_hash" TEXT not null,
+	"status_code" INTEGER not null,
+	"content_type" TEXT not null,
+	"response" TEXT not null,
+	"created_at" TEXT not null,
+	"expires_at" TEXT not null,
+	constraint idempotency_keys_pk primary key ("userid", "key"));
+insert into "idempotency_keys_v5" select k."key", u."login", k."request_hash", k."status_code", k."content_type", k."response", k."created_at", k."expires_at"
+	from "idempotency_keys" k join "users" u on u."id" = k."user_id";
+
+drop table "idempotency_keys";
+drop table "balances";
+drop table "ledger";
+drop table "withdrawals";
+drop table "sync_jobs";
+drop table "order_status_history";
+drop table "orders";
+drop table "sessions";
+drop table "users";
+
+alter table "users_v5" rename to "users";
+alter table "sessions_v5" rename to "sessions";
+alter table "orders_v5" rename to "orders";
+alter table "order_status_history_v5" rename to "order_status_history";
+alter table "sync_jobs_v5" rename to "sync_jobs";
+alter table "withdrawals_v5" rename to "withdrawals";
+alter table "ledger_v5" rename to "ledger";
+alter table "balances_v5" rename to "balances";
+alter table "idempotency_keys_v5" rename to "idempotency_keys";
+
+create index sessions_userid_idx on "sessions" ("userid");
+create unique index order_status_history_order_idx on "order_status_history" ("order", "seq");
+create index sync_jobs_run_at_idx on "sync_jobs" ("status", "run_at");
+create index idempotency_keys_expires_at_idx on "idempotency_keys" ("expires_at");
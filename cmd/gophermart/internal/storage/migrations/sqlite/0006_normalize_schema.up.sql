@@ -0,0 +1,127 @@
+-- нормализация схемы: суррогатный идентификатор пользователя и внешние ключи на него,
+-- даты и время в столбцах timestamp, ограничения на статусы и индексы под все запросы хранилища
+-- sqlite не умеет добавлять ограничения в существующие таблицы - таблицы пересоздаются с переносом данных;
+-- при переименовании таблиц sqlite сам переводит на новые имена ссылки внешних ключей
+-- строки пользователей, которых нет в "users", не переносятся: заказы - вместе с их историей и заданиями синхронизации, списания, проводки журнала
+
+create table "users_v6" (
+	"id" INTEGER constraint users_pk primary key autoincrement,
+	"login" TEXT constraint users_login_uniq unique not null,
+	"password" TEXT not null,
+	"created_at" TIMESTAMP not null default CURRENT_TIMESTAMP);
+insert into "users_v6" ("login", "password") select "userid", "password" from "users";
+
+create table "sessions_v6" (
+	"session_id" TEXT constraint sessions_pk primary key not null,
+	"token_hash" TEXT constraint token_hash_uniq unique not null,
+	"user_id" INTEGER not null constraint sessions_user_fk references "users_v6" ("id") on delete cascade,
+	"created_at" TIMESTAMP not null,
+	"last_seen_at" TIMESTAMP not null,
+	"expires_at" TIMESTAMP not null,
+	"user_agent" TEXT not null,
+	"ip" TEXT not null);
+insert into "sessions_v6" select s."session_id", s."token_hash", u."id", s."created_at", s."last_seen_at", s."expires_at", s."user_agent", s."ip"
+	from "sessions" s join "users_v6" u on u."login" = s."userid";
+
+create table "orders_v6" (
+	"order" TEXT constraint orders_pk primary key not null,
+	"status" TEXT not null constraint orders_status_check check ("status" in ('NEW', 'REGISTERED', 'PROCESSING', 'PROCESSED', 'INVALID')),
+	"accrual" NUMERIC(18, 2) not null,
+	"uploaded_at" TIMESTAMP not null,
+	"user_id" INTEGER not null constraint orders_user_fk references "users_v6" ("id"),
+	"status_changed_at" TIMESTAMP not null,
+	"processed_at" TIMESTAMP);
+insert into "orders_v6" select o."order", o."status", o."accrual", o."uploaded_at", u."id", o."status_changed_at", o."processed_at"
+	from "orders" o join "users_v6" u on u."login" = o."userid";
+
+create table "order_status_history_v6" (
+	"entry_id" TEXT constraint order_status_history_pk primary key not null,
+	"order" TEXT not null constraint order_status_history_order_fk references "orders_v6" ("order") on delete cascade,
+	"status" TEXT not null constraint order_status_history_status_check check ("status" in ('NEW', 'REGISTERED', 'PROCESSING', 'PROCESSED', 'INVALID')),
+	"changed_at" TIMESTAMP not null,
+	"seq" INTEGER not null);
+insert into "order_status_history_v6" select h.* from "order_status_history" h join "orders_v6" o on o."order" = h."order";
+
+create table "sync_jobs_v6" (
+	"order" TEXT constraint sync_jobs_pk primary key not null constraint sync_jobs_order_fk references "orders_v6" ("order") on delete cascade,
+	"status" TEXT not null constraint sync_jobs_status_check check ("status" in ('PENDING', 'DEAD')),
+	"attempts" INTEGER not null default 0,
+	"failures" INTEGER not null default 0,
+	"last_error" TEXT not null default '',
+	"run_at" TIMESTAMP not null,
+	"lease_id" TEXT,
+	"locked_until" TIMESTAMP,
+	"created_at" TIMESTAMP not null);
+insert into "sync_jobs_v6" select j.* from "sync_jobs" j join "orders_v6" o on o."order" = j."order";
+
+create table "withdrawals_v6" (
+	"order" TEXT constraint withdrawals_pk primary key not null,
+	"sum" NUMERIC(18, 2) not null,
+	"processed_at" TIMESTAMP not null,
+	"user_id" INTEGER not null constraint withdrawals_user_fk references "users_v6" ("id"));
+insert into "withdrawals_v6" select w."order", w."sum", w."processed_at", u."id"
+	from "withdrawals" w join "users_v6" u on u."login" = w."userid";
+
+create table "ledger_v6" (
+	"entry_id" TEXT constraint ledger_pk primary key not null,
+	"tx_id" TEXT not null,
+	"user_id" INTEGER not null constraint ledger_user_fk references "users_v6" ("id"),
+	"account" TEXT not null constraint ledger_account_check check ("account" in ('USER', 'ACCRUAL', 'REDEMPTION')),
+	"entry_type" TEXT not null constraint ledger_entry_type_check check ("entry_type" in ('ACCRUAL', 'WITHDRAWAL', 'REVERSAL', 'ADJUSTMENT')),
+	"amount" NUMERIC(18, 2) not null,
+	"order" TEXT not null,
+	"created_at" TIMESTAMP not null);
+insert into "ledger_v6" select l."entry_id", l."tx_id", u."id", l."account", l."entry_type", l."amount", l."order", l."created_at"
+	from "ledger" l join "users_v6" u on u."login" = l."userid";
+
+create table "balances_v6" (
+	"user_id" INTEGER constraint balances_pk primary key not null constraint balances_user_fk references "users_v6" ("id") on delete cascade,
+	"current" NUMERIC(18, 2) not null,
+	"withdrawn" NUMERIC(18, 2) not null);
+insert into "balances_v6" select u."id", b."current", b."withdrawn"
+	from "balances" b join "users_v6" u on u."login" = b."userid";
+
+create table "idempotency_keys_v6" (
+	"key" TEXT not null,
+	"user_id" INTEGER not null constraint idempotency_keys_user_fk references "users_v6" ("id") on delete cascade,
+	"request_hash" TEXT not null,
+	"status_code" INTEGER not null,
+	"content_type" TEXT not null,
+	"response" TEXT not null,
+	"created_at" TIMESTAMP not null,
+	"expires_at" TIMESTAMP not null,
+	constraint idempotency_keys_pk primary key ("user_id", "key"));
+insert into "idempotency_keys_v6" select k."key", u."id", k."request_hash", k."status_code", k."content_type", k."response", k."created_at", k."expires_at"
+	from "idempotency_keys" k join "users_v6" u on u."login" = k."userid";
+
+drop table "idempotency_keys";
+drop table "balances";
+drop table "ledger";
+drop table "withdrawals";
+drop table "sync_jobs";
+drop table "order_status_history";
+drop table "orders";
+drop table "sessions";
+drop table "users";
+
+alter table "users_v6" rename to "users";
+alter table "sessions_v6" rename to "sessions";
+alter table "orders_v6" rename to "orders";
+alter table "order_status_history_v6" rename to "order_status_history";
+alter table "sync_jobs_v6" rename to "sync_jobs";
+alter table "withdrawals_v6" rename to "withdrawals";
+alter table "ledger_v6" rename to "ledger";
+alter table "balances_v6" rename to "balances";
+alter table "idempotency_keys_v6" rename to "idempotency_keys";
+
+create index sessions_user_id_idx on "sessions" ("user_id", "created_at");
+create index sessions_expires_at_idx on "sessions" ("expires_at");
+create index orders_user_id_idx on "orders" ("user_id", "uploaded_at");
+create index orders_status_idx on "orders" ("status");
+create unique index order_status_history_order_idx on "order_status_history" ("order", "seq");
+create index sync_jobs_run_at_idx on "sync_jobs" ("status", "run_at");
+create index sync_jobs_lease_id_idx on "sync_jobs" ("lease_id");
+create index withdrawals_user_id_idx on "withdrawals" ("user_id", "processed_at");
+create index ledger_user_id_idx on "ledger" ("user_id", "account");
+create index ledger_order_idx on "ledger" ("order", "entry_type", "account");
+create index idempotency_keys_expires_at_idx on "idempotency_keys" ("expires_at");
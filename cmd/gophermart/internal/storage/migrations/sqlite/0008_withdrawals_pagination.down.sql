@@ -0,0 +1,2 @@
+drop index if exists withdrawals_user_id_idx;
+create index withdrawals_user_id_idx on "withdrawals" ("user_id", "processed_at");
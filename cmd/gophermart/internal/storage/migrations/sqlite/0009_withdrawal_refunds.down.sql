@@ -0,0 +1 @@
+alter table "withdrawals" drop column "refunded";
@@ -1,29 +1,50 @@
 package storage
 
 import (
+	"context"
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"time"
 )
 
 //	Datasource - интерфейс источника данных сервера
-//	может реализовываться базой данных PostgreSQL (Database) или в тестовых целях - базой данных sqllite (SQLliteDB) в режиме "in memory"
+//	методы принимают контекст запроса: при его отмене прерывается и выполнение запросов к базе данных
+//	реализуется хранилищем Database на базе данных PostgreSQL, файловой базе данных sqlite или, в тестовых целях, на базе sqlite в режиме "in memory",
+//	а также хранилищем MemoryStore (DatabaseDSN = memory://) на структурах в оперативной памяти процесса:
+//	данные MemoryStore не сохраняются между запусками сервера, а схемы и миграций у него нет
 type Datasource interface {
-	UserRegister(userID, password string) (token string, err error)        //	регистрация пользователя
-	UserAuthorise(userID, password string) (token string, err error)       //	авторизация пользователя
-	GetOrders(userID string) ([]Order, error)                              //	запрос списка заказов пользователя
-	GetBalance(userID string) (accrualSum, withdrawSum float32, err error) //	запрос баланса пользователя
-	GetWithdrawals(userID string) ([]Withdraw, error)                      //	запрос на списание баллов пользователя
-	OrderInsert(order string, userID string) error                         //	запрос от пользователя на регистрацию нового заказа
-	WithdrawRequest(order string, sum float32, userID string) error        //	запрос пользователя на списание баллов
-	Close()                                                                //	закрытие источника данных
-	UpdateOrdersStatus() error                                             //	синхронизация статуса заказов с внешним сервисом начисления баллов
+	UserRegister(ctx context.Context, userID, password string, meta SessionMeta) (token string, expiresAt time.Time, err error)  //	регистрация пользователя
+	UserAuthorise(ctx context.Context, userID, password string, meta SessionMeta) (token string, expiresAt time.Time, err error) //	авторизация пользователя
+	SessionUser(ctx context.Context, token string) (userID, sessionID string, err error)                                         //	определение пользователя по секретному значению сессии
+	SessionActive(ctx context.Context, userID, sessionID string) error                                                           //	проверка, что сессия пользователя не закрыта и не истекла
+	RefreshSession(ctx context.Context, token string) (userID, sessionID, newToken string, expiresAt time.Time, err error)       //	продление сессии
+	UserLogout(ctx context.Context, userID, sessionID string) error                                                              //	завершение сессии пользователя
+	GetSessions(ctx context.Context, userID, sessionID string) ([]Session, error)                                                //	запрос списка сессий пользователя
+	DeleteSession(ctx context.Context, userID, id string) error                                                                  //	завершение другой сессии пользователя
+	GetOrders(ctx context.Context, userID string, filter OrdersFilter) (orders []Order, next string, err error)                  //	запрос страницы списка заказов пользователя
+	GetOrder(ctx context.Context, userID, number string) (OrderDetails, error)                                                   //	получение заказа пользователя с историей смены его статусов
+	GetBalance(ctx context.Context, userID string) (current, held, withdrawSum Points, err error)                                //	запрос баланса пользователя
+	GetWithdrawals(ctx context.Context, userID string, params ListParams) (withdrawals []Withdraw, next string, err error)       //	запрос страницы списка списаний баллов пользователя
+	GetWithdrawalsSummary(ctx context.Context, userID string, from, to time.Time) (WithdrawalsSummary, error)                    //	запрос итогов списаний баллов пользователя за период
+	OrderInsert(ctx context.Context, order string, userID string) error                                                          //	запрос от пользователя на регистрацию нового заказа
+	WithdrawRequest(ctx context.Context, order string, sum Points, userID string) error                                          //	запрос пользователя на списание баллов
+	RefundWithdrawal(ctx context.Context, order string, sum *Points, userID string) (Withdraw, error)                            //	возврат баллов по списанию в счёт отменённого заказа
+	HoldRequest(ctx context.Context, order string, sum Points, userID string, ttl time.Duration) (Hold, error)                   //	резервирование баллов пользователя в счёт оплаты заказа
+	HoldCapture(ctx context.Context, id, userID string) (Hold, error)                                                            //	списание резерва баллов в счёт оплаты заказа
+	HoldRelease(ctx context.Context, id, userID string) (Hold, error)                                                            //	возврат резерва баллов в доступный остаток
+	ReleaseExpiredHolds(ctx context.Context) (int, error)                                                                        //	возврат в доступный остаток резервов с истёкшим сроком
+	IdempotencyReserve(ctx context.Context, key, requestHash, userID string, ttl time.Duration) (*IdempotentResponse, error)     //	резервирование ключа идемпотентности
+	IdempotencySave(ctx context.Context, key, userID string, response IdempotentResponse) error                                  //	сохранение ответа по ключу идемпотентности
+	IdempotencyRelease(ctx context.Context, key, userID string) error                                                            //	освобождение ключа идемпотентности
+	Close()                                                                                                                      //	закрытие источника данных
+	UpdateOrdersStatus(ctx context.Context) error                                                                                //	синхронизация статуса заказов с внешним сервисом начисления баллов
 }
 
 //	Synchronizer - интерфейс сервиса для начисления бонусных баллов
 //	реализуется либо подключением к реальному сервису - BonusServer, либо к его эмулятору - MOKServer
 type Synchronizer interface {
-	SyncOrderStatus(orders []Order) error //	синхронизация статусов заказов и начислений
+	SyncOrderStatus(ctx context.Context, order *Order) error //	синхронизация статуса заказа и начислений по нему
 }
 
 //	рабочий экземпляр сервиса начислений
@@ -40,18 +61,57 @@ func newSessionID() string {
 //	Order - структура для передачи информации о начисленных баллах за покупки
 //	используется в методе GetOrders
 type Order struct {
-	Number     string  `json:"number"`      //  номер заказа, за который начисляем баллы
-	Accrual    float32 `json:"accrual"`     //  рассчитанные баллы к начислению
-	Status     string  `json:"status"`      //  статус расчёта начисления
-	UploadedAt string  `json:"uploaded_at"` //  дата загрузки заказа в систему
+	Number          string     `json:"number"`                 //  номер заказа, за который начисляем баллы
+	Accrual         Points     `json:"accrual"`                //  рассчитанные баллы к начислению
+	Status          string     `json:"status"`                 //  статус расчёта начисления
+	UploadedAt      time.Time  `json:"uploaded_at"`            //  дата загрузки заказа в систему
+	StatusChangedAt time.Time  `json:"status_changed_at"`      //  дата последней смены статуса
+	ProcessedAt     *time.Time `json:"processed_at,omitempty"` //  дата перехода в финальный статус PROCESSED или INVALID
 }
 
 //	Withdraw - структура для передачи информации о списании баллов в счёт покупки
 //	используется в методе GerWithdrawals
 type Withdraw struct {
-	Order       string  `json:"order"`        //  номер заказа, в счёт которого списываются баллы
-	Sum         float32 `json:"sum"`          //  сумма баллов к списанию в счёт оплаты заказа
-	ProcessedAt string  `json:"processed_at"` //  дата вывода средств на оплату заказа баллами
+	Order       string    `json:"order"`              //  номер заказа, в счёт которого списываются баллы
+	Sum         Points    `json:"sum"`                //  сумма баллов к списанию в счёт оплаты заказа
+	Refunded    Points    `json:"refunded,omitempty"` //  сумма баллов, возвращённых на счёт при отмене заказа
+	Status      string    `json:"status"`             //  статус списания: WITHDRAWN, PARTIALLY_REFUNDED или REFUNDED
+	ProcessedAt time.Time `json:"processed_at"`       //  дата вывода средств на оплату заказа баллами
+}
+
+//	статусы списания баллов
+const (
+	WithdrawalWithdrawn         = "WITHDRAWN"          //	баллы списаны
+	WithdrawalPartiallyRefunded = "PARTIALLY_REFUNDED" //	часть списанных баллов возвращена на счёт
+	WithdrawalRefunded          = "REFUNDED"           //	все списанные баллы возвращены на счёт
+)
+
+//	withdrawalStatus - функция определяет статус списания суммы sum, из которой возвращено refunded баллов
+func withdrawalStatus(sum, refunded Points) string {
+	switch {
+	case refunded == 0:
+		return WithdrawalWithdrawn
+	case refunded < sum:
+		return WithdrawalPartiallyRefunded
+	default:
+		return WithdrawalRefunded
+	}
+}
+
+//	WithdrawalsSummary - структура для передачи итогов списаний баллов за период
+//	используется в методе GetWithdrawalsSummary
+type WithdrawalsSummary struct {
+	Count    int    `json:"count"`    //  количество списаний
+	Sum      Points `json:"sum"`      //  сумма списанных баллов
+	Refunded Points `json:"refunded"` //  сумма баллов, возвращённых по этим списаниям
+}
+
+//	IdempotentResponse - структура для хранения ответа на запрос, выполненный с ключом идемпотентности
+//	используется в методах IdempotencyReserve и IdempotencySave
+type IdempotentResponse struct {
+	StatusCode  int    //	код статуса ответа
+	ContentType string //	тип содержимого ответа
+	Body        []byte //	тело ответа
 }
 
 //	ErrEmptyNotAllowed - ошибка возникающая при попытке вставить пустое значение в любое поле структуры хранения
@@ -69,8 +129,29 @@ var ErrOrderExistToAnother = errors.New("this order is already bind with another
 //	ErrInsufficientFundsToAccount - ошибка возникающая при попытке списать сумму баллов, большую чем осталось на счёте
 var ErrInsufficientFundsToAccount = errors.New("there are insufficient funds in the account")
 
+//	ErrWithdrawalExist - ошибка возникающая при попытке повторно списать баллы в счёт заказа, по которому списание уже было
+var ErrWithdrawalExist = errors.New("withdrawal for this order already exists")
+
+//	ErrWithdrawalRefunded - ошибка возникающая при попытке вернуть баллы по списанию, которое уже полностью возвращено
+var ErrWithdrawalRefunded = errors.New("withdrawal is already refunded")
+
+//	ErrRefundExceedsWithdrawal - ошибка возникающая при попытке вернуть баллов больше, чем осталось невозвращёнными по списанию
+var ErrRefundExceedsWithdrawal = errors.New("refund exceeds the withdrawn sum")
+
 //	ErrUserAlreadyExist - ошибка возникающая при попытке создать новый аккаунт с логином, уже существующим в нашей базе
 var ErrUserAlreadyExist = errors.New("account with same login already exist")
 
+//	ErrSessionNotFound - ошибка возникающая при обращении с идентификатором сессии, который не зарегистрирован в нашей базе
+var ErrSessionNotFound = errors.New("session is not found")
+
+//	ErrIdempotencyKeyReused - ошибка возникающая при повторном использовании ключа идемпотентности с другим содержимым запроса
+var ErrIdempotencyKeyReused = errors.New("idempotency key is already used with another request")
+
+//	ErrIdempotencyInProgress - ошибка возникающая при повторе запроса, обработка которого с тем же ключом идемпотентности ещё не завершена
+var ErrIdempotencyInProgress = errors.New("request with same idempotency key is in progress")
+
+//	ErrNoSchema - ошибка возникающая при попытке открыть базу данных для хранилища MemoryStore, у которого нет схемы и миграций
+var ErrNoSchema = errors.New("memory:// datasource keeps data in process memory and has no schema to migrate")
+
 //	ErrLoginPasswordIsWrong - ошибка возникающая при попытке авторизоваться с неправильным логин и/или пароль
 var ErrLoginPasswordIsWrong = errors.New("login or password is incorrect")
@@ -1,81 +1,117 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	//	github.com/jackc/pgx/stdlib - драйвер PostgreSQL для доступа к БД с использованием пакета database/sql
-	//	если хотим работать с БД напрямую, без database/sql надо использовать пакет - github.com/jackc/pgx/v4
-	_ "github.com/jackc/pgx/stdlib"
+	"fmt"
+	"strings"
+
+	//	с PostgreSQL работаем напрямую через пул соединений pgxpool (см. newPgxPool), с sqlite - через database/sql
 	_ "github.com/mattn/go-sqlite3"
 )
 
 // NewDatasource - функция конструктор, инициализирующая хранилище
+//	при DatabaseDSN = memory:// данные хранятся в оперативной памяти без базы данных (см. MemoryStore),
+//	иначе схема базы данных приводится к последней версии миграциями (см. MigrateUp)
 func NewDatasource(DatabaseDSN, AccrualAddress string) (strg Datasource, err error) {
 
 	if AccrualAddress == "" {
 		Syncer = &MOKServer{}
 	} else {
-		Syncer = &BonusServer{
-			AccrualAddress: AccrualAddress,
-		}
+		Syncer = NewBonusServer(AccrualAddress)
+	}
+
+	if DatabaseDSN == memoryScheme { //	хранилище в оперативной памяти без базы данных - миграции ему не нужны
+		return NewMemoryStore(), nil
+	}
+
+	d, err := OpenDatabase(DatabaseDSN)
+	if err != nil {
+		return nil, err
 	}
 
-	var d Database
+	//	если база данных доступна - применяем к ней миграции, создающие и обновляющие структуры хранения
+	//	после изменения схемы миграции заодно пересчитывают балансы пользователей из журнала баллов
+	if _, err = d.MigrateUp(); err != nil { //	при ошибке миграции прерываем работу конструктора
+		d.Close()
+		return nil, err
+	}
+
+	return d, nil //	если всё прошло ОК, то возвращаем выбранный источник данных
+}
+
+//	memoryScheme - DatabaseDSN, выбирающий хранилище в оперативной памяти MemoryStore
+const memoryScheme = "memory://"
+
+//	sqliteScheme - префикс DatabaseDSN, выбирающий файловую базу данных sqlite: sqlite://путь/к/файлу.db
+const sqliteScheme = "sqlite://"
+
+//	OpenDatabase - функция открывает connect к базе данных без изменения её схемы
+//	если DatabaseDSN не задан, то работаем с БД - sqllite3 в режиме "in memory",
+//	если задан в виде sqlite://путь - с файловой БД sqlite, иначе - с БД PostgreSQL
+//	у хранилища MemoryStore (DatabaseDSN = memory://) базы данных нет - для него возвращается ErrNoSchema
+func OpenDatabase(DatabaseDSN string) (d *Database, err error) {
+	if DatabaseDSN == memoryScheme {
+		return nil, ErrNoSchema
+	}
+	d = &Database{}
 
-	//	если не задана переменная среды DATABASE_DSN, то работаем с БД - sqllite3
 	if DatabaseDSN == "" { //	режим - "in memory" - всё в оперативке, на диске файлов НЕ создается
-		d.DB, err = sql.Open("sqlite3", ":memory:") //	при перезагрузке всё содержимое БД теряется
+		//	при перезагрузке всё содержимое БД теряется; проверка внешних ключей в sqlite включается параметром соединения
+		db, err := sql.Open(driverSQLite, ":memory:?_foreign_keys=1")
 		if err != nil {
 			return nil, err
 		}
-	} else { //	если задана переменная среды DATABASE_DSN, то работаем с БД - Postgres
-
-		d.DB, err = sql.Open("pgx", DatabaseDSN) //	открываем connect с базой данных PostgreSQL 10+
+		//	база "in memory" существует только в рамках одного соединения, кроме того sqlite допускает единственного писателя -
+		//	поэтому ограничиваем пул одним соединением: все транзакции, включая списания баллов, выполняются строго по очереди
+		db.SetMaxOpenConns(1)
+		d.db, d.driver = newSQLPool(db), driverSQLite
+		return d, nil
+	}
 
-		if err != nil { //	при ошибке открытия, прерываем работу конструктора
+	if strings.HasPrefix(DatabaseDSN, sqliteScheme) { //	режим - файловая база sqlite для сервера, работающего в одном экземпляре
+		d.db, err = openSQLiteFile(strings.TrimPrefix(DatabaseDSN, sqliteScheme))
+		if err != nil {
 			return nil, err
 		}
-
-		if err := d.DB.Ping(); err != nil { //	если база недоступна, прерываем работу конструктора
-			return nil, err
-		} //	тестируем доступность базы данных
+		d.driver = driverSQLite
+		return d, nil
 	}
 
-	//	если база данных доступна - создаём в ней структуры хранения
-	//	готовим SQL-statement для создания таблицы со списком пользователей, если её не существует
-	stmt := `create table if not exists "users" (
-						"userid" TEXT constraint userid_pk primary key not null,
-						"password" TEXT not null,
-                        "session_id" TEXT constraint session_id_uniq unique not null)`
-	_, err = d.DB.Exec(stmt)
-	if err != nil { //	при ошибке в создании структур хранения в базе данных, прерываем работу конструктора
+	//	если задана переменная среды DATABASE_DSN, то работаем с БД - Postgres
+	//	открываем пул соединений с базой данных PostgreSQL 10+ и тестируем доступность базы данных
+	d.db, err = newPgxPool(context.Background(), DatabaseDSN)
+	if err != nil { //	при ошибке открытия или недоступности базы, прерываем работу конструктора
 		return nil, err
 	}
+	d.driver = driverPostgres
 
-	//	готовим SQL-statement для создания таблицы заказов для начисления баллов, если её не существует
-	stmt = `create table if not exists "orders" (
-						"order" TEXT constraint orders_pk primary key not null,
-						"status" TEXT not null,
-   					"accrual" NUMERIC not null,
-   					"uploaded_at" TEXT not null,
-						"userid" TEXT not null)`
-	_, err = d.DB.Exec(stmt)
-	if err != nil { //	при ошибке в создании структур хранения в базе данных, прерываем работу конструктора
-		return nil, err
-	}
+	return d, nil
+}
 
-	//	готовим SQL-statement для создания таблицы списаний баллов, если её не существует
-	stmt = `create table if not exists "withdrawals" (
-					"order" TEXT constraint withdrawals_pk primary key not null,
-					"sum" NUMERIC not null,
-					"processed_at" TEXT not null,
-					"userid" TEXT not null)`
+//	openSQLiteFile - функция открывает файловую базу данных sqlite path, создавая файл при первом запуске
+//	журнал WAL позволяет читать базу параллельно с записью, а запись в sqlite возможна только одним соединением:
+//	все транзакции открываются как BEGIN IMMEDIATE и сразу захватывают блокировку записи, поэтому списания баллов
+//	выполняются строго по очереди, а соединение, не получившее блокировку, ждёт её до SQLiteBusyTimeout
+func openSQLiteFile(path string) (dbPool, error) {
+	if path == "" || strings.Contains(path, "?") {
+		return nil, fmt.Errorf("sqlite database path is invalid: %q", path)
+	}
 
-	_, err = d.DB.Exec(stmt)
-	if err != nil { //	при ошибке в создании структур хранения в базе данных, прерываем работу конструктора
+	params := fmt.Sprintf("?_foreign_keys=1&_journal_mode=WAL&_synchronous=NORMAL&_txlock=immediate&_busy_timeout=%d",
+		SQLiteBusyTimeout.Milliseconds())
+	db, err := sql.Open(driverSQLite, path+params)
+	if err != nil {
 		return nil, err
 	}
+	if DatabaseMaxConns > 0 {
+		db.SetMaxOpenConns(DatabaseMaxConns)
+	}
 
-	strg = &Database{DB: d.DB}
+	if err := db.Ping(); err != nil { //	если файл базы недоступен, прерываем работу конструктора
+		db.Close()
+		return nil, err
+	}
 
-	return strg, nil //	если всё прошло ОК, то возвращаем выбранный источник данных
+	return newSQLPool(db), nil
 }
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+//	OrderStatusChange - структура для передачи информации о смене статуса заказа
+//	используется в методе GetOrder
+type OrderStatusChange struct {
+	Status    string    `json:"status"`     //  статус, в который перешёл заказ
+	ChangedAt time.Time `json:"changed_at"` //  дата перехода в статус
+}
+
+//	OrderDetails - структура для передачи информации о заказе вместе с историей смены его статусов
+//	используется в методе GetOrder
+type OrderDetails struct {
+	Order
+	History []OrderStatusChange `json:"history"` //  переходы заказа между статусами в хронологическом порядке
+}
+
+//	recordOrderStatus - функция записывает в историю переход заказа order в статус status в рамках транзакции tx
+//	порядковый номер перехода задаёт хронологию переходов, совершённых в пределах одной секунды
+func recordOrderStatus(ctx context.Context, tx dbTx, order, status string, changedAt time.Time) error {
+	stmt := `insert into "order_status_history" ("entry_id", "order", "status", "changed_at", "seq")
+		select $1, $2, $3, $4, coalesce(max("seq"), 0) + 1 from "order_status_history" where "order" = $2`
+	_, err := tx.Exec(ctx, stmt, newSessionID(), order, status, changedAt)
+	return err
+}
+
+//	recordStatusChange - функция записывает в историю переход заказа order из статуса from в статус to,
+//	если статус действительно изменился и запрос обновил updated строк заказа
+func recordStatusChange(ctx context.Context, tx dbTx, updated int64, order, from, to string, changedAt time.Time) error {
+	if from == to || updated == 0 {
+		return nil
+	}
+	return recordOrderStatus(ctx, tx, order, to, changedAt)
+}
+
+//	GetOrder - метод возвращает заказ number пользователя userID вместе с историей смены его статусов
+//	для заказа другого пользователя, как и для несуществующего заказа, возвращает ErrNoDataToAnswer
+func (d *Database) GetOrder(ctx context.Context, userID, number string) (OrderDetails, error) {
+	var details OrderDetails
+
+	stmt := `select "order", "status", "accrual", "uploaded_at", "status_changed_at", "processed_at" from "orders"
+		where "order" = $1 and "user_id" = (select "id" from "users" where "login" = $2)`
+	err := d.db.QueryRow(ctx, stmt, number, userID).Scan(&details.Number, &details.Status, &details.Accrual, &details.UploadedAt, &details.StatusChangedAt, &details.ProcessedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return details, ErrNoDataToAnswer
+	}
+	if err != nil {
+		return details, err
+	}
+
+	stmt = `select "status", "changed_at" from "order_status_history" where "order" = $1 order by "seq"`
+	rows, err := d.db.Query(ctx, stmt, number)
+	if err != nil {
+		return details, err
+	}
+	defer rows.Close()
+
+	details.History = make([]OrderStatusChange, 0)
+	//	перебираем все строки выборки, добавляя записи в историю заказа
+	for rows.Next() {
+		var change OrderStatusChange
+		if err := rows.Scan(&change.Status, &change.ChangedAt); err != nil {
+			return details, err
+		}
+		details.History = append(details.History, change)
+	}
+
+	return details, rows.Err()
+}
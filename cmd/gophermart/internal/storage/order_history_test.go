@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//	scriptedServer - эмулятор сервера начислений, на каждый опрос заказа отвечающий очередным статусом из сценария
+type scriptedServer struct {
+	script []string
+	polls  int
+}
+
+//	SyncOrderStatus - метод отвечает очередным статусом сценария, начисляя 10 баллов в статусе PROCESSED
+func (s *scriptedServer) SyncOrderStatus(ctx context.Context, order *Order) error {
+	order.Status = s.script[s.polls]
+	if order.Status == "PROCESSED" {
+		order.Accrual = 10 * PointsScale
+	}
+	s.polls++
+	return nil
+}
+
+func TestOrderStatusHistory(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	defer func(s Synchronizer) { Syncer = s }(Syncer)
+	Syncer = &scriptedServer{script: []string{"REGISTERED", "REGISTERED", "PROCESSING", "PROCESSED"}}
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	_, _, err = datasource.UserRegister(ctx, "test2", "test2_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "2834832929383747", "test1"))
+
+	//	промежуточные статусы сохраняются и видны пользователю
+	wantStatuses := []string{"REGISTERED", "REGISTERED", "PROCESSING", "PROCESSED"}
+	for _, want := range wantStatuses {
+		//	опрашиваем заказ, не дожидаясь срока очередного опроса
+		_, err := d.db.Exec(ctx, `update "sync_jobs" set "run_at" = $1`, time.Now().UTC().Add(-time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+
+		orders, _, err := datasource.GetOrders(ctx, "test1", OrdersFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, want, orders[0].Status)
+	}
+
+	//	в истории записан каждый переход, повтор статуса переходом не считается
+	order, err := datasource.GetOrder(ctx, "test1", "2834832929383747")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	assert.Equal(t, Points(10*PointsScale), order.Accrual)
+	var history []string
+	for _, change := range order.History {
+		history = append(history, change.Status)
+		assert.NotEmpty(t, change.ChangedAt)
+	}
+	assert.Equal(t, []string{"NEW", "REGISTERED", "PROCESSING", "PROCESSED"}, history)
+
+	//	чужой заказ не выдаётся
+	_, err = datasource.GetOrder(ctx, "test2", "2834832929383747")
+	assert.ErrorIs(t, err, ErrNoDataToAnswer)
+	_, err = datasource.GetOrder(ctx, "test1", "12345678903")
+	assert.ErrorIs(t, err, ErrNoDataToAnswer)
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//	ErrInvalidListParams - ошибка возникающая при запросе списка с некорректными параметрами: курсором, статусом или периодом
+var ErrInvalidListParams = errors.New("invalid list parameters")
+
+//	ListParams - параметры постраничной выдачи списка
+//	записи упорядочены по дате и номеру заказа, страница начинается сразу за записью, на которую указывает курсор After
+type ListParams struct {
+	Limit int       //	максимальное количество записей на странице; 0 - без ограничения
+	After string    //	курсор из предыдущей страницы; пустой - с начала списка
+	Desc  bool      //	сортировка от новых записей к старым
+	From  time.Time //	начало периода включительно; нулевое значение - без ограничения
+	To    time.Time //	конец периода, не включая его; нулевое значение - без ограничения
+}
+
+//	OrdersFilter - параметры выборки списка заказов пользователя
+//	используется в методе GetOrders
+type OrdersFilter struct {
+	ListParams
+	Statuses []string //	статусы заказов; пустой список - любые статусы
+}
+
+//	orderStatuses - статусы, в которых может находиться заказ
+var orderStatuses = map[string]bool{"NEW": true, "REGISTERED": true, "PROCESSING": true, "PROCESSED": true, "INVALID": true}
+
+//	validate - метод проверяет параметры выдачи и возвращает позицию, с которой начинается страница
+func (p ListParams) validate() (cursor listCursor, hasCursor bool, err error) {
+	if p.Limit < 0 {
+		return listCursor{}, false, ErrInvalidListParams
+	}
+	if err := p.validatePeriod(); err != nil {
+		return listCursor{}, false, err
+	}
+	if p.After == "" {
+		return listCursor{}, false, nil
+	}
+	cursor, err = decodeCursor(p.After)
+	return cursor, err == nil, err
+}
+
+//	validatePeriod - метод проверяет, что начало периода выдачи предшествует его концу
+func (p ListParams) validatePeriod() error {
+	if !p.From.IsZero() && !p.To.IsZero() && !p.From.Before(p.To) {
+		return ErrInvalidListParams
+	}
+	return nil
+}
+
+//	validate - метод проверяет параметры выборки заказов
+func (f OrdersFilter) validate() (cursor listCursor, hasCursor bool, err error) {
+	for _, status := range f.Statuses {
+		if !orderStatuses[status] {
+			return listCursor{}, false, ErrInvalidListParams
+		}
+	}
+	return f.ListParams.validate()
+}
+
+//	listCursor - позиция в списке: дата и номер заказа последней выданной записи
+type listCursor struct {
+	at  time.Time
+	key string
+}
+
+//	after - метод определяет, идёт ли запись с датой at и номером key после позиции курсора при заданном направлении сортировки
+func (c listCursor) after(at time.Time, key string, desc bool) bool {
+	if !at.Equal(c.at) {
+		return at.After(c.at) != desc
+	}
+	return key != c.key && (key > c.key) != desc
+}
+
+//	encodeCursor - функция формирует непрозрачный для клиента курсор, указывающий на запись с датой at и номером key
+func encodeCursor(at time.Time, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(at.Unix(), 10) + ":" + key))
+}
+
+//	decodeCursor - функция восстанавливает позицию в списке из курсора
+func decodeCursor(cursor string) (listCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return listCursor{}, ErrInvalidListParams
+	}
+	unix, key, found := strings.Cut(string(raw), ":")
+	if !found || key == "" {
+		return listCursor{}, ErrInvalidListParams
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return listCursor{}, ErrInvalidListParams
+	}
+	return listCursor{at: time.Unix(seconds, 0).UTC(), key: key}, nil
+}
+
+//	queryArgs - аргументы SQL запроса, собираемого из необязательных условий
+type queryArgs []interface{}
+
+//	add - метод добавляет аргумент запроса и возвращает его плейсхолдер
+func (a *queryArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+//	page - метод формирует условия выборки страницы по периоду и курсору, а также её сортировку и лимит
+//	atColumn и keyColumn - столбцы даты и номера заказа, по которым упорядочен список и которые покрыты индексом
+//	лимит на единицу больше запрошенного - лишняя запись показывает, что за страницей есть продолжение
+func (a *queryArgs) page(p ListParams, cursor listCursor, hasCursor bool, atColumn, keyColumn string) (conditions []string, tail string) {
+	if !p.From.IsZero() {
+		conditions = append(conditions, atColumn+" >= "+a.add(p.From.UTC()))
+	}
+	if !p.To.IsZero() {
+		conditions = append(conditions, atColumn+" < "+a.add(p.To.UTC()))
+	}
+	compare, direction := ">", "asc"
+	if p.Desc {
+		compare, direction = "<", "desc"
+	}
+	if hasCursor {
+		conditions = append(conditions, "("+atColumn+", "+keyColumn+") "+compare+" ("+a.add(cursor.at)+", "+a.add(cursor.key)+")")
+	}
+	tail = " order by " + atColumn + " " + direction + ", " + keyColumn + " " + direction
+	if p.Limit > 0 {
+		tail += " limit " + a.add(p.Limit+1)
+	}
+	return conditions, tail
+}
+
+//	ordersPage - функция отбрасывает лишнюю запись выборки и формирует курсор следующей страницы
+func ordersPage(orders []Order, limit int) ([]Order, string) {
+	if limit <= 0 || len(orders) <= limit {
+		return orders, ""
+	}
+	orders = orders[:limit]
+	last := orders[limit-1]
+	return orders, encodeCursor(last.UploadedAt, last.Number)
+}
+
+//	withdrawalsPage - функция отбрасывает лишнюю запись выборки и формирует курсор следующей страницы
+func withdrawalsPage(withdrawals []Withdraw, limit int) ([]Withdraw, string) {
+	if limit <= 0 || len(withdrawals) <= limit {
+		return withdrawals, ""
+	}
+	withdrawals = withdrawals[:limit]
+	last := withdrawals[limit-1]
+	return withdrawals, encodeCursor(last.ProcessedAt, last.Order)
+}
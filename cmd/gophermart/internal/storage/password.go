@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//	PasswordHasher - интерфейс алгоритма хеширования паролей пользователей
+//	hash хранится в самоописываемом формате: по его префиксу определяется алгоритм и параметры, с которыми он получен
+//	реализуется алгоритмами argon2id (Argon2idHasher) и bcrypt (BcryptHasher)
+type PasswordHasher interface {
+	Hash(password string) (encoded string, err error)     //	вычисление hash пароля
+	Verify(password, encoded string) (ok bool, err error) //	проверка пароля по hash, сравнение выполняется за постоянное время
+	NeedsRehash(encoded string) bool                      //	нужно ли пересчитать hash с текущими алгоритмом и параметрами
+}
+
+//	рабочий алгоритм хеширования паролей, по умолчанию - argon2id
+var Hasher PasswordHasher = NewArgon2idHasher()
+
+//	NewPasswordHasher - функция конструктор, возвращающая алгоритм хеширования паролей по его названию
+func NewPasswordHasher(name string) (PasswordHasher, error) {
+	switch name {
+	case "", "argon2id":
+		return NewArgon2idHasher(), nil
+	case "bcrypt":
+		return &BcryptHasher{Cost: bcrypt.DefaultCost}, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher: %q", name)
+}
+
+//	ErrUnknownPasswordHash - ошибка возникающая при проверке пароля по hash неизвестного формата
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+//	Argon2idHasher - хеширование паролей алгоритмом argon2id
+//	формат hash: $argon2id$v=19$m=65536,t=1,p=4$<salt base64>$<key base64>
+type Argon2idHasher struct {
+	Memory      uint32 //	объём памяти в KiB
+	Iterations  uint32 //	количество проходов
+	Parallelism uint8  //	количество потоков
+	SaltLength  uint32 //	длина соли в байтах
+	KeyLength   uint32 //	длина ключа в байтах
+}
+
+//	NewArgon2idHasher - функция конструктор argon2id с рекомендованными параметрами
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64 * 1024, Iterations: 1, Parallelism: 4, SaltLength: 16, KeyLength: 32}
+}
+
+//	Hash - метод вычисляет hash пароля со случайной солью
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//	Verify - метод проверяет пароль по hash, параметры вычисления берутся из самого hash
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+//	NeedsRehash - метод сообщает, получен ли hash другим алгоритмом или с другими параметрами
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := parseArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Memory || params.Iterations != h.Iterations || params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength || uint32(len(key)) != h.KeyLength
+}
+
+//	parseArgon2id - функция разбора hash в формате argon2id
+func parseArgon2id(encoded string) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	return params, salt, key, nil
+}
+
+//	BcryptHasher - хеширование паролей алгоритмом bcrypt
+//	формат hash: $2a$<cost>$<salt и ключ>
+type BcryptHasher struct {
+	Cost int //	стоимость вычисления hash
+}
+
+//	Hash - метод вычисляет hash пароля со случайной солью
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hash), err
+}
+
+//	Verify - метод проверяет пароль по hash, bcrypt сравнивает ключи за постоянное время
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//	NeedsRehash - метод сообщает, получен ли hash другим алгоритмом или с другой стоимостью
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+//	legacyHash - функция вычисляет hash пароля в устаревшем формате md5(login + password + login)
+//	используется только для проверки паролей пользователей, зарегистрированных до перехода на PasswordHasher
+func legacyHash(userID, password string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(userID+password+userID)))
+}
+
+//	checkPassword - функция проверяет пароль пользователя по hash из базы данных любого поддерживаемого формата
+//	и сообщает, нужно ли пересчитать hash рабочим алгоритмом Hasher
+func checkPassword(userID, password, encoded string) (ok, rehash bool, err error) {
+	var hasher PasswordHasher
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		hasher = &Argon2idHasher{}
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		hasher = &BcryptHasher{}
+	case len(encoded) == md5.Size*2: //	устаревший формат - hex строка md5, всегда требует пересчёта
+		ok = subtle.ConstantTimeCompare([]byte(encoded), []byte(legacyHash(userID, password))) == 1
+		return ok, ok, nil
+	default:
+		return false, false, ErrUnknownPasswordHash
+	}
+
+	if ok, err = hasher.Verify(password, encoded); err != nil || !ok {
+		return false, false, err
+	}
+
+	return true, Hasher.NeedsRehash(encoded), nil
+}
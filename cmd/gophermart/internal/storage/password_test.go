@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		prefix string
+	}{
+		{name: "argon2id", hasher: NewArgon2idHasher(), prefix: "$argon2id$v=19$m=65536,t=1,p=4$"},
+		{name: "bcrypt", hasher: &BcryptHasher{Cost: bcrypt.MinCost}, prefix: "$2a$04$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.hasher.Hash("test1_password")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(encoded, tt.prefix), encoded)
+
+			//	соль случайная - hash одного пароля каждый раз разный
+			other, err := tt.hasher.Hash("test1_password")
+			require.NoError(t, err)
+			assert.NotEqual(t, encoded, other)
+
+			ok, err := tt.hasher.Verify("test1_password", encoded)
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			ok, err = tt.hasher.Verify("wrong_password", encoded)
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			assert.False(t, tt.hasher.NeedsRehash(encoded))
+		})
+	}
+
+	//	hash другого алгоритма или с другими параметрами требует пересчёта
+	bcryptHash, err := (&BcryptHasher{Cost: bcrypt.MinCost}).Hash("test1_password")
+	require.NoError(t, err)
+	assert.True(t, NewArgon2idHasher().NeedsRehash(bcryptHash))
+	assert.True(t, (&BcryptHasher{Cost: bcrypt.DefaultCost}).NeedsRehash(bcryptHash))
+}
+
+func TestLegacyPasswordRehash(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	//	пользователь, зарегистрированный до перехода на PasswordHasher, с hash в формате md5
+	_, err = d.db.Exec(ctx, `insert into "users" ("login", "password") values ($1, $2)`,
+		"legacy", legacyHash("legacy", "legacy_password"))
+	require.NoError(t, err)
+
+	_, _, err = datasource.UserAuthorise(ctx, "legacy", "wrong_password", SessionMeta{})
+	assert.ErrorIs(t, err, ErrLoginPasswordIsWrong)
+
+	_, _, err = datasource.UserAuthorise(ctx, "legacy", "legacy_password", SessionMeta{})
+	require.NoError(t, err)
+
+	//	после успешного входа hash пересчитан рабочим алгоритмом
+	var encoded string
+	require.NoError(t, d.db.QueryRow(ctx, `select "password" from "users" where "login" = $1`, "legacy").Scan(&encoded))
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$"), encoded)
+
+	//	и по новому hash пользователь по-прежнему входит в систему
+	_, _, err = datasource.UserAuthorise(ctx, "legacy", "legacy_password", SessionMeta{})
+	require.NoError(t, err)
+	_, _, err = datasource.UserAuthorise(ctx, "legacy", "wrong_password", SessionMeta{})
+	assert.ErrorIs(t, err, ErrLoginPasswordIsWrong)
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//	Points - тип для хранения баллов лояльности с фиксированной точностью
+//	значение хранится как целое число сотых долей балла (1 балл = 1 рубль = 100 копеек),
+//	поэтому сложение и вычитание баллов выполняются точно, без накопления ошибок округления float
+//
+//	Правила округления:
+//	-	точность хранения - два знака после запятой (PointsScale);
+//	-	значения с большей точностью округляются до сотых "половина от нуля" (half away from zero):
+//		0.005 -> 0.01, 0.0049 -> 0, -0.005 -> -0.01;
+//	-	округление выполняется один раз - при разборе входящего значения (JSON, строка, значение из БД),
+//		все дальнейшие операции над Points выполняются в целых числах и округления не требуют.
+type Points int64
+
+//	PointsScale - количество сотых долей в одном балле
+const PointsScale = 100
+
+//	ErrInvalidPoints - ошибка возникающая при попытке разобрать некорректное значение количества баллов
+var ErrInvalidPoints = errors.New("invalid points value")
+
+//	maxPointsLength - максимальная длина десятичной записи количества баллов
+//	int64 сотых долей - это не более 17 цифр целой части, остальное - запас на знаки после запятой
+const maxPointsLength = 64
+
+//	ParsePoints - функция разбора десятичной записи количества баллов, например: "100", "89.5", "0.01"
+//	значение округляется до сотых по правилу "половина от нуля"
+func ParsePoints(s string) (Points, error) {
+	s = strings.TrimSpace(s)
+	//	big.Rat допускает дроби "a/b", экспоненту "1e999999", префиксы систем счисления и "_" - для баллов принимаем
+	//	только знак, цифры и десятичную точку: разбор экспоненты большой степени стоит заметного процессорного времени
+	if s == "" || len(s) > maxPointsLength || strings.TrimLeft(strings.TrimLeft(s, "+-"), "0123456789.") != "" ||
+		strings.LastIndexAny(s, "+-") > 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidPoints, s)
+	}
+
+	r, ok := new(big.Rat).SetString(s) //	разбираем десятичную запись без потери точности
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidPoints, s)
+	}
+	r.Mul(r, big.NewRat(PointsScale, 1)) //	переводим значение в сотые доли балла
+
+	//	делим числитель на знаменатель с отбрасыванием дробной части и округляем по остатку
+	num, den := r.Num(), r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(den) >= 0 { //	если остаток не меньше половины - округляем от нуля
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+
+	if !quo.IsInt64() { //	значение не помещается в int64
+		return 0, fmt.Errorf("%w: %q is out of range", ErrInvalidPoints, s)
+	}
+
+	return Points(quo.Int64()), nil
+}
+
+//	String - метод возвращает десятичную запись количества баллов без лишних нулей: "100", "89.5", "0.01"
+func (p Points) String() string {
+	v := int64(p)
+	sign := ""
+	if v < 0 {
+		sign, v = "-", -v
+	}
+
+	whole, frac := v/PointsScale, v%PointsScale
+	if frac == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+
+	return strings.TrimRight(fmt.Sprintf("%s%d.%02d", sign, whole, frac), "0")
+}
+
+//	MarshalJSON - метод кодирует баллы в JSON как число: 89.5
+func (p Points) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+//	UnmarshalJSON - метод разбирает баллы из JSON числа (или строки с числом) с округлением до сотых
+func (p *Points) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" { //	отсутствующее значение оставляем без изменений, как и для встроенных типов
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	v, err := ParsePoints(s)
+	if err != nil {
+		return err
+	}
+	*p = v
+
+	return nil
+}
+
+//	Scan - метод реализует интерфейс sql.Scanner для чтения значений из NUMERIC столбцов базы данных
+func (p *Points) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*p = 0
+		return nil
+	case int64:
+		*p = Points(v * PointsScale)
+		return nil
+	case float64: //	sqlite хранит NUMERIC с дробной частью как REAL - округляем кратчайшую запись числа до сотых
+		return p.scanString(strconv.FormatFloat(v, 'f', -1, 64))
+	case []byte:
+		return p.scanString(string(v))
+	case string:
+		return p.scanString(v)
+	}
+
+	return fmt.Errorf("%w: unsupported type %T", ErrInvalidPoints, src)
+}
+
+//	scanString - вспомогательный метод разбора строкового значения из базы данных
+func (p *Points) scanString(s string) error {
+	v, err := ParsePoints(s)
+	if err != nil {
+		return err
+	}
+	*p = v
+
+	return nil
+}
+
+//	Value - метод реализует интерфейс driver.Valuer - в базу данных баллы передаются точной десятичной строкой
+func (p Points) Value() (driver.Value, error) {
+	return p.String(), nil
+}
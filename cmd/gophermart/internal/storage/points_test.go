@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    Points
+		wantErr bool
+	}{
+		{name: "integer", in: "100", want: 10000},
+		{name: "one decimal", in: "89.5", want: 8950},
+		{name: "two decimals", in: "0.01", want: 1},
+		{name: "round half up", in: "0.005", want: 1},
+		{name: "round down", in: "0.0049", want: 0},
+		{name: "negative round half away from zero", in: "-0.005", want: -1},
+		{name: "float artefact", in: "0.30000000000000004", want: 30},
+		{name: "empty", in: "", wantErr: true},
+		{name: "fraction", in: "1/3", wantErr: true},
+		{name: "garbage", in: "abc", wantErr: true},
+		{name: "out of range", in: "1000000000000000000000000000000", wantErr: true},
+		{name: "exponent", in: "1e2", wantErr: true},
+		{name: "huge exponent", in: "1e999999", wantErr: true},
+		{name: "hex", in: "0x10", wantErr: true},
+		{name: "underscore", in: "1_000", wantErr: true},
+		{name: "sign inside", in: "1-2", wantErr: true},
+		{name: "too long", in: "0." + strings.Repeat("1", 100), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePoints(tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidPoints)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPointsJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Points
+		want string
+	}{
+		{name: "zero", in: 0, want: `0`},
+		{name: "integer", in: 10000, want: `100`},
+		{name: "one decimal", in: 8950, want: `89.5`},
+		{name: "two decimals", in: 1, want: `0.01`},
+		{name: "negative", in: -1050, want: `-10.5`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(tt.in)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(body))
+
+			var back Points
+			require.NoError(t, json.Unmarshal(body, &back))
+			assert.Equal(t, tt.in, back)
+		})
+	}
+}
+
+func TestPointsScan(t *testing.T) {
+	tests := []struct {
+		name string
+		src  interface{}
+		want Points
+	}{
+		{name: "nil", src: nil, want: 0},
+		{name: "int64", src: int64(100), want: 10000},
+		{name: "float64", src: 0.1 + 0.2, want: 30},
+		{name: "bytes", src: []byte("89.50"), want: 8950},
+		{name: "string", src: "11", want: 1100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Points
+			require.NoError(t, p.Scan(tt.src))
+			assert.Equal(t, tt.want, p)
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//	syncMetrics - метрики обмена с сервером начисления бонусных баллов в формате expvar:
+//	requests - количество запросов, throttled - количество ответов 429, rate_limit - действующий лимит запросов в минуту (0 - без лимита)
+//	метрики не публикуются в общем реестре expvar - вместе с ними он выдал бы и cmdline с секретами из флагов запуска
+var syncMetrics = new(expvar.Map)
+
+//	SyncMetrics - функция возвращает метрики обмена с сервером начислений для выдачи администратору
+func SyncMetrics() expvar.Var {
+	return syncMetrics
+}
+
+//	RateLimiter - ограничитель частоты запросов к серверу начислений по алгоритму token bucket
+//	один экземпляр используется всеми обработчиками синхронизации, поэтому лимит соблюдается для сервиса в целом
+type RateLimiter struct {
+	mu          sync.Mutex
+	perMinute   int       //	лимит запросов в минуту, 0 - без лимита
+	burst       float64   //	ёмкость корзины - сколько запросов можно выполнить подряд без пауз
+	tokens      float64   //	доступные запросы; отрицательное значение - запросы, уже ожидающие своей очереди
+	last        time.Time //	время последнего пополнения корзины
+	pausedUntil time.Time //	время, до которого запросы приостановлены по заголовку Retry-After
+}
+
+//	NewRateLimiter - функция конструктор ограничителя на perMinute запросов в минуту с ёмкостью корзины burst
+//	при perMinute = 0 запросы не ограничиваются, пока сервер начислений не сообщит свой лимит
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &RateLimiter{burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	l.SetLimit(perMinute)
+	return l
+}
+
+//	Limit - метод возвращает действующий лимит запросов в минуту
+func (l *RateLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.perMinute
+}
+
+//	SetLimit - метод устанавливает лимит запросов в минуту
+func (l *RateLimiter) SetLimit(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLimit(perMinute)
+}
+
+//	setLimit - метод устанавливает лимит запросов в минуту и публикует его в метриках, вызывается под блокировкой l.mu
+func (l *RateLimiter) setLimit(perMinute int) {
+	if perMinute < 0 {
+		perMinute = 0
+	}
+	l.perMinute = perMinute
+
+	limit := new(expvar.Int)
+	limit.Set(int64(perMinute))
+	syncMetrics.Set("rate_limit", limit)
+}
+
+//	Wait - метод ожидает своей очереди на выполнение запроса, при отмене ctx прекращает ожидание и возвращает ошибку контекста
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	delay := l.reserve(time.Now())
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//	Budget - метод возвращает, сколько запросов ограничитель пропустит за время d начиная с now с учётом паузы по Retry-After
+//	и запросов, уже ожидающих своей очереди; -1 - количество запросов не ограничено
+func (l *RateLimiter) Budget(now time.Time, d time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := now
+	if l.pausedUntil.After(start) { //	во время паузы запросы не выполняются
+		start = l.pausedUntil
+	}
+	available := now.Add(d).Sub(start)
+	if available <= 0 {
+		return 0
+	}
+	if l.perMinute == 0 {
+		return -1
+	}
+
+	rate := float64(l.perMinute) / float64(time.Minute)
+	tokens := l.tokens
+	if start.After(l.last) {
+		tokens += float64(start.Sub(l.last)) * rate
+		if tokens > l.burst {
+			tokens = l.burst
+		}
+	}
+	if budget := tokens + float64(available)*rate; budget > 0 {
+		return int(budget)
+	}
+	return 0
+}
+
+//	reserve - метод занимает место в очереди запросов и возвращает время ожидания этой очереди
+func (l *RateLimiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	start := now
+	if l.pausedUntil.After(start) { //	после ответа 429 запросы не выполняются до окончания паузы
+		start = l.pausedUntil
+	}
+	if l.perMinute == 0 {
+		return start.Sub(now)
+	}
+
+	rate := float64(l.perMinute) / float64(time.Minute) //	скорость пополнения корзины - запросов в наносекунду
+	if start.After(l.last) {
+		l.tokens += float64(start.Sub(l.last)) * rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = start
+	}
+
+	l.tokens--
+	wait := start.Sub(now)
+	if l.tokens < 0 { //	корзина пуста - ждём, пока в ней появится запрос для нас
+		wait += time.Duration(-l.tokens / rate)
+	}
+	return wait
+}
+
+//	Throttle - метод адаптирует ограничитель к ответу 429 сервера начислений:
+//	приостанавливает запросы на retryAfter и, если сервер сообщил лимит perMinute, устанавливает его
+func (l *RateLimiter) Throttle(retryAfter time.Duration, perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	syncMetrics.Add("throttled", 1)
+
+	now := time.Now()
+	if until := now.Add(retryAfter); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	//	запас корзины сбрасываем - после паузы запросы идут равномерно, без всплеска
+	l.tokens = 1
+	if l.last.Before(l.pausedUntil) {
+		l.last = l.pausedUntil
+	}
+	if perMinute > 0 {
+		l.setLimit(perMinute)
+	}
+}
+
+//	параметры паузы после ответа 429 сервера начислений
+const (
+	defaultRetryAfter = 5 * time.Second  //	пауза, если сервер начислений не прислал заголовок Retry-After
+	maxRetryAfter     = 10 * time.Minute //	максимальная пауза - ошибочный Retry-After не должен останавливать опрос надолго
+)
+
+//	parseRetryAfter - функция разбирает заголовок Retry-After: число секунд или дату в формате HTTP
+//	пауза ограничивается maxRetryAfter
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return defaultRetryAfter
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil && seconds >= 0 {
+		if seconds > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := date.Sub(now); wait > maxRetryAfter {
+			return maxRetryAfter
+		} else if wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+//	rateLimitPattern - формат сообщения о лимите запросов в ответе 429 сервера начислений
+var rateLimitPattern = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+//	parseRateLimit - функция извлекает лимит запросов в минуту из тела ответа 429, при отсутствии лимита возвращает 0
+func parseRateLimit(body []byte) int {
+	match := rateLimitPattern.FindSubmatch(body)
+	if match == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(600, 1) //	10 запросов в секунду
+	l.last = now
+
+	//	первый запрос выполняется сразу, следующие - равномерно, по одному в 100 мс
+	for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond} {
+		assert.InDelta(t, float64(want), float64(l.reserve(now)), float64(time.Millisecond), "request %d", i)
+	}
+
+	//	после паузы корзина пополняется, но не больше своей ёмкости
+	later := now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), l.reserve(later))
+	assert.InDelta(t, float64(100*time.Millisecond), float64(l.reserve(later)), float64(time.Millisecond))
+
+	//	без лимита запросы не ждут
+	assert.Equal(t, time.Duration(0), NewRateLimiter(0, 1).reserve(now))
+}
+
+func TestRateLimiterThrottle(t *testing.T) {
+	l := NewRateLimiter(0, 1)
+	l.Throttle(2*time.Second, 60)
+	assert.Equal(t, 60, l.Limit())
+	assert.Equal(t, "60", syncMetrics.Get("rate_limit").String())
+
+	//	до окончания паузы запросы не выполняются, после неё - по одному в секунду
+	now := time.Now()
+	assert.InDelta(t, float64(2*time.Second), float64(l.reserve(now)), float64(50*time.Millisecond))
+	assert.InDelta(t, float64(3*time.Second), float64(l.reserve(now)), float64(50*time.Millisecond))
+
+	//	ответ 429 без лимита в теле сохраняет действующий лимит
+	l.Throttle(0, 0)
+	assert.Equal(t, 60, l.Limit())
+}
+
+func TestRateLimiterBudget(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(30, 1) //	один запрос в 2 секунды
+	l.last = now
+
+	//	за минуту проходит запрос из корзины и ещё 30 по мере её пополнения, без лимита запросы не ограничены
+	assert.Equal(t, 31, l.Budget(now, time.Minute))
+	assert.Equal(t, -1, NewRateLimiter(0, 1).Budget(now, time.Minute))
+
+	//	запросы, уже ожидающие очереди, и пауза по Retry-After уменьшают количество запросов за срок аренды
+	l.reserve(now)
+	l.reserve(now)
+	assert.Equal(t, 29, l.Budget(now, time.Minute))
+	l.Throttle(2*time.Minute, 0)
+	assert.Equal(t, 0, l.Budget(time.Now(), time.Minute))
+}
+
+func TestSyncBatchSize(t *testing.T) {
+	defer func(s Synchronizer, size int) { Syncer, SyncQueueSize = s, size }(Syncer, SyncQueueSize)
+	SyncQueueSize = 100
+
+	//	без ограничения частоты запросов арендуется вся очередь, с ограничением - не больше, чем успеем опросить за срок аренды
+	Syncer = &MOKServer{}
+	assert.Equal(t, 100, syncBatchSize(time.Now()))
+	server := NewBonusServer("http://localhost")
+	Syncer = server
+	assert.Equal(t, 100, syncBatchSize(time.Now()))
+	server.Limiter.SetLimit(10)
+	assert.InDelta(t, 10*SyncLeaseTTL/time.Minute, syncBatchSize(time.Now()), 1)
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	l := NewRateLimiter(0, 1)
+	l.Throttle(time.Hour, 0)
+
+	//	отмена контекста прерывает ожидание очереди
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "60", want: time.Minute},
+		{header: "0", want: 0},
+		{header: "Sat, 01 Jan 2022 00:00:30 GMT", want: 30 * time.Second},
+		{header: "Fri, 31 Dec 2021 00:00:00 GMT", want: 0},
+		{header: "", want: defaultRetryAfter},
+		{header: "soon", want: defaultRetryAfter},
+		{header: "86400", want: maxRetryAfter},
+		{header: "99999999999999999", want: maxRetryAfter},
+		{header: "Sun, 02 Jan 2022 00:00:00 GMT", want: maxRetryAfter},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, parseRetryAfter(tt.header, now), tt.header)
+	}
+
+	assert.Equal(t, 120, parseRateLimit([]byte("No more than 120 requests per minute allowed")))
+	assert.Equal(t, 0, parseRateLimit([]byte("Too Many Requests")))
+}
+
+func TestBonusServerThrottled(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 { //	на первый запрос сервер отвечает, что лимит превышен
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("No more than 6000 requests per minute allowed"))
+			return
+		}
+		w.Write([]byte(`{"order": "1", "status": "PROCESSED", "accrual": 5}`))
+	}))
+	defer ts.Close()
+
+	server := NewBonusServer(ts.URL)
+	var throttled string
+	if v := syncMetrics.Get("throttled"); v != nil {
+		throttled = v.String()
+	}
+
+	order := Order{Number: "1", Status: "NEW"}
+	require.NoError(t, server.SyncOrderStatus(context.Background(), &order))
+	assert.Equal(t, "PROCESSED", order.Status)
+	assert.Equal(t, Points(500), order.Accrual)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	//	ограничитель перешёл на лимит из ответа сервера, ответ 429 учтён в метриках
+	assert.Equal(t, 6000, server.Limiter.Limit())
+	require.NotNil(t, syncMetrics.Get("throttled"))
+	assert.NotEqual(t, throttled, syncMetrics.Get("throttled").String())
+}
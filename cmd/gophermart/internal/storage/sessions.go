@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+//	срок жизни сессии пользователя, по истечении которого сессия перестаёт действовать
+var SessionTTL = 24 * time.Hour
+
+//	SessionMeta - структура с информацией о клиенте, открывающем сессию
+//	используется в методах UserRegister и UserAuthorise
+type SessionMeta struct {
+	UserAgent string //	заголовок User-Agent клиента
+	IP        string //	IP адрес клиента
+}
+
+//	Session - структура для передачи информации о сессиях пользователя
+//	используется в методе GetSessions
+type Session struct {
+	ID         string    `json:"id"`           //  идентификатор сессии - не совпадает с секретным значением cookie
+	CreatedAt  time.Time `json:"created_at"`   //  дата открытия сессии
+	LastSeenAt time.Time `json:"last_seen_at"` //  дата последнего запроса в рамках сессии
+	ExpiresAt  time.Time `json:"expires_at"`   //  дата окончания действия сессии
+	UserAgent  string    `json:"user_agent"`   //  клиент, открывший сессию
+	IP         string    `json:"ip"`           //  IP адрес клиента, открывшего сессию
+	Current    bool      `json:"current"`      //  признак сессии, из которой выполнен запрос
+}
+
+//	tokenHash - функция вычисляет hash секретного значения сессии - в базе хранится только он
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//	createSession - функция открывает новую сессию пользователя в рамках транзакции tx
+//	возвращает секретное значение сессии для cookie и срок его действия
+func createSession(ctx context.Context, tx dbTx, userID string, meta SessionMeta) (token string, expiresAt time.Time, err error) {
+	now := time.Now().UTC().Truncate(time.Second) //	даты хранятся с точностью до секунды, как в ответах API
+	expiresAt = now.Add(SessionTTL)
+	token = newSessionID()
+
+	//	удаляем сессии с истёкшим сроком действия
+	if _, err := tx.Exec(ctx, `delete from "sessions" where "expires_at" < $1`, now); err != nil {
+		return "", time.Time{}, err
+	}
+
+	stmt := `insert into "sessions" ("session_id", "token_hash", "user_id", "created_at", "last_seen_at", "expires_at", "user_agent", "ip")
+		values ($1, $2, (select "id" from "users" where "login" = $3), $4, $4, $5, $6, $7)`
+	_, err = tx.Exec(ctx, stmt, newSessionID(), tokenHash(token), userID, now, expiresAt, meta.UserAgent, meta.IP)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+//	SessionUser - метод возвращает пользователя и идентификатор действующей сессии с секретным значением token,
+//	и отмечает время последнего обращения в рамках сессии; для неизвестной или истёкшей сессии возвращает ErrSessionNotFound
+func (d *Database) SessionUser(ctx context.Context, token string) (userID, sessionID string, err error) {
+	if token == "" {
+		return "", "", ErrSessionNotFound
+	}
+
+	var expiresAt time.Time
+	stmt := `select s."session_id", u."login", s."expires_at" from "sessions" s join "users" u on u."id" = s."user_id" where s."token_hash" = $1`
+	err = d.db.QueryRow(ctx, stmt, tokenHash(token)).Scan(&sessionID, &userID, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrSessionNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if !now.Before(expiresAt) {
+		//	срок действия сессии истёк - удаляем её
+		if _, err := d.db.Exec(ctx, `delete from "sessions" where "session_id" = $1`, sessionID); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrSessionNotFound
+	}
+
+	if _, err := d.db.Exec(ctx, `update "sessions" set "last_seen_at" = $1 where "session_id" = $2`, now, sessionID); err != nil {
+		return "", "", err
+	}
+
+	return userID, sessionID, nil
+}
+
+//	SessionActive - метод проверяет, что сессия sessionID пользователя userID не закрыта и не истекла,
+//	и отмечает время последнего обращения в рамках сессии; для закрытой или истёкшей сессии возвращает ErrSessionNotFound
+//	используется для JWT: токен доступа действует, только пока действует сессия, в рамках которой он выдан
+func (d *Database) SessionActive(ctx context.Context, userID, sessionID string) error {
+	now := time.Now().UTC().Truncate(time.Second)
+	stmt := `update "sessions" set "last_seen_at" = $1
+		where "session_id" = $2 and "user_id" = (select "id" from "users" where "login" = $3) and "expires_at" > $1`
+	n, err := d.db.Exec(ctx, stmt, now, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+//	RefreshSession - метод продлевает действующую сессию по её секретному значению token (refresh token):
+//	сессии выдаётся новое секретное значение, а прежнее перестаёт действовать, поэтому каждый refresh token одноразовый
+func (d *Database) RefreshSession(ctx context.Context, token string) (userID, sessionID, newToken string, expiresAt time.Time, err error) {
+	userID, sessionID, err = d.SessionUser(ctx, token)
+	if err != nil {
+		return "", "", "", time.Time{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	expiresAt = now.Add(SessionTTL)
+	newToken = newSessionID()
+
+	//	заменяем секретное значение только если его не успел заменить параллельный запрос с тем же refresh token
+	stmt := `update "sessions" set "token_hash" = $1, "last_seen_at" = $2, "expires_at" = $3 where "session_id" = $4 and "token_hash" = $5`
+	n, err := d.db.Exec(ctx, stmt, tokenHash(newToken), now, expiresAt, sessionID, tokenHash(token))
+	if err != nil {
+		return "", "", "", time.Time{}, err
+	}
+	if n == 0 {
+		return "", "", "", time.Time{}, ErrSessionNotFound
+	}
+
+	return userID, sessionID, newToken, expiresAt, nil
+}
+
+//	UserLogout - метод закрывает сессию sessionID пользователя userID
+func (d *Database) UserLogout(ctx context.Context, userID, sessionID string) error {
+	stmt := `delete from "sessions" where "session_id" = $1 and "user_id" = (select "id" from "users" where "login" = $2)`
+	n, err := d.db.Exec(ctx, stmt, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+//	GetSessions - метод возвращает список действующих сессий пользователя userID, сессия sessionID отмечается как текущая
+func (d *Database) GetSessions(ctx context.Context, userID, sessionID string) ([]Session, error) {
+	stmt := `select "session_id", "created_at", "last_seen_at", "expires_at", "user_agent", "ip" from "sessions"
+		where "user_id" = (select "id" from "users" where "login" = $1) and "expires_at" >= $2 order by "created_at"`
+	rows, err := d.db.Query(ctx, stmt, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	//	перебираем все строки выборки, добавляя записи session в исходящий срез sessions
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.UserAgent, &s.IP); err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == sessionID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(sessions) == 0 { //	если действующих сессий нет
+		return nil, ErrNoDataToAnswer
+	}
+
+	return sessions, nil
+}
+
+//	DeleteSession - метод закрывает сессию id пользователя userID
+func (d *Database) DeleteSession(ctx context.Context, userID, id string) error {
+	//	закрыть можно только собственную сессию пользователя
+	stmt := `delete from "sessions" where "session_id" = $1 and "user_id" = (select "id" from "users" where "login" = $2)`
+	n, err := d.db.Exec(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoDataToAnswer
+	}
+
+	return nil
+}
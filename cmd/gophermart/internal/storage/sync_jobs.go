@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+//	статусы заданий синхронизации заказов с сервером начисления бонусных баллов
+const (
+	syncJobPending = "PENDING" //	задание ожидает очередного опроса заказа
+	syncJobDead    = "DEAD"    //	опрос заказа SyncMaxFailures раз подряд завершился ошибкой по самому заказу - задание больше не опрашивается
+)
+
+//	errSyncLeaseLost - аренда задания истекла и его забрал другой обработчик - результат опроса не сохраняется
+var errSyncLeaseLost = errors.New("sync job lease is lost")
+
+//	syncJob - задание синхронизации заказа, арендованное обработчиком
+type syncJob struct {
+	order    Order  //	заказ в том виде, в котором он хранится в базе до опроса
+	userID   string //	владелец заказа - для проводки начисления по журналу баллов
+	attempts int    //	количество уже выполненных опросов - для расчёта срока следующего опроса
+	failures int    //	количество неудачных опросов подряд
+}
+
+//	enqueueSyncJob - функция ставит заказ order в очередь синхронизации в рамках транзакции tx
+//	задание создаётся в одной транзакции с заказом, поэтому заказ не может остаться без опроса
+func enqueueSyncJob(ctx context.Context, tx dbTx, order string, now time.Time) error {
+	stmt := `insert into "sync_jobs" ("order", "status", "run_at", "created_at") values ($1, '` + syncJobPending + `', $2, $2)`
+	_, err := tx.Exec(ctx, stmt, order, now)
+	return err
+}
+
+//	leaseSyncJobs - метод арендует не более syncBatchSize заданий, срок опроса которых наступил, на срок SyncLeaseTTL
+//	задания, уже арендованные другим обработчиком - в том числе другим экземпляром сервера с той же базой, - пропускаются
+//	до истечения срока их аренды; результат опроса сохраняется только под действующей арендой (см. ackSyncJob),
+//	поэтому даже после истечения аренды результат по заказу фиксирует ровно один обработчик
+func (d *Database) leaseSyncJobs(ctx context.Context, now time.Time) (leaseID string, jobs []syncJob, err error) {
+	leaseID = newSessionID()
+
+	//	строки, заблокированные параллельной арендой, подзапрос пропускает; условие аренды повторяется во внешнем запросе,
+	//	так как в PostgreSQL оно перепроверяется по строке, обновлённой параллельной транзакцией, и задание не арендуется дважды
+	stmt := `update "sync_jobs" set "lease_id" = $1, "locked_until" = $2
+		where "order" in (select "order" from "sync_jobs"
+			where "status" = '` + syncJobPending + `' and "run_at" <= $3 and ("locked_until" is null or "locked_until" <= $3)
+			order by "run_at" limit $4` + d.skipLocked() + `)
+		and "status" = '` + syncJobPending + `' and ("locked_until" is null or "locked_until" <= $3)`
+	if _, err = d.db.Exec(ctx, stmt, leaseID, now.Add(SyncLeaseTTL), now, syncBatchSize(now)); err != nil {
+		return "", nil, err
+	}
+
+	stmt = `select o."order", o."status", u."login", j."attempts", j."failures"
+		from "sync_jobs" j join "orders" o on o."order" = j."order" join "users" u on u."id" = o."user_id"
+		where j."lease_id" = $1 order by j."run_at"`
+	rows, err := d.db.Query(ctx, stmt, leaseID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() { //	перебираем все строки выборки
+		var job syncJob
+		if err := rows.Scan(&job.order.Number, &job.order.Status, &job.userID, &job.attempts, &job.failures); err != nil {
+			return "", nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	return leaseID, jobs, rows.Err()
+}
+
+//	renewSyncJob - метод продлевает аренду задания по заказу order на срок SyncLeaseTTL от now перед его опросом:
+//	ожидание в очереди запросов к серверу начислений может занять больше срока аренды, выданного в начале цикла
+//	если аренда уже истекла и задание забрал другой обработчик, метод возвращает errSyncLeaseLost
+func (d *Database) renewSyncJob(ctx context.Context, leaseID, order string, now time.Time) error {
+	n, err := d.db.Exec(ctx, `update "sync_jobs" set "locked_until" = $1 where "order" = $2 and "lease_id" = $3`, now.Add(SyncLeaseTTL), order, leaseID)
+	return checkSyncLease(n, err)
+}
+
+//	ackSyncJob - метод сохраняет результат опроса заказа order по заданию job, арендованному под leaseID, в отдельной транзакции:
+//	при недоступности сервера начислений (ErrAccrualUnavailable) задание просто переносится на потом,
+//	при ошибке опроса самого заказа - переносится или, после SyncMaxFailures ошибок подряд, переходит в статус DEAD;
+//	заказ в финальном статусе обновляется и его задание удаляется, иначе задание переносится на следующий опрос
+func (d *Database) ackSyncJob(ctx context.Context, leaseID string, job syncJob, order Order, syncErr error, now time.Time) error {
+	tx, err := d.db.Begin(ctx) //	начинаем транзакцию
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) //	при ошибке выполнения - откатываем транзакцию
+
+	if errors.Is(syncErr, ErrAccrualUnavailable) {
+		//	сервер начислений недоступен - ошибка не относится к заказу: опрос повторяется с растущей паузой,
+		//	но не засчитывается в неудачные, и задание не переходит в статус DEAD
+		attempts := job.attempts + 1
+		stmt := `update "sync_jobs" set "attempts" = $1, "last_error" = $2, "run_at" = $3, "lease_id" = null, "locked_until" = null
+			where "order" = $4 and "lease_id" = $5`
+		n, err := tx.Exec(ctx, stmt, attempts, syncErr.Error(), now.Add(syncBackoff(attempts)), order.Number, leaseID)
+		if err := checkSyncLease(n, err); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+	if syncErr != nil {
+		failures := job.failures + 1
+		status := syncJobPending
+		if failures >= SyncMaxFailures {
+			status = syncJobDead
+		}
+		stmt := `update "sync_jobs" set "status" = $1, "failures" = $2, "last_error" = $3, "run_at" = $4, "lease_id" = null, "locked_until" = null
+			where "order" = $5 and "lease_id" = $6`
+		n, err := tx.Exec(ctx, stmt, status, failures, syncErr.Error(), now.Add(syncBackoff(failures)), order.Number, leaseID)
+		if err := checkSyncLease(n, err); err != nil {
+			return err
+		}
+		if status == syncJobDead {
+			log.Println("sync job for order", order.Number, "is dead after", failures, "failures:", syncErr.Error())
+		}
+		return tx.Commit(ctx)
+	}
+
+	if order.Status != "PROCESSED" && order.Status != "INVALID" {
+		//	расчёт по заказу ещё не завершён - переносим задание на следующий опрос
+		attempts := job.attempts + 1
+		stmt := `update "sync_jobs" set "attempts" = $1, "failures" = 0, "last_error" = '', "run_at" = $2, "lease_id" = null, "locked_until" = null
+			where "order" = $3 and "lease_id" = $4`
+		n, err := tx.Exec(ctx, stmt, attempts, now.Add(syncBackoff(attempts)), order.Number, leaseID)
+		if err := checkSyncLease(n, err); err != nil {
+			return err
+		}
+
+		//	обновляем только поля, которыми владеет сервер начислений, - статус и дату его смены
+		//	в sqlite параметры $N нумеруются в порядке их появления в запросе - поэтому номера идут по возрастанию
+		n, err = tx.Exec(ctx, `update "orders" set
+			"status_changed_at" = case when "status" = $1 then "status_changed_at" else $2 end, "status" = $1
+			where "order" = $3 and "status" <> 'PROCESSED'`, order.Status, now, order.Number)
+		if err != nil {
+			return err
+		}
+		if err := recordStatusChange(ctx, tx, n, order.Number, job.order.Status, order.Status, now); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	//	заказ перешёл в финальный статус - задание выполнено и удаляется из очереди
+	n, err := tx.Exec(ctx, `delete from "sync_jobs" where "order" = $1 and "lease_id" = $2`, order.Number, leaseID)
+	if err := checkSyncLease(n, err); err != nil {
+		return err
+	}
+
+	//	заказ в финальном статусе PROCESSED не обновляется повторно - так начисление по нему проводится ровно один раз
+	n, err = tx.Exec(ctx, `update "orders" set
+		"status_changed_at" = case when "status" = $1 then "status_changed_at" else $2 end,
+		"status" = $1, "processed_at" = $2, "accrual" = $3
+		where "order" = $4 and "status" <> 'PROCESSED'`, order.Status, now, order.Accrual, order.Number)
+	if err != nil {
+		return err
+	}
+	if err := recordStatusChange(ctx, tx, n, order.Number, job.order.Status, order.Status, now); err != nil {
+		return err
+	}
+
+	//	если заказ перешёл в статус PROCESSED с ненулевым начислением - проводим начисление по журналу баллов
+	if order.Status == "PROCESSED" && order.Accrual != 0 {
+		if n > 0 {
+			if err := postLedger(ctx, tx, job.userID, LedgerAccrual, AccountAccrual, order.Number, order.Accrual); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit(ctx) //	фиксируем транзакцию
+}
+
+//	checkSyncLease - функция проверяет, что запрос к заданию, изменивший n строк с ошибкой err, выполнен под действующей арендой
+func checkSyncLease(n int64, err error) error {
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errSyncLeaseLost
+	}
+	return nil
+}
+
+//	UpdateOrdersStatus - метод синхронизации статусов заказов и начисленных баллов с внешним сервисом расчёта бонусных баллов
+//	за один вызов арендуются не более syncBatchSize заданий, срок опроса которых уже наступил;
+//	результат опроса каждого заказа сохраняется отдельно, поэтому ошибка по одному заказу не влияет на остальные
+//	после отмены ctx обработчики завершают опрос уже взятых заказов, а остальные задания освобождаются
+func (d *Database) UpdateOrdersStatus(ctx context.Context) error {
+	if ctx.Err() != nil { //	сервер останавливается - новые задания не арендуем
+		return nil
+	}
+
+	leaseID, jobs, err := d.leaseSyncJobs(ctx, time.Now().UTC().Truncate(time.Second))
+	if err != nil {
+		return err
+	}
+
+	//	если заданий на опрос не нашлось - то завершаем на этом процесс синхронизации
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	orders := make([]Order, len(jobs))
+	for i := range jobs {
+		orders[i] = jobs[i].order
+	}
+
+	//	результаты опроса сохраняются и после отмены ctx - иначе опрошенные при остановке сервера заказы пришлось бы опрашивать повторно
+	saveCtx := context.Background()
+
+	//	синхронизуем статусы и начисления заказов с сервером начисления бонусных баллов и сохраняем результат по каждому заказу
+	claim := func(i int) bool {
+		err := d.renewSyncJob(saveCtx, leaseID, orders[i].Number, time.Now().UTC().Truncate(time.Second))
+		if err != nil {
+			log.Println("sync job for order", orders[i].Number, "is not polled:", err.Error())
+		}
+		return err == nil
+	}
+	syncOrders(ctx, orders, claim, func(i int, syncErr error) {
+		if syncErr != nil {
+			log.Println(syncErr.Error()) //	если при опросе произошла ошибка, то заносим её в журнал
+		}
+		if err := d.ackSyncJob(saveCtx, leaseID, jobs[i], orders[i], syncErr, time.Now().UTC().Truncate(time.Second)); err != nil {
+			log.Println("sync job for order", orders[i].Number, "is not saved:", err.Error())
+		}
+	})
+
+	//	задания, которые не успели опросить до остановки, освобождаем - их подхватит следующий цикл или другой экземпляр сервера
+	_, err = d.db.Exec(saveCtx, `update "sync_jobs" set "lease_id" = null, "locked_until" = null where "lease_id" = $1`, leaseID)
+	return err
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//	poisonServer - эмулятор сервера начислений, опрос заказа poison на котором всегда завершается ошибкой,
+//	а остальные заказы сразу переходят в статус PROCESSED
+type poisonServer struct {
+	mu     sync.Mutex
+	poison string
+	polls  map[string]int
+}
+
+//	SyncOrderStatus - метод возвращает ошибку для заказа poison и начисляет 10 баллов по остальным заказам
+func (s *poisonServer) SyncOrderStatus(ctx context.Context, order *Order) error {
+	s.mu.Lock()
+	s.polls[order.Number]++
+	s.mu.Unlock()
+
+	if order.Number == s.poison {
+		return errors.New("accrual system responded to order " + order.Number + " with status 400")
+	}
+	order.Status = "PROCESSED"
+	order.Accrual = 10 * PointsScale
+	return nil
+}
+
+func TestOrderInsertEnqueuesSyncJob(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "2834832929383747", "test1"))
+
+	//	задание синхронизации создано вместе с заказом
+	var status string
+	var attempts int
+	err = d.db.QueryRow(ctx, `select "status", "attempts" from "sync_jobs" where "order" = $1`, "2834832929383747").Scan(&status, &attempts)
+	require.NoError(t, err)
+	assert.Equal(t, syncJobPending, status)
+	assert.Equal(t, 0, attempts)
+
+	//	повторная загрузка заказа не создаёт второго задания
+	assert.ErrorIs(t, datasource.OrderInsert(ctx, "2834832929383747", "test1"), ErrOrderExistToAccount)
+
+	//	после перехода заказа в финальный статус задание удаляется
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	var jobs int
+	require.NoError(t, d.db.QueryRow(ctx, `select count(*) from "sync_jobs"`).Scan(&jobs))
+	assert.Equal(t, 0, jobs)
+}
+
+func TestSyncJobDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	defer func(s Synchronizer, failures int, backoff time.Duration) {
+		Syncer, SyncMaxFailures, SyncBackoffMin = s, failures, backoff
+	}(Syncer, SyncMaxFailures, SyncBackoffMin)
+	server := &poisonServer{poison: "poison", polls: make(map[string]int)}
+	Syncer, SyncMaxFailures, SyncBackoffMin = server, 2, 0 //	без паузы - каждый цикл опрашивает задания снова
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "order1", "test1"))
+	require.NoError(t, datasource.OrderInsert(ctx, "poison", "test1"))
+	require.NoError(t, datasource.OrderInsert(ctx, "order2", "test1"))
+
+	//	ошибка опроса одного заказа не мешает сохранить результат по остальным
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	current, _, _, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(20*PointsScale), current)
+
+	var status, lastError string
+	var failures int
+	stmt := `select "status", "failures", "last_error" from "sync_jobs" where "order" = $1`
+	require.NoError(t, d.db.QueryRow(ctx, stmt, "poison").Scan(&status, &failures, &lastError))
+	assert.Equal(t, syncJobPending, status)
+	assert.Equal(t, 1, failures)
+	assert.Contains(t, lastError, "status 400")
+
+	//	после SyncMaxFailures ошибок подряд задание переходит в статус DEAD и больше не опрашивается
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	require.NoError(t, d.db.QueryRow(ctx, stmt, "poison").Scan(&status, &failures, &lastError))
+	assert.Equal(t, syncJobDead, status)
+	assert.Equal(t, 2, failures)
+
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	assert.Equal(t, map[string]int{"order1": 1, "order2": 1, "poison": 2}, server.polls)
+
+	//	заказ задания в статусе DEAD остаётся в своём статусе
+	orders, _, err := datasource.GetOrders(ctx, "test1", OrdersFilter{})
+	require.NoError(t, err)
+	for _, order := range orders {
+		if order.Number == "poison" {
+			assert.Equal(t, "NEW", order.Status)
+		}
+	}
+}
+
+//	outageServer - эмулятор сервера начислений, недоступного до отключения флага down
+type outageServer struct {
+	down bool
+}
+
+//	SyncOrderStatus - метод возвращает ErrAccrualUnavailable, пока сервер недоступен, а затем начисляет 10 баллов
+func (s *outageServer) SyncOrderStatus(ctx context.Context, order *Order) error {
+	if s.down {
+		return fmt.Errorf("%w: responded to order %s with status 503", ErrAccrualUnavailable, order.Number)
+	}
+	order.Status = "PROCESSED"
+	order.Accrual = 10 * PointsScale
+	return nil
+}
+
+func TestSyncJobAccrualUnavailable(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	defer func(s Synchronizer, failures int, backoff time.Duration) {
+		Syncer, SyncMaxFailures, SyncBackoffMin = s, failures, backoff
+	}(Syncer, SyncMaxFailures, SyncBackoffMin)
+	server := &outageServer{down: true}
+	Syncer, SyncMaxFailures, SyncBackoffMin = server, 2, 0 //	без паузы - каждый цикл опрашивает задания снова
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "order1", "test1"))
+
+	//	недоступность сервера начислений не засчитывается заказу - задание не переходит в статус DEAD
+	for i := 0; i < 2*SyncMaxFailures; i++ {
+		require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	}
+	var status, lastError string
+	var attempts, failures int
+	stmt := `select "status", "attempts", "failures", "last_error" from "sync_jobs" where "order" = $1`
+	require.NoError(t, d.db.QueryRow(ctx, stmt, "order1").Scan(&status, &attempts, &failures, &lastError))
+	assert.Equal(t, syncJobPending, status)
+	assert.Equal(t, 4, attempts)
+	assert.Equal(t, 0, failures)
+	assert.Contains(t, lastError, "status 503")
+
+	//	после восстановления сервера начислений заказ обрабатывается
+	server.down = false
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	current, _, _, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(10*PointsScale), current)
+}
+
+func TestSyncJobLease(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "order1", "test1"))
+
+	//	арендованное задание не выдаётся другому обработчику до истечения срока аренды
+	now := time.Now().UTC().Truncate(time.Second)
+	leaseID, jobs, err := d.leaseSyncJobs(ctx, now)
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "order1", jobs[0].order.Number)
+	assert.Equal(t, "test1", jobs[0].userID)
+
+	_, others, err := d.leaseSyncJobs(ctx, now)
+	require.NoError(t, err)
+	assert.Empty(t, others)
+
+	//	после истечения аренды задание забирает другой обработчик, а результат первого не сохраняется
+	expiredID, expired, err := d.leaseSyncJobs(ctx, now.Add(SyncLeaseTTL))
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+
+	//	потерянную аренду продлить нельзя, а продлённая перед опросом аренда действует дольше срока, выданного при аренде
+	assert.ErrorIs(t, d.renewSyncJob(ctx, leaseID, "order1", now), errSyncLeaseLost)
+	require.NoError(t, d.renewSyncJob(ctx, expiredID, "order1", now.Add(SyncLeaseTTL)))
+	_, others, err = d.leaseSyncJobs(ctx, now.Add(2*SyncLeaseTTL-time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, others)
+
+	order := Order{Number: "order1", Status: "PROCESSED", Accrual: 10 * PointsScale}
+	assert.ErrorIs(t, d.ackSyncJob(ctx, leaseID, jobs[0], order, nil, now), errSyncLeaseLost)
+	require.NoError(t, d.ackSyncJob(ctx, expiredID, expired[0], order, nil, now))
+
+	current, _, _, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, Points(10*PointsScale), current)
+}
+
+//	TestUpdateOrdersStatusConcurrent - несколько экземпляров сервера с общим хранилищем одновременно синхронизируют заказы
+//	в sqlite транзакции записи выполняются строго по очереди, поэтому там проверяется только условие аренды по lease_id
+//	и locked_until у отдельных пулов соединений с одним файлом базы; пропуск заблокированных строк (SKIP LOCKED)
+//	параллельными транзакциями проверяется только на PostgreSQL - при заданной переменной окружения TEST_DATABASE_URI
+func TestUpdateOrdersStatusConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	defer func(s Synchronizer, queue int, backoff time.Duration) {
+		Syncer, SyncQueueSize, SyncBackoffMin = s, queue, backoff
+	}(Syncer, SyncQueueSize, SyncBackoffMin)
+
+	for name, dsn := range conformanceBackends(t) {
+		name, dsn := name, dsn
+		t.Run(name, func(t *testing.T) {
+			//	у каждого экземпляра сервера - свой пул соединений с общей базой; хранилища в памяти процесса экземпляры делят
+			var replicas []Datasource
+			switch name {
+			case "memory", "sqlite memory":
+				datasource := openConformance(t, name, dsn)
+				replicas = []Datasource{datasource, datasource, datasource, datasource}
+			case "sqlite file":
+				dsn = sqliteScheme + filepath.Join(t.TempDir(), "gophermart.db")
+			default:
+				replicas = append(replicas, openConformance(t, name, dsn)) //	база очищается перед сценарием
+			}
+			for len(replicas) < 4 {
+				replica, err := NewDatasource(dsn, "")
+				require.NoError(t, err)
+				t.Cleanup(replica.Close)
+				replicas = append(replicas, replica)
+			}
+			datasource := replicas[0]
+
+			//	NewDatasource выбирает сервер начислений - эмулятор подставляем после открытия всех экземпляров
+			server := &pendingServer{polls: make(map[string]int)}
+			Syncer, SyncQueueSize, SyncBackoffMin = server, 5, time.Minute
+
+			_, _, err := datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+			require.NoError(t, err)
+			for i := 0; i < 10; i++ {
+				require.NoError(t, datasource.OrderInsert(ctx, "order"+strings.Repeat("0", i), "test1"))
+			}
+
+			//	циклы синхронизации нескольких экземпляров сервера идут одновременно - каждый заказ опрашивает ровно один из них
+			var wg sync.WaitGroup
+			for _, replica := range replicas {
+				wg.Add(1)
+				go func(replica Datasource) {
+					defer wg.Done()
+					assert.NoError(t, replica.UpdateOrdersStatus(ctx))
+				}(replica)
+			}
+			wg.Wait()
+
+			assert.Len(t, server.polls, 10)
+			for number, polls := range server.polls {
+				assert.Equal(t, 1, polls, number)
+			}
+		})
+	}
+}
+
+//	cancelServer - эмулятор сервера начислений, отменяющий контекст синхронизации при первом опросе
+type cancelServer struct {
+	cancel context.CancelFunc
+	polls  []string
+}
+
+//	SyncOrderStatus - метод отменяет контекст и переводит заказ в статус PROCESSED
+func (s *cancelServer) SyncOrderStatus(ctx context.Context, order *Order) error {
+	s.cancel()
+	s.polls = append(s.polls, order.Number)
+	order.Status = "PROCESSED"
+	return nil
+}
+
+func TestUpdateOrdersStatusStops(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	syncCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer func(s Synchronizer, workers int) { Syncer, SyncWorkers = s, workers }(Syncer, SyncWorkers)
+	server := &cancelServer{cancel: cancel}
+	Syncer, SyncWorkers = server, 1
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	for _, number := range []string{"order1", "order2", "order3"} {
+		require.NoError(t, datasource.OrderInsert(ctx, number, "test1"))
+	}
+
+	//	при остановке опрос уже взятого заказа завершается и фиксируется, остальные задания освобождаются
+	require.NoError(t, datasource.UpdateOrdersStatus(syncCtx))
+	require.Len(t, server.polls, 1)
+
+	var jobs int
+	require.NoError(t, d.db.QueryRow(ctx, `select count(*) from "sync_jobs" where "lease_id" is null and "status" = $1`, syncJobPending).Scan(&jobs))
+	assert.Equal(t, 2, jobs)
+	order, err := datasource.GetOrder(ctx, "test1", server.polls[0])
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+
+	//	после отмены новые задания не арендуются, а освобождённые подхватывает следующий цикл
+	require.NoError(t, datasource.UpdateOrdersStatus(syncCtx))
+	assert.Len(t, server.polls, 1)
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	assert.Len(t, server.polls, 3)
+}
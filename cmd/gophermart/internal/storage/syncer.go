@@ -1,85 +1,205 @@
 package storage
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"encoding/json"
 	"github.com/go-resty/resty/v2"
 )
 
+//	параметры синхронизации заказов с сервером начисления бонусных баллов
+var (
+	SyncWorkers     = 4                //	количество обработчиков, параллельно опрашивающих сервер начислений
+	SyncQueueSize   = 100              //	максимальное количество заказов, отбираемых на опрос за один цикл синхронизации
+	SyncBackoffMin  = time.Second      //	пауза перед повторным опросом заказа после первого опроса
+	SyncBackoffMax  = 10 * time.Minute //	максимальная пауза между опросами одного заказа
+	SyncRateLimit   = 0                //	начальный лимит запросов в минуту к серверу начислений, 0 - до первого ответа 429 без лимита
+	SyncMaxFailures = 10               //	количество ошибок опроса заказа подряд (кроме ErrAccrualUnavailable), после которого задание переходит в статус DEAD
+	SyncLeaseTTL    = time.Minute      //	срок аренды задания синхронизации, продлеваемой перед опросом заказа, - после него задание может забрать другой обработчик
+)
+
+//	ErrAccrualUnavailable - ошибка временной недоступности сервера начислений: сетевая ошибка, ответ 5xx или 408, ограничение частоты запросов
+//	такие ошибки не говорят ничего о самом заказе, поэтому опрос повторяется без ограничения количества попыток
+//	и задание не переходит в статус DEAD - иначе обычный сбой сервера начислений остановил бы опрос всех заказов
+var ErrAccrualUnavailable = errors.New("accrual system is unavailable")
+
+//	параметры запросов к серверу начислений
+const (
+	syncMaxThrottled   = 3                //	количество ответов 429 подряд, после которого опрос заказа переносится на следующий цикл
+	syncRequestTimeout = 30 * time.Second //	время ожидания ответа сервера начислений на один запрос
+)
+
+//	syncBackoff - функция вычисляет паузу перед следующим опросом заказа, уже опрошенного attempts раз:
+//	пауза удваивается с каждым опросом, поэтому свежие заказы опрашиваются часто, а давно зависшие - редко
+func syncBackoff(attempts int) time.Duration {
+	backoff := SyncBackoffMin
+	for i := 1; i < attempts && backoff < SyncBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > SyncBackoffMax {
+		backoff = SyncBackoffMax
+	}
+	return backoff
+}
+
+//	syncBudget - сервер начислений, ограничивающий частоту запросов к себе
+type syncBudget interface {
+	Budget(now time.Time, d time.Duration) int //	сколько запросов можно выполнить за время d начиная с now, -1 - без ограничения
+}
+
+//	syncBatchSize - функция возвращает, сколько заданий можно арендовать в момент now: не больше SyncQueueSize
+//	и не больше, чем ограничитель запросов к серверу начислений пропустит за срок аренды SyncLeaseTTL, -
+//	иначе аренда истекала бы посреди цикла и задания опрашивал бы повторно другой экземпляр сервера
+func syncBatchSize(now time.Time) int {
+	size := SyncQueueSize
+	if server, ok := Syncer.(syncBudget); ok {
+		if budget := server.Budget(now, SyncLeaseTTL); budget >= 0 && budget < size {
+			size = budget
+		}
+	}
+	return size
+}
+
+//	syncOrders - функция синхронизирует заказы orders с сервером начисления бонусных баллов пулом из SyncWorkers обработчиков
+//	перед опросом заказа обработчик вызывает claim - продление аренды задания; если аренда потеряна, заказ не опрашивается
+//	по завершении опроса каждого заказа обработчик вызывает done с индексом заказа и ошибкой опроса
+//	после отмены ctx обработчики прерывают начатые запросы и не берут новые заказы из очереди - done для них не вызывается
+func syncOrders(ctx context.Context, orders []Order, claim func(i int) bool, done func(i int, err error)) {
+	queue := make(chan int, len(orders)) //	очередь ограничена размером выборки - не более SyncQueueSize заказов
+
+	workers := SyncWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil { //	сервер останавливается - оставшиеся заказы не опрашиваем
+					continue
+				}
+				if !claim(i) { //	задание уже забрал другой обработчик
+					continue
+				}
+				err := Syncer.SyncOrderStatus(ctx, &orders[i])
+				if err != nil && ctx.Err() != nil { //	опрос прерван остановкой сервера - ошибку не фиксируем, заказ опросим позже
+					continue
+				}
+				done(i, err)
+			}
+		}()
+	}
+
+	for i := range orders {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+}
+
 //	BonusServer - сервер начисления бонусных баллов
 type BonusServer struct {
-	AccrualAddress string //	адрес сервера
+	AccrualAddress string        //	адрес сервера
+	Limiter        *RateLimiter  //	ограничитель частоты запросов, общий для всех обработчиков
+	client         *resty.Client //	клиент HTTP, общий для всех обработчиков
+}
+
+//	NewBonusServer - функция конструктор клиента сервера начисления бонусных баллов
+func NewBonusServer(AccrualAddress string) *BonusServer {
+	return &BonusServer{AccrualAddress: AccrualAddress, Limiter: NewRateLimiter(SyncRateLimit, 1), client: resty.New().SetTimeout(syncRequestTimeout)}
+}
+
+//	Budget - метод возвращает, сколько запросов к серверу начислений можно выполнить за время d начиная с now
+func (s *BonusServer) Budget(now time.Time, d time.Duration) int {
+	return s.Limiter.Budget(now, d)
 }
 
-//	SyncOrderStatus - метод синхронизации списка заказов с сервером начисления бонусных баллов
-func (s *BonusServer) SyncOrderStatus(orders []Order) error {
+//	SyncOrderStatus - метод синхронизации заказа с сервером начисления бонусных баллов
+//	отмена ctx прерывает и ожидание очереди запросов, и сам запрос
+func (s *BonusServer) SyncOrderStatus(ctx context.Context, order *Order) error {
 	//	описываем структуру для приема данных о статусе заказа в JSON виде
 	type ordersSync struct {
-		Order   string  `json:"order"`
-		Status  string  `json:"status"`
-		Accrual float32 `json:"accrual,omitempty"`
+		Order   string `json:"order"`
+		Status  string `json:"status"`
+		Accrual Points `json:"accrual,omitempty"`
 	}
 	//	создаём экземпляр этой структуры
 	ordersUpdated := ordersSync{}
 
-	//	создаём клиент HTTP для запросов о статусе заказа в систему начисления баллов
-	client := resty.New()
+	var resp *resty.Response
+	var status int
+	for throttled := 0; ; throttled++ {
+		if throttled == syncMaxThrottled { //	сервер начислений перегружен - переносим опрос заказа
+			return fmt.Errorf("%w: throttling requests for order %s", ErrAccrualUnavailable, order.Number)
+		}
+
+		//	ожидаем своей очереди в рамках лимита запросов к серверу начислений
+		if err := s.Limiter.Wait(ctx); err != nil {
+			return err
+		}
 
-	//	опрашиваем статус всех заказов из списка orders для получения их текущего статуса
-	for i := range orders {
 		//	для запросов в систему начисления баллов используется запрос:
 		//	GET /api/orders/{number} — получение информации о расчёте начислений баллов лояльности
-		resp, err := client.R().Get(s.AccrualAddress + "/api/orders/" + orders[i].Number)
+		var err error
+		resp, err = s.client.R().SetContext(ctx).Get(s.AccrualAddress + "/api/orders/" + order.Number)
+		syncMetrics.Add("requests", 1)
 		if err != nil {
-			return err
+			return fmt.Errorf("%w: %s", ErrAccrualUnavailable, err.Error())
 		}
 
-		status := resp.StatusCode() //	считываем код статуса ответа
-
-		for status == http.StatusTooManyRequests { //	если пришел ответ со статусом 429 - TooManyRequests
-			log.Println("response status - TooManyRequests for sync service")
-			time.Sleep(5 * time.Second) //	если превышен лимит количества запросов в минуту, делаем паузу
-			//	и повторяем запрос с теми же параметрами
-			resp, err := client.R().Get(s.AccrualAddress + "/api/orders/" + orders[i].Number)
-			if err != nil {
-				return err
-			}
-			status = resp.StatusCode() //	считываем код статуса ответа
+		status = resp.StatusCode() //	считываем код статуса ответа
+		if status != http.StatusTooManyRequests {
+			break
 		}
 
-		if status == http.StatusOK { //	если пришел ответ со статусом 200 - ОК
-
-			body := resp.Body() //	считываем тело ответа
-
-			errParsing := json.Unmarshal(body, &ordersUpdated) //	парсим JSON и записываем результат в ordersUpdated
+		//	если пришел ответ со статусом 429 - TooManyRequests, приостанавливаем запросы всех обработчиков
+		//	на время из заголовка Retry-After и переходим на лимит запросов, указанный в теле ответа
+		retryAfter := parseRetryAfter(resp.Header().Get("Retry-After"), time.Now())
+		perMinute := parseRateLimit(resp.Body())
+		log.Println("response status - TooManyRequests for sync service, retry after", retryAfter, "limit per minute", perMinute)
+		s.Limiter.Throttle(retryAfter, perMinute)
+	}
 
-			if errParsing != nil { //				проверяем успешно ли парсится JSON
-				log.Println(errParsing.Error()) //	запишем в лог сообщение об ошибке
-				continue                        //	и продолжаем цикл в новой итерации
-			}
-			//	нас интересуют только заказы перешедшие в финальные статусы - PROCESSED и INVALID
-			//	меняем в списке orders для них статус и сумму начислений - на актуальные значения
-			if ordersUpdated.Status == "PROCESSED" || ordersUpdated.Status == "INVALID" {
-				orders[i].Status = ordersUpdated.Status
-				orders[i].Accrual = ordersUpdated.Accrual
-			}
+	switch status {
+	case http.StatusOK: //	если пришел ответ со статусом 200 - ОК
+		//	парсим JSON и записываем результат в ordersUpdated
+		if err := json.Unmarshal(resp.Body(), &ordersUpdated); err != nil {
+			return err
+		}
+		switch ordersUpdated.Status {
+		case "PROCESSED", "INVALID": //	заказ перешёл в финальный статус - фиксируем статус и сумму начислений
+			order.Status = ordersUpdated.Status
+			order.Accrual = ordersUpdated.Accrual
+		case "REGISTERED", "PROCESSING": //	заказ принят сервером начислений, но расчёт ещё не закончен
+			order.Status = ordersUpdated.Status
 		}
+		return nil
+	case http.StatusNoContent: //	заказ ещё не зарегистрирован в системе расчёта - статус не меняется
+		return nil
 	}
-	return nil //	завершаем процесс синхронизации
+	if status >= http.StatusInternalServerError || status == http.StatusRequestTimeout { //	сбой сервера начислений - повторим позже
+		return fmt.Errorf("%w: responded to order %s with status %d", ErrAccrualUnavailable, order.Number, status)
+	}
+	//	любой другой ответ, как и некорректное тело ответа 200, - ошибка опроса именно этого заказа
+	return fmt.Errorf("accrual system responded to order %s with status %d", order.Number, status)
 }
 
 //	MOKServer - эмулятор сервера начисления бонусных баллов для тестов
 type MOKServer struct{}
 
-//	SyncOrderStatus - метод синхронизации списка заказов с сервером начисления бонусных баллов
-func (s *MOKServer) SyncOrderStatus(orders []Order) error {
-	for i := range orders { //									в эмуляторе все заказы принимаются безусловно
-		orders[i].Status = "PROCESSED"                     //	с переводом их в статус PROCESSED
-		orders[i].Accrual = 100                            //	с начислением 100 баллов
-		orders[i].UploadedAt = "2022-01-01T00:00:00+03:00" //	и датой загрузки заказа - "2022-01-01T00:00:00+03:00"
-	}
-	return nil //	завершаем процесс синхронизации
+//	SyncOrderStatus - метод синхронизации заказа с сервером начисления бонусных баллов
+func (s *MOKServer) SyncOrderStatus(ctx context.Context, order *Order) error {
+	//	в эмуляторе все заказы принимаются безусловно
+	order.Status = "PROCESSED"        //	с переводом их в статус PROCESSED
+	order.Accrual = 100 * PointsScale //	и с начислением 100 баллов
+	return nil                        //	завершаем процесс синхронизации
 }
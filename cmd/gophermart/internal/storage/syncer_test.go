@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncBackoff(t *testing.T) {
+	defer func(min, max time.Duration) { SyncBackoffMin, SyncBackoffMax = min, max }(SyncBackoffMin, SyncBackoffMax)
+	SyncBackoffMin, SyncBackoffMax = time.Second, time.Minute
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 3, want: 4 * time.Second},
+		{attempts: 6, want: 32 * time.Second},
+		{attempts: 7, want: time.Minute},
+		{attempts: 1000, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, syncBackoff(tt.attempts), "attempts: %d", tt.attempts)
+	}
+}
+
+//	pendingServer - эмулятор сервера начислений, у которого расчёт по заказам ещё не завершён
+//	подсчитывает опросы и максимальное количество одновременных запросов
+type pendingServer struct {
+	mu       sync.Mutex
+	polls    map[string]int
+	inFlight int
+	peak     int
+}
+
+//	SyncOrderStatus - метод отвечает статусом PROCESSING на любой заказ
+func (s *pendingServer) SyncOrderStatus(ctx context.Context, order *Order) error {
+	s.mu.Lock()
+	s.polls[order.Number]++
+	s.inFlight++
+	if s.inFlight > s.peak {
+		s.peak = s.inFlight
+	}
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond) //	имитируем задержку сети
+
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+
+	order.Status = "PROCESSING"
+	return nil
+}
+
+func TestUpdateOrdersStatusSchedule(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+	d := datasource.(*Database)
+
+	defer func(s Synchronizer, workers, queue int, backoff time.Duration) {
+		Syncer, SyncWorkers, SyncQueueSize, SyncBackoffMin = s, workers, queue, backoff
+	}(Syncer, SyncWorkers, SyncQueueSize, SyncBackoffMin)
+	server := &pendingServer{polls: make(map[string]int)}
+	Syncer, SyncWorkers, SyncQueueSize, SyncBackoffMin = server, 4, 8, time.Minute
+
+	_, _, err = datasource.UserRegister(ctx, "test1", "test1_password", SessionMeta{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, datasource.OrderInsert(ctx, "order"+strings.Repeat("0", i), "test1"))
+	}
+
+	//	за один цикл опрашивается не больше SyncQueueSize заказов, параллельно несколькими обработчиками
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	assert.Len(t, server.polls, 8)
+	assert.Greater(t, server.peak, 1)
+	assert.LessOrEqual(t, server.peak, 4)
+
+	//	опрошенные заказы перенесены на будущее - следующий цикл опрашивает только оставшиеся
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+	assert.Len(t, server.polls, 10)
+	for number, polls := range server.polls {
+		assert.Equal(t, 1, polls, number)
+	}
+
+	var status string
+	var attempts int
+	var runAt time.Time
+	err = d.db.QueryRow(ctx, `select o."status", j."attempts", j."run_at" from "orders" o join "sync_jobs" j on j."order" = o."order" where o."order" = $1`, "order").Scan(&status, &attempts, &runAt)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSING", status)
+	assert.Equal(t, 1, attempts)
+	assert.WithinDuration(t, time.Now().Add(SyncBackoffMin), runAt, 2*time.Second)
+}
+
+func TestBonusServerSyncOrderStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.TrimPrefix(r.URL.Path, "/api/orders/") {
+		case "1":
+			w.Write([]byte(`{"order": "1", "status": "REGISTERED"}`))
+		case "2":
+			w.Write([]byte(`{"order": "2", "status": "PROCESSED", "accrual": 729.98}`))
+		case "3":
+			w.Write([]byte(`{"order": "3", "status": "INVALID"}`))
+		case "4":
+			w.WriteHeader(http.StatusNoContent)
+		case "6":
+			w.WriteHeader(http.StatusNotFound)
+		case "7":
+			w.Write([]byte(`{"order": "7", "status":`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+	server := NewBonusServer(ts.URL)
+
+	tests := []struct {
+		number  string
+		status  string
+		accrual Points
+		wantErr bool
+		outage  bool //	ошибка - недоступность сервера начислений, а не ошибка по заказу
+	}{
+		{number: "1", status: "REGISTERED"},
+		{number: "2", status: "PROCESSED", accrual: 72998},
+		{number: "3", status: "INVALID"},
+		{number: "4", status: "NEW"},
+		{number: "5", status: "NEW", wantErr: true, outage: true},
+		{number: "6", status: "NEW", wantErr: true},
+		{number: "7", status: "NEW", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.number, func(t *testing.T) {
+			order := Order{Number: tt.number, Status: "NEW"}
+			err := server.SyncOrderStatus(context.Background(), &order)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, tt.outage, errors.Is(err, ErrAccrualUnavailable))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.status, order.Status)
+			assert.Equal(t, tt.accrual, order.Accrual)
+		})
+	}
+}
+
+func TestBonusServerSyncOrderStatusCanceled(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release //	сервер начислений не отвечает
+	}))
+	defer ts.Close()
+	defer close(release)
+	server := NewBonusServer(ts.URL)
+
+	//	остановка сервера прерывает зависший запрос, заказ остаётся в прежнем статусе
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	order := Order{Number: "1", Status: "NEW"}
+	start := time.Now()
+	assert.Error(t, server.SyncOrderStatus(ctx, &order))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, "NEW", order.Status)
+}
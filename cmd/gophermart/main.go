@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/auth"
 	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/handlers"
 	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
 	"log"
@@ -13,32 +16,111 @@ import (
 )
 
 func main() {
+	//	подкоманда gophermart migrate управляет схемой базы данных и не запускает сервер
+	migrate := len(os.Args) > 1 && os.Args[1] == "migrate"
+	if migrate {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	//	конфигурация приложения через считывание флагов и переменных окружения
 	cfg := newConfig()
 
+	//	параметры пула соединений с базой данных - и для сервера, и для миграций
+	storage.DatabaseMaxConns = cfg.DBMaxConns
+	storage.DatabaseMinConns = cfg.DBMinConns
+	storage.DatabaseConnectTimeout = cfg.DBConnTimeout
+	storage.DatabaseHealthCheckPeriod = cfg.DBHealthCheck
+	storage.SQLiteBusyTimeout = cfg.DBBusyTimeout
+
+	if migrate {
+		if err := migrateCommand(cfg, flag.Args(), os.Stdout); err != nil {
+			cfg.ErrorLog.Fatal(err)
+		}
+		return
+	}
+
+	//	выбираем алгоритм хеширования паролей пользователей
+	hasher, err := storage.NewPasswordHasher(cfg.PasswordHasher)
+	if err != nil {
+		cfg.ErrorLog.Fatal(err)
+	}
+	storage.Hasher = hasher
+	storage.SessionTTL = cfg.SessionTTL //	срок жизни сессий пользователей
+
+	//	параметры синхронизации заказов с сервером начислений
+	storage.SyncWorkers = cfg.SyncWorkers
+	storage.SyncQueueSize = cfg.SyncQueueSize
+	storage.SyncBackoffMin = cfg.SyncBackoffMin
+	storage.SyncBackoffMax = cfg.SyncBackoffMax
+	storage.SyncRateLimit = cfg.SyncRateLimit
+	storage.SyncMaxFailures = cfg.SyncMaxFailures
+	storage.SyncLeaseTTL = cfg.SyncLeaseTTL
+
 	//	инициализируем источники данных нашего сервера
 	datasource, err := storage.NewDatasource(cfg.DatabaseDSN, cfg.AccrualAddress)
 	if err != nil {
 		cfg.ErrorLog.Fatal(err)
 	}
-	defer datasource.Close() //	при остановке сервера закроем все источники данных
+
+	//	контекст отменяется при получении сигнала на останов сервера
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	err = run(ctx, cfg, datasource)
+	//	источники данных закрываем последними - после завершения обработки запросов и синхронизации
+	datasource.Close()
+	if err != nil {
+		cfg.ErrorLog.Fatal(err)
+	}
+	log.Println("SERVER Gophermart SHUTDOWN (code 0)")
+}
+
+//	run - функция запускает сервер и синхронизацию заказов в режиме cfg.RunMode и работает до отмены ctx,
+//	после чего дожидается завершения запросов и текущего цикла синхронизации, каждого - в пределах cfg.ShutdownTimeout
+func run(ctx context.Context, cfg Config, datasource storage.Datasource) error {
+	//	собираем ключи подписи JWT - если ключи не заданы, авторизация возможна только по cookie
+	tokens, err := auth.NewIssuer(cfg.JWTKeys, cfg.JWTSigningKey, cfg.JWTAccessTTL)
+	if err != nil {
+		return err
+	}
 
 	//	инициализируем контекст нашего приложения
 	app := &handlers.Application{
-		ErrorLog:   cfg.ErrorLog, //	журнал ошибок
-		InfoLog:    cfg.InfoLog,  //	журнал информационных сообщений
-		Datasource: datasource,   //	источник данных для хранения информации о заказах
+		ErrorLog:       cfg.ErrorLog,       //	журнал ошибок
+		InfoLog:        cfg.InfoLog,        //	журнал информационных сообщений
+		Datasource:     datasource,         //	источник данных для хранения информации о заказах
+		IdempotencyTTL: cfg.IdempotencyTTL, //	срок хранения ответов по ключам идемпотентности
+		Tokens:         tokens,             //	выпуск и проверка JWT
+		AdminToken:     cfg.AdminToken,     //	токен доступа к административным маршрутам
+		HoldTTL:        cfg.HoldTTL,        //	срок действия резерва баллов
 	}
 
-	//	создаем контекст для остановки служебных процессов по сигналу
-	ctx, cancel := context.WithCancel(context.Background())
+	//	синхронизация останавливается и при остановке сервера, и при ошибке его запуска
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	//	запускаем процесс синхронизации информации о заказах с внешней системой расчёта баллов
-	go statusSyncer(app, ctx)
-
-	//	запускаем процесс слежение за сигналами на останов сервера
-	go termSignal(cancel)
+	//	и возврат в доступный остаток резервов с истёкшим сроком - обе фоновые задачи работают вне режима api
+	syncDone := make(chan struct{})
+	if cfg.RunMode == runModeAPI {
+		close(syncDone)
+	} else {
+		holdsDone := make(chan struct{})
+		go func() {
+			defer close(holdsDone)
+			holdsReleaser(app, ctx, cfg.HoldInterval)
+		}()
+		go func() {
+			defer close(syncDone)
+			statusSyncer(app, ctx, cfg.SyncBackoffMin)
+			<-holdsDone
+		}()
+	}
+	if cfg.RunMode == runModeSync { //	экземпляр только синхронизирует заказы - HTTP API не запускаем
+		<-ctx.Done()
+		waitSync(app, syncDone, cfg.ShutdownTimeout)
+		return nil
+	}
 
 	//	запуск сервера
 	srv := &http.Server{
@@ -46,15 +128,50 @@ func main() {
 		ErrorLog: cfg.ErrorLog,
 		Handler:  app.Routes(),
 	}
-	cfg.ErrorLog.Fatal(srv.ListenAndServe())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serveErr: //	сервер не запустился
+		cancel()
+	case <-ctx.Done(): //	при подаче сигнала на останов сервера новые соединения не принимаем, а начатые запросы дообрабатываем
+		app.InfoLog.Println("Server is shutting down")
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancelShutdown()
+		if err = srv.Shutdown(shutdownCtx); err != nil {
+			srv.Close() //	запросы, не завершившиеся за отведённое время, прерываем
+		}
+	}
+
+	waitSync(app, syncDone, cfg.ShutdownTimeout) //	дожидаемся сохранения результатов текущего цикла синхронизации
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+//	waitSync - функция дожидается завершения фоновых задач не дольше timeout:
+//	запросы к серверу начислений прерываются при остановке, поэтому превышение timeout - признак зависшей задачи,
+//	и остановку сервера она не задерживает
+func waitSync(app *handlers.Application, syncDone <-chan struct{}, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-syncDone:
+	case <-timer.C:
+		app.ErrorLog.Println("background sync is not finished within shutdown timeout", timeout)
+	}
 }
 
 //	 statusSyncer - синхронизатор информации о заказах с внешней системой расчёта баллов
-func statusSyncer(app *handlers.Application, ctx context.Context) {
-	syncTicker := time.NewTicker(10 * time.Second) //	тикер для выдачи сигналов на синхронизацию
+//	каждый цикл опрашивает только заказы, срок очередного опроса которых наступил
+func statusSyncer(app *handlers.Application, ctx context.Context, interval time.Duration) {
+	syncTicker := time.NewTicker(interval) //	тикер для выдачи сигналов на синхронизацию
 	defer syncTicker.Stop()
 	for { //	вызываем обновление статусов для заказов, находящихся у нас в базе НЕ в финальных статусах
-		err := app.Datasource.UpdateOrdersStatus()
+		err := app.Datasource.UpdateOrdersStatus(ctx)
 
 		if err != nil {
 			app.ErrorLog.Println(err.Error()) //	все ошибки пишем в журнал
@@ -70,23 +187,24 @@ func statusSyncer(app *handlers.Application, ctx context.Context) {
 	}
 }
 
-// termSignal - функция слежения за сигналами на останов сервера
-func termSignal(cancel context.CancelFunc) {
-	// сигнальный канал для отслеживания системных вызовов на остановку сервера
-	signalChanel := make(chan os.Signal, 1)
-	signal.Notify(signalChanel,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
-
-	//	запускаем слежение за каналом
+//	holdsReleaser - фоновая задача, возвращающая в доступный остаток резервы баллов с истёкшим сроком
+func holdsReleaser(app *handlers.Application, ctx context.Context, interval time.Duration) {
+	releaseTicker := time.NewTicker(interval)
+	defer releaseTicker.Stop()
 	for {
-		s := <-signalChanel
-		if s == syscall.SIGINT || s == syscall.SIGTERM || s == syscall.SIGQUIT {
-			cancel()
-			time.Sleep(1 * time.Second)
-			log.Println("SERVER Gophermart SHUTDOWN (code 0)")
-			os.Exit(0) //	при получении сигнала, останавливаем сервер
+		released, err := app.Datasource.ReleaseExpiredHolds(ctx)
+
+		if err != nil {
+			app.ErrorLog.Println(err.Error()) //	все ошибки пишем в журнал
+		} else if released > 0 {
+			app.InfoLog.Println("Expired holds released:", released)
+		}
+
+		select {
+		case <-releaseTicker.C:
+
+		case <-ctx.Done(): //	при подаче сигнала на останов сервера, прерываем возврат резервов
+			return
 		}
 	}
 }
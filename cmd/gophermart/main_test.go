@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+)
+
+//	slowDatasource - источник данных, сообщающий о начале списания и выполняющий его с задержкой
+type slowDatasource struct {
+	storage.Datasource
+	started chan struct{}
+}
+
+//	WithdrawRequest - метод сообщает о начале списания и выполняет его с задержкой
+func (d *slowDatasource) WithdrawRequest(ctx context.Context, order string, sum storage.Points, userID string) error {
+	close(d.started)
+	time.Sleep(500 * time.Millisecond)
+	return d.Datasource.WithdrawRequest(ctx, order, sum, userID)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	ctx := context.Background()
+	datasource, err := storage.NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	//	пользователь с начисленными по заказу 100 баллами
+	token, _, err := datasource.UserRegister(ctx, "test1", "test1_password", storage.SessionMeta{})
+	require.NoError(t, err)
+	require.NoError(t, datasource.OrderInsert(ctx, "12345678903", "test1"))
+	require.NoError(t, datasource.UpdateOrdersStatus(ctx))
+
+	//	свободный адрес для запуска сервера
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := ln.Addr().String()
+	ln.Close()
+
+	cfg := Config{
+		ServerAddress:   address,
+		ShutdownTimeout: 5 * time.Second,
+		RunMode:         runModeAll,
+		SyncBackoffMin:  100 * time.Millisecond,
+		HoldInterval:    time.Minute,
+		JWTAccessTTL:    15 * time.Minute,
+		InfoLog:         log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime),
+		ErrorLog:        log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+	slow := &slowDatasource{Datasource: datasource, started: make(chan struct{})}
+
+	serverCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM)
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- run(serverCtx, cfg, slow) }()
+
+	//	ждём запуска сервера
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	//	отправляем заявку на списание и, пока она обрабатывается, подаём сигнал на останов сервера
+	responses := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+address+"/api/user/balance/withdraw", strings.NewReader(`{"order": "2377225624", "sum": 40}`))
+		req.AddCookie(&http.Cookie{Name: "sessionid", Value: token})
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+	<-slow.started
+	require.NoError(t, syscall.Kill(syscall.Getpid(), syscall.SIGTERM))
+
+	//	начатая заявка дообрабатывается, сервер останавливается без ошибок
+	assert.Equal(t, http.StatusOK, <-responses)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(cfg.ShutdownTimeout):
+		t.Fatal("server is not stopped")
+	}
+
+	//	новые соединения после остановки не принимаются
+	_, err = net.Dial("tcp", address)
+	assert.Error(t, err)
+
+	//	списание сохранено
+	current, _, withdrawn, err := datasource.GetBalance(ctx, "test1")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Points(60*storage.PointsScale), current)
+	assert.Equal(t, storage.Points(40*storage.PointsScale), withdrawn)
+	withdrawals, _, err := datasource.GetWithdrawals(ctx, "test1", storage.ListParams{})
+	require.NoError(t, err)
+	require.Len(t, withdrawals, 1)
+	assert.Equal(t, "2377225624", withdrawals[0].Order)
+}
+
+//	stuckDatasource - источник данных, цикл синхронизации которого не завершается
+type stuckDatasource struct {
+	storage.Datasource
+	release chan struct{}
+}
+
+//	UpdateOrdersStatus - метод зависает до закрытия release, не обращая внимания на отмену контекста
+func (d *stuckDatasource) UpdateOrdersStatus(ctx context.Context) error {
+	<-d.release
+	return nil
+}
+
+func TestShutdownSyncTimeout(t *testing.T) {
+	datasource, err := storage.NewDatasource("", "")
+	require.NoError(t, err)
+	defer datasource.Close()
+
+	cfg := Config{
+		ShutdownTimeout: 200 * time.Millisecond,
+		RunMode:         runModeSync,
+		SyncBackoffMin:  time.Minute,
+		HoldInterval:    time.Minute,
+		JWTAccessTTL:    15 * time.Minute,
+		InfoLog:         log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime),
+		ErrorLog:        log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile),
+	}
+	stuck := &stuckDatasource{Datasource: datasource, release: make(chan struct{})}
+	defer close(stuck.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, cfg, stuck) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	//	зависший цикл синхронизации не задерживает остановку дольше cfg.ShutdownTimeout
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server is not stopped")
+	}
+}
+
+func TestMigrateCommandMemoryStore(t *testing.T) {
+	//	у хранилища в оперативной памяти нет схемы - подкоманда migrate отказывает с понятной ошибкой, не обращаясь к PostgreSQL
+	for _, action := range []string{"up", "down", "status"} {
+		err := migrateCommand(Config{DatabaseDSN: "memory://"}, []string{action}, io.Discard)
+		assert.ErrorIs(t, err, storage.ErrNoSchema, action)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Constantine-IT/gophermart/cmd/gophermart/internal/storage"
+	"io"
+	"strconv"
+)
+
+//	migrateUsage - справка по подкоманде migrate
+const migrateUsage = `usage: gophermart migrate [flags] up|down [N]|status
+   up      - применить все ещё не применённые миграции
+   down N  - откатить N последних применённых миграций (по умолчанию одну)
+   status  - показать состояние миграций`
+
+//	migrateCommand - подкоманда gophermart migrate управления схемой базы данных DatabaseDSN
+//	args - действие и его параметры, результат выводится в out
+func migrateCommand(cfg Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	db, err := storage.OpenDatabase(cfg.DatabaseDSN)
+	if errors.Is(err, storage.ErrNoSchema) { //	хранилище в оперативной памяти мигрировать нечего
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "up":
+		done, err := db.MigrateUp()
+		for _, m := range done {
+			fmt.Fprintf(out, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Fprintln(out, "schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("migrate down: N must be a positive number: %s", args[1])
+			}
+		}
+		done, err := db.MigrateDown(steps)
+		for _, m := range done {
+			fmt.Fprintf(out, "reverted %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		status, err := db.MigrationStatus()
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied at " + s.AppliedAt.Format("2006-01-02T15:04:05Z07:00")
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return err
+	default:
+		return errors.New(migrateUsage)
+	}
+}